@@ -0,0 +1,57 @@
+// Command fsck checks the localcloud catalog against DATA_DIR and optionally
+// repairs what it finds. Run it while the server is stopped.
+//
+//	fsck                      # report only
+//	fsck -fix all -dry-run    # show what would be fixed
+//	fsck -fix missing,thumbs  # fix selected categories
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"localcloud/internal/api"
+	"localcloud/internal/config"
+	"localcloud/internal/db"
+)
+
+func main() {
+	fix := flag.String("fix", "", "comma separated categories to fix (missing,untracked,paths,thumbs,uploads) or all")
+	dryRun := flag.Bool("dry-run", false, "report what -fix would change without changing anything")
+	flag.Parse()
+
+	config.LoadConfig()
+	dataDir, err := filepath.Abs(config.DataDir)
+	if err != nil {
+		log.Fatalf("invalid data dir: %v", err)
+	}
+	dbPath := filepath.Join(dataDir, "metadata.db")
+	if _, err := os.Stat(dbPath); err != nil {
+		log.Fatalf("no database at %s: %v", dbPath, err)
+	}
+	db.InitDB(dbPath)
+	api.DataDir = dataDir
+	if err := api.InitSyncDB(); err != nil {
+		log.Fatalf("InitSyncDB failed: %v", err)
+	}
+
+	rep, err := api.RunFsck(api.ParseFsckFix(*fix), *dryRun)
+	if err != nil {
+		log.Fatalf("fsck failed: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(rep)
+
+	// non-zero exit when problems remain, like fsck(8)
+	for _, entries := range rep.Categories {
+		for _, e := range entries {
+			if !e.Fixed {
+				os.Exit(1)
+			}
+		}
+	}
+}
@@ -22,7 +22,11 @@ func ensureDir(p string) error {
 func main() {
 	// Load config
 	config.LoadConfig()
-	dataDir := config.DataDir
+	// handlers compute paths relative to the data dir, so make it absolute once
+	dataDir, err := filepath.Abs(config.DataDir)
+	if err != nil {
+		log.Fatalf("invalid data dir: %v", err)
+	}
 
 	// Ensure data dir exists
 	if err := ensureDir(dataDir); err != nil {
@@ -55,6 +59,34 @@ func main() {
 	// Initialize the database
 	db.InitDB(dbPath)
 
+	// handlers and background workers resolve paths against this
+	api.DataDir = dataDir
+
+	// tags table before the metadata worker imports XMP keywords into it
+	if err := api.InitTagsDB(); err != nil {
+		log.Fatalf("InitTagsDB failed: %v", err)
+	}
+	api.XMPWrite = config.XMPWrite
+	api.PreviewClips = config.PreviewClips
+
+	// hash and metadata workers for newly uploaded files; metadata needs the
+	// geocoder for place names
+	api.LoadGeocoder(config.GeoNamesFile)
+	api.StartHashWorker(2)
+	api.StartMetadataWorker(2)
+
+	// load the thumbnail cache index, then start the worker before indexing
+	// so enqueued thumbs aren't dropped
+	api.InitThumbCache(config.ThumbCacheMaxMB << 20)
+	api.StartThumbCacheGC(config.ThumbGCInterval)
+	api.StartThumbnailWorker(3)
+
+	// HLS renditions of videos, transcoded on demand
+	api.InitStreamCache(config.StreamCacheMaxMB << 20)
+	if config.ProxyWorkers > 0 {
+		api.StartProxyWorker(config.ProxyWorkers)
+	}
+
 	// synchronous indexing at startup and enqueue thumbnails
 	go func() {
 		processed, err := db.IndexDataDirSync(dataDir)
@@ -66,6 +98,25 @@ func main() {
 		for _, apiPath := range processed {
 			api.EnqueueThumbnail(filepath.Join(dataDir, strings.TrimPrefix(apiPath, "/")))
 		}
+
+		// extract metadata and hash everything new/changed, then optionally
+		// collapse duplicates
+		api.ExtractCatalogMetadata(2)
+		api.SyncSidecars()
+		api.StartSidecarSync(config.SidecarSyncInterval)
+		api.HashCatalog(2)
+		if config.ProxyWorkers > 0 {
+			api.ProxyCatalog()
+			api.StartProxySweep(config.ProxySweepInterval)
+		}
+		if config.DedupMode != "" {
+			actions, err := api.ResolveDuplicates(config.DedupMode, "", false)
+			if err != nil {
+				log.Printf("dedup error: %v", err)
+				return
+			}
+			log.Printf("dedup (%s): resolved %d duplicates", config.DedupMode, len(actions))
+		}
 	}()
 
 	// initialize media table for sync/backup
@@ -73,13 +124,25 @@ func main() {
 		log.Fatalf("InitSyncDB failed: %v", err)
 	}
 
-	// start workers (thumbnail worker may already be started)
-	api.StartThumbnailWorker(3) // if not already started elsewhere
-
-	// start backup worker - store backups under DATA_DIR/backups (or change path)
-	backupDir := filepath.Join(dataDir, "backups")
+	// start backup worker - store backups under DATA_DIR/backups, which the
+	// catalog skips so copies are never hashed or deduplicated as originals
+	backupDir := filepath.Join(dataDir, db.BackupDir)
 	api.StartBackupWorker(3, backupDir)
 
+	// albums reference catalog rows
+	if err := api.InitAlbumsDB(); err != nil {
+		log.Fatalf("InitAlbumsDB failed: %v", err)
+	}
+	if err := api.InitSmartAlbumsDB(); err != nil {
+		log.Fatalf("InitSmartAlbumsDB failed: %v", err)
+	}
+
+	// integrity issues table + periodic scrub
+	if err := api.InitIntegrityDB(); err != nil {
+		log.Fatalf("InitIntegrityDB failed: %v", err)
+	}
+	api.StartScrubScheduler(config.ScrubInterval)
+
 	// Router
 	r := mux.NewRouter()
 
@@ -111,9 +174,6 @@ func main() {
 		})
 	}
 
-	// Start thumbnail worker (concurrency 3)
-	api.StartThumbnailWorker(3)
-
 	// Protect all routes with Basic Auth — wrap the fully configured router
 	protected := middleware.BasicAuth(r)
 
@@ -0,0 +1,523 @@
+package api
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"localcloud/internal/db"
+)
+
+// InitAlbumsDB ensures the albums and album_items tables exist.
+// Call once after db.InitDB()
+func InitAlbumsDB() error {
+	_, err := db.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS albums (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		cover_file_id INTEGER REFERENCES files(id) ON DELETE SET NULL,
+		created_at DATETIME DEFAULT (datetime('now')),
+		updated_at DATETIME DEFAULT (datetime('now'))
+	);
+	CREATE TABLE IF NOT EXISTS album_items (
+		album_id INTEGER NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+		file_id INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		added_at DATETIME DEFAULT (datetime('now')),
+		PRIMARY KEY (album_id, file_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_album_items_position ON album_items(album_id, position);
+	CREATE INDEX IF NOT EXISTS idx_album_items_file ON album_items(file_id);
+	`)
+	return err
+}
+
+// album is the JSON shape of an album (without its items)
+type album struct {
+	ID          int64                  `json:"id"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Count       int                    `json:"count"`
+	Cover       map[string]interface{} `json:"cover,omitempty"`
+	CreatedAt   string                 `json:"created_at"`
+	UpdatedAt   string                 `json:"updated_at"`
+}
+
+// albumRequest is the body of create/update calls; nil fields are left alone
+type albumRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Cover       *string `json:"cover"` // API path of an item, "" to reset
+}
+
+// albumItemsRequest is the body of add/remove/reorder calls
+type albumItemsRequest struct {
+	Paths []string `json:"paths"`
+}
+
+// albumSelect loads albums with their item count and cover. Without an
+// explicit cover the first item is used.
+const albumSelect = `
+	SELECT a.id, a.name, a.description, a.created_at, a.updated_at,
+		(SELECT COUNT(*) FROM album_items WHERE album_id = a.id),
+		COALESCE(c.filename, f.filename, ''), COALESCE(c.filepath, f.filepath, '')
+	FROM albums a
+	LEFT JOIN files c ON c.id = a.cover_file_id
+	LEFT JOIN files f ON f.id = (SELECT file_id FROM album_items WHERE album_id = a.id ORDER BY position LIMIT 1)`
+
+func scanAlbum(row interface{ Scan(...interface{}) error }) (album, error) {
+	var a album
+	var coverName, coverPath string
+	if err := row.Scan(&a.ID, &a.Name, &a.Description, &a.CreatedAt, &a.UpdatedAt, &a.Count, &coverName, &coverPath); err != nil {
+		return a, err
+	}
+	if coverPath != "" {
+		p := relAPIPath(catalogAbs(coverPath))
+		a.Cover = map[string]interface{}{
+			"name":   coverName,
+			"path":   p,
+			"thumb":  thumbURL(p, defaultRendition),
+			"srcset": thumbSrcset(p),
+		}
+	}
+	return a, nil
+}
+
+func loadAlbum(id int64) (album, error) {
+	return scanAlbum(db.DB.QueryRow(albumSelect+" WHERE a.id = ?", id))
+}
+
+// albumIDFromRequest parses the {id} route variable
+func albumIDFromRequest(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(muxVars(r)["id"], 10, 64)
+	return id, err == nil && id > 0
+}
+
+// catalogIDForPath returns the files.id for an API path, adding the file to
+// the catalog first if the indexer hasn't seen it yet.
+func catalogIDForPath(p string) (int64, error) {
+	abs, err := absClean(DataDir, p)
+	if err != nil {
+		return 0, err
+	}
+	rel, _ := filepath.Rel(DataDir, abs)
+	if shouldIgnoreFile(path.Base(p)) || db.SkipIndexPath(rel) {
+		return 0, fmt.Errorf("%s: not found", p)
+	}
+	if id := catalogFileID(abs); id != 0 {
+		return id, nil
+	}
+	fi, err := os.Stat(abs)
+	if err != nil || fi.IsDir() {
+		return 0, fmt.Errorf("%s: not found", p)
+	}
+	if err := db.UpsertFile(relAPIPath(abs), fi); err != nil {
+		return 0, err
+	}
+	EnqueueThumbnail(abs)
+	EnqueueHash(abs)
+	EnqueueMetadata(abs, false)
+	if id := catalogFileID(abs); id != 0 {
+		return id, nil
+	}
+	return 0, fmt.Errorf("%s: not in catalog", p)
+}
+
+func writeAlbumJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func touchAlbum(id int64) {
+	_, _ = db.DB.Exec("UPDATE albums SET updated_at = datetime('now') WHERE id = ?", id)
+}
+
+// AlbumsHandler lists albums (GET) or creates one (POST {"name","description"}).
+// GET|POST /api/albums
+func AlbumsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req albumRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if req.Name == nil || strings.TrimSpace(*req.Name) == "" {
+			http.Error(w, "name required", http.StatusBadRequest)
+			return
+		}
+		desc := ""
+		if req.Description != nil {
+			desc = *req.Description
+		}
+		res, err := db.DB.Exec("INSERT INTO albums(name, description) VALUES(?, ?)", strings.TrimSpace(*req.Name), desc)
+		if err != nil {
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, _ := res.LastInsertId()
+		a, err := loadAlbum(id)
+		if err != nil {
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAlbumJSON(w, http.StatusCreated, a)
+		return
+	}
+
+	rows, err := db.DB.Query(albumSelect + " ORDER BY a.updated_at DESC, a.id DESC")
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	albums := []album{}
+	for rows.Next() {
+		a, err := scanAlbum(rows)
+		if err != nil {
+			log.Printf("albums: row scan: %v", err)
+			continue
+		}
+		albums = append(albums, a)
+	}
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{"albums": albums})
+}
+
+// AlbumHandler returns an album with a page of its items in GridHandler's
+// shape (GET), updates name/description/cover (PUT) or deletes it (DELETE).
+// Deleting an album never touches the files in it.
+// GET    /api/albums/{id}?offset=0&limit=60
+// PUT    /api/albums/{id}  {"name","description","cover":"/path"}
+// DELETE /api/albums/{id}
+func AlbumHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := albumIDFromRequest(r)
+	if !ok {
+		http.Error(w, "invalid album id", http.StatusBadRequest)
+		return
+	}
+	a, err := loadAlbum(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "album not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		if _, err := db.DB.Exec("DELETE FROM albums WHERE id = ?", id); err != nil {
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAlbumJSON(w, http.StatusOK, map[string]interface{}{"deleted": id})
+		return
+
+	case http.MethodPut:
+		var req albumRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if req.Name != nil {
+			if strings.TrimSpace(*req.Name) == "" {
+				http.Error(w, "name must not be empty", http.StatusBadRequest)
+				return
+			}
+			_, err = db.DB.Exec("UPDATE albums SET name = ? WHERE id = ?", strings.TrimSpace(*req.Name), id)
+		}
+		if err == nil && req.Description != nil {
+			_, err = db.DB.Exec("UPDATE albums SET description = ? WHERE id = ?", *req.Description, id)
+		}
+		if err == nil && req.Cover != nil {
+			var cover interface{}
+			if *req.Cover != "" {
+				fid, cerr := catalogIDForPath(*req.Cover)
+				if cerr != nil {
+					http.Error(w, "cover: "+cerr.Error(), http.StatusBadRequest)
+					return
+				}
+				cover = fid
+			}
+			_, err = db.DB.Exec("UPDATE albums SET cover_file_id = ? WHERE id = ?", cover, id)
+		}
+		if err != nil {
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		touchAlbum(id)
+		if a, err = loadAlbum(id); err != nil {
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAlbumJSON(w, http.StatusOK, a)
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 60
+	}
+	items, err := albumItems(id, offset, limit)
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{
+		"album":  a,
+		"items":  items,
+		"offset": offset,
+		"limit":  limit,
+		"total":  a.Count,
+	})
+}
+
+// albumFile is an album member as stored in the catalog
+type albumFile struct {
+	name, path string
+}
+
+// albumFiles returns the members of an album in album order
+func albumFiles(id int64, offset, limit int) ([]albumFile, error) {
+	rows, err := db.DB.Query(`SELECT f.filename, f.filepath FROM album_items ai
+		JOIN files f ON f.id = ai.file_id
+		WHERE ai.album_id = ? ORDER BY ai.position, ai.added_at LIMIT ? OFFSET ?`, id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []albumFile
+	for rows.Next() {
+		var f albumFile
+		if err := rows.Scan(&f.name, &f.path); err == nil {
+			out = append(out, f)
+		}
+	}
+	return out, rows.Err()
+}
+
+// albumItems returns a page of album members shaped like GridHandler items
+func albumItems(id int64, offset, limit int) ([]map[string]interface{}, error) {
+	files, err := albumFiles(id, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	items := []map[string]interface{}{}
+	for _, f := range files {
+		abs := catalogAbs(f.path)
+		apiPath := relAPIPath(abs)
+		item := map[string]interface{}{
+			"name":   f.name,
+			"path":   apiPath,
+			"type":   "file",
+			"mime":   mimeTypeFor(f.name),
+			"thumb":  thumbURL(apiPath, defaultRendition),
+			"srcset": thumbSrcset(apiPath),
+		}
+		if info, err := os.Stat(resolveFile(abs)); err == nil {
+			item["modified"] = info.ModTime().Format(time.RFC3339)
+			item["size"] = info.Size()
+		} else {
+			item["missing"] = true
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// mimeTypeFor is the grid's mime fallback for a file name
+func mimeTypeFor(name string) string {
+	mt := mime.TypeByExtension(strings.ToLower(path.Ext(name)))
+	if mt == "" {
+		mt = "application/octet-stream"
+	}
+	return mt
+}
+
+// AlbumItemsHandler adds (POST) or removes (DELETE) assets, given by API path.
+// Added assets go to the end of the album; ones already in it are skipped.
+// POST|DELETE /api/albums/{id}/items  {"paths":["/a.jpg","/trip/b.jpg"]}
+func AlbumItemsHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := albumIDFromRequest(r)
+	if !ok {
+		http.Error(w, "invalid album id", http.StatusBadRequest)
+		return
+	}
+	if _, err := loadAlbum(id); err != nil {
+		http.Error(w, "album not found", http.StatusNotFound)
+		return
+	}
+	var req albumItemsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Paths) == 0 {
+		http.Error(w, "paths required", http.StatusBadRequest)
+		return
+	}
+
+	changed := 0
+	errs := map[string]string{}
+	for _, p := range req.Paths {
+		fid, err := catalogIDForPath(p)
+		if err != nil {
+			errs[p] = err.Error()
+			continue
+		}
+		var res sql.Result
+		if r.Method == http.MethodDelete {
+			res, err = db.DB.Exec("DELETE FROM album_items WHERE album_id = ? AND file_id = ?", id, fid)
+		} else {
+			res, err = db.DB.Exec(`INSERT OR IGNORE INTO album_items(album_id, file_id, position)
+				VALUES(?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM album_items WHERE album_id = ?))`, id, fid, id)
+		}
+		if err != nil {
+			errs[p] = err.Error()
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			changed++
+		}
+	}
+	if changed > 0 {
+		touchAlbum(id)
+	}
+	a, _ := loadAlbum(id)
+	resp := map[string]interface{}{"album": a, "changed": changed}
+	if len(errs) > 0 {
+		resp["errors"] = errs
+	}
+	writeAlbumJSON(w, http.StatusOK, resp)
+}
+
+// AlbumOrderHandler reorders an album. Listed assets come first in the given
+// order; the rest keep their relative order after them.
+// PUT /api/albums/{id}/order  {"paths":["/b.jpg","/a.jpg"]}
+func AlbumOrderHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := albumIDFromRequest(r)
+	if !ok {
+		http.Error(w, "invalid album id", http.StatusBadRequest)
+		return
+	}
+	if _, err := loadAlbum(id); err != nil {
+		http.Error(w, "album not found", http.StatusNotFound)
+		return
+	}
+	var req albumItemsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	rows, err := db.DB.Query("SELECT file_id FROM album_items WHERE album_id = ? ORDER BY position, added_at", id)
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var current []int64
+	for rows.Next() {
+		var fid int64
+		if err := rows.Scan(&fid); err == nil {
+			current = append(current, fid)
+		}
+	}
+	rows.Close()
+
+	member := map[int64]bool{}
+	for _, fid := range current {
+		member[fid] = true
+	}
+	var order []int64
+	placed := map[int64]bool{}
+	for _, p := range req.Paths {
+		abs, err := absClean(DataDir, p)
+		if err != nil {
+			continue
+		}
+		if fid := catalogFileID(abs); member[fid] && !placed[fid] {
+			order = append(order, fid)
+			placed[fid] = true
+		}
+	}
+	for _, fid := range current {
+		if !placed[fid] {
+			order = append(order, fid)
+		}
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, fid := range order {
+		if _, err := tx.Exec("UPDATE album_items SET position = ? WHERE album_id = ? AND file_id = ?", i+1, id, fid); err != nil {
+			_ = tx.Rollback()
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	touchAlbum(id)
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{"id": id, "count": len(order)})
+}
+
+// AlbumZipHandler streams all album assets as a zip, in album order. Entries
+// are flat; name clashes from different folders get a " (2)" suffix.
+// GET /api/albums/{id}/zip
+func AlbumZipHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := albumIDFromRequest(r)
+	if !ok {
+		http.Error(w, "invalid album id", http.StatusBadRequest)
+		return
+	}
+	a, err := loadAlbum(id)
+	if err != nil {
+		http.Error(w, "album not found", http.StatusNotFound)
+		return
+	}
+	files, err := albumFiles(id, 0, -1)
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	zipName := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, a.Name) + ".zip"
+
+	streamZip(w, zipName, func(zw *zip.Writer) error {
+		// lowercased entry names taken so far; a suffixed name can clash with
+		// a real one ("x (2).jpg"), so suffixes are checked against it too
+		used := map[string]bool{}
+		for _, f := range files {
+			abs := resolveFile(catalogAbs(f.path))
+			if _, err := os.Stat(abs); err != nil {
+				continue
+			}
+			name := f.name
+			ext := path.Ext(name)
+			for n := 2; used[strings.ToLower(name)]; n++ {
+				name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(f.name, ext), n, ext)
+			}
+			used[strings.ToLower(name)] = true
+			if err := addFileToZip(zw, abs, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,786 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/disintegration/imaging"
+)
+
+func init() {
+	_ = mime.AddExtensionType(".mp3", "audio/mpeg")
+	_ = mime.AddExtensionType(".flac", "audio/flac")
+	_ = mime.AddExtensionType(".m4a", "audio/mp4")
+	_ = mime.AddExtensionType(".ogg", "audio/ogg")
+	_ = mime.AddExtensionType(".oga", "audio/ogg")
+	_ = mime.AddExtensionType(".opus", "audio/ogg")
+}
+
+// audioExts are the music formats whose tags we read: ID3 (MP3), Vorbis
+// comments (FLAC, Ogg Vorbis, Opus) and iTunes atoms (M4A)
+var audioExts = []string{".mp3", ".flac", ".m4a", ".ogg", ".oga", ".opus"}
+
+// isAudioExt reports whether ext (lowercase, with dot) is a supported music format
+func isAudioExt(ext string) bool {
+	for _, e := range audioExts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAudioTagBytes bounds how much tag data is read; big enough for
+// embedded cover art, small enough that a corrupt size can't exhaust memory
+const maxAudioTagBytes = 32 << 20
+
+// audioTags is what a music file says about itself
+type audioTags struct {
+	Title       string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Genre       string
+	Track       int
+	Disc        int
+	Year        int
+	Duration    float64 // seconds, when the container records it
+	Cover       []byte  // embedded picture (JPEG or PNG)
+	coverType   int     // picture type of Cover; 3 = front cover
+}
+
+// setCover keeps the front cover, or else the first picture
+func (t *audioTags) setCover(data []byte, picType int) {
+	if len(data) == 0 {
+		return
+	}
+	if t.Cover == nil || (picType == 3 && t.coverType != 3) {
+		t.Cover, t.coverType = data, picType
+	}
+}
+
+// set stores a tag by its Vorbis comment name. The first value wins, so
+// ID3v2 beats ID3v1 and a track's own artist beats later duplicates.
+func (t *audioTags) set(key, v string) {
+	v = strings.TrimSpace(strings.TrimRight(v, "\x00"))
+	if v == "" {
+		return
+	}
+	setStr := func(dst *string) {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+	setInt := func(dst *int, n int) {
+		if *dst == 0 {
+			*dst = n
+		}
+	}
+	switch key {
+	case "title":
+		setStr(&t.Title)
+	case "artist":
+		setStr(&t.Artist)
+	case "albumartist", "album artist", "album_artist":
+		setStr(&t.AlbumArtist)
+	case "album":
+		setStr(&t.Album)
+	case "genre":
+		if t.Genre == "" {
+			t.Genre = id3Genre(v)
+		}
+	case "tracknumber", "track":
+		setInt(&t.Track, leadingInt(v))
+	case "discnumber", "disc":
+		setInt(&t.Disc, leadingInt(v))
+	case "date", "year":
+		setInt(&t.Year, yearOf(v))
+	}
+}
+
+// leadingInt parses "3" and "3/12" as 3
+func leadingInt(s string) int {
+	s, _, _ = strings.Cut(s, "/")
+	n, _ := strconv.Atoi(strings.TrimSpace(s))
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// yearOf returns the year of "2001", "2001-05-12" or "2001-05-12T10:00:00"
+func yearOf(s string) int {
+	if len(s) < 4 {
+		return 0
+	}
+	n, err := strconv.Atoi(s[:4])
+	if err != nil || n < 1000 {
+		return 0
+	}
+	return n
+}
+
+// id3v1Genres are the original ID3v1 genre numbers, still used by "(17)"
+// style TCON frames
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop", "Jazz", "Metal",
+	"New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk",
+	"Fusion", "Trance", "Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic",
+	"Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta",
+	"Top 40", "Christian Rap", "Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes",
+	"Trailer", "Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+var id3GenreRef = regexp.MustCompile(`^\((\d+)\)(.*)$`)
+
+// id3Genre resolves numeric genre references: "17", "(17)" -> "Rock";
+// "(17)Rock & Roll" keeps the refinement
+func id3Genre(v string) string {
+	n := -1
+	if m := id3GenreRef.FindStringSubmatch(v); m != nil {
+		if m[2] != "" {
+			return strings.TrimSpace(m[2])
+		}
+		n, _ = strconv.Atoi(m[1])
+	} else if i, err := strconv.Atoi(v); err == nil {
+		n = i
+	}
+	if n >= 0 {
+		if n < len(id3v1Genres) {
+			return id3v1Genres[n]
+		}
+		return ""
+	}
+	return v
+}
+
+// readAudioTags reads the tags of a music file, detecting the container
+// from its first bytes rather than trusting the extension
+func readAudioTags(abs string) (audioTags, error) {
+	var t audioTags
+	f, err := os.Open(abs)
+	if err != nil {
+		return t, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return t, err
+	}
+	size := fi.Size()
+	magic := make([]byte, 8)
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return t, fmt.Errorf("audio tags: %w", err)
+	}
+	switch {
+	case string(magic[4:8]) == "ftyp":
+		err = parseMP4Tags(f, size, &t)
+	case string(magic[:4]) == "OggS":
+		err = parseOggTags(f, size, &t)
+	default:
+		// MP3 (ID3v2 and/or ID3v1), or FLAC, sometimes behind an ID3v2 tag
+		var off int64
+		if off, err = parseID3v2(f, &t); err != nil {
+			return t, err
+		}
+		head := make([]byte, 4)
+		if _, rerr := f.ReadAt(head, off); rerr == nil && string(head) == "fLaC" {
+			err = parseFLACTags(f, off, &t)
+		} else {
+			parseID3v1(f, size, &t)
+		}
+	}
+	return t, err
+}
+
+// ---------------------- cover art ----------------------
+
+// folderCovers are the album art files players and rippers leave next to
+// the tracks, in order of preference
+var folderCovers = []string{"cover", "folder", "front", "albumart", "album"}
+
+// generateAudioThumbnail thumbnails the embedded cover of a music file, or
+// else the album art in its folder. Without either there is no thumbnail;
+// unlike photos, covers aren't perceptually hashed, since every track of an
+// album shares one.
+func generateAudioThumbnail(abs, dst string, maxDim int) error {
+	t, _ := readAudioTags(abs)
+	var img image.Image
+	var err error
+	if t.Cover != nil {
+		img, err = imaging.Decode(bytes.NewReader(t.Cover))
+	}
+	if img == nil {
+		cover := folderCover(filepath.Dir(abs))
+		if cover == "" {
+			if err == nil {
+				err = fmt.Errorf("no cover art")
+			}
+			return fmt.Errorf("%s: %w", abs, err)
+		}
+		if img, err = imaging.Open(cover); err != nil {
+			return err
+		}
+	}
+	thumb := imaging.Thumbnail(img, maxDim, maxDim, imaging.Lanczos)
+	return imaging.Save(thumb, dst, imaging.JPEGQuality(82))
+}
+
+// folderCover finds cover.jpg, Folder.png etc. in dir (any case)
+func folderCover(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, want := range folderCovers {
+		for _, e := range entries {
+			name := e.Name()
+			ext := strings.ToLower(filepath.Ext(name))
+			if !e.IsDir() && (ext == ".jpg" || ext == ".jpeg" || ext == ".png") &&
+				strings.EqualFold(strings.TrimSuffix(name, filepath.Ext(name)), want) {
+				return filepath.Join(dir, name)
+			}
+		}
+	}
+	return ""
+}
+
+// ---------------------- ID3 ----------------------
+
+// id3Frames maps ID3v2.3/2.4 and v2.2 frame ids to Vorbis comment names
+var id3Frames = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TPE2": "albumartist", "TP2": "albumartist",
+	"TALB": "album", "TAL": "album",
+	"TRCK": "track", "TRK": "track",
+	"TPOS": "disc", "TPA": "disc",
+	"TYER": "year", "TYE": "year", "TDRC": "date",
+	"TCON": "genre", "TCO": "genre",
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// unsynchronise reverses ID3 unsynchronisation (0xFF 0x00 -> 0xFF)
+func unsynchronise(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xff, 0x00}, []byte{0xff})
+}
+
+// parseID3v2 reads an ID3v2 tag at the start of r, if there is one, and
+// returns the offset of the audio data behind it
+func parseID3v2(r io.ReaderAt, t *audioTags) (int64, error) {
+	hdr := make([]byte, 10)
+	if _, err := r.ReadAt(hdr, 0); err != nil || string(hdr[:3]) != "ID3" {
+		return 0, nil
+	}
+	ver, flags, size := hdr[3], hdr[5], syncsafe(hdr[6:10])
+	end := int64(10 + size)
+	if flags&0x10 != 0 {
+		end += 10 // v2.4 footer
+	}
+	if ver < 2 || ver > 4 {
+		return end, nil
+	}
+	if size > maxAudioTagBytes {
+		return end, fmt.Errorf("id3: tag of %d bytes", size)
+	}
+	body := make([]byte, size)
+	if _, err := r.ReadAt(body, 10); err != nil {
+		return end, fmt.Errorf("id3: %w", err)
+	}
+	if ver < 4 && flags&0x80 != 0 {
+		body = unsynchronise(body)
+	}
+	pos := 0
+	if flags&0x40 != 0 && len(body) >= 4 {
+		// skip the extended header
+		if ver == 3 {
+			pos = 4 + int(binary.BigEndian.Uint32(body))
+		} else if ver == 4 {
+			pos = syncsafe(body)
+		}
+	}
+	idLen, hdrLen := 4, 10
+	if ver == 2 {
+		idLen, hdrLen = 3, 6
+	}
+	for pos >= 0 && pos+hdrLen <= len(body) && body[pos] != 0 {
+		id := string(body[pos : pos+idLen])
+		var fsize int
+		var fflags byte
+		switch ver {
+		case 2:
+			fsize = int(body[pos+3])<<16 | int(body[pos+4])<<8 | int(body[pos+5])
+		case 3:
+			fsize, fflags = int(binary.BigEndian.Uint32(body[pos+4:])), body[pos+9]
+		case 4:
+			fsize, fflags = syncsafe(body[pos+4:pos+8]), body[pos+9]
+		}
+		pos += hdrLen
+		if fsize < 0 || pos+fsize > len(body) {
+			break
+		}
+		data := body[pos : pos+fsize]
+		pos += fsize
+		// compressed or encrypted frames aren't worth supporting
+		if (ver == 3 && fflags&0xc0 != 0) || (ver == 4 && fflags&0x0c != 0) {
+			continue
+		}
+		if ver == 4 {
+			if fflags&0x02 != 0 {
+				data = unsynchronise(data)
+			}
+			if fflags&0x01 != 0 {
+				if len(data) < 4 {
+					continue
+				}
+				data = data[4:] // data length indicator
+			}
+		}
+		switch {
+		case id == "APIC" && len(data) > 1:
+			// encoding, MIME type, picture type, description, data
+			enc, rest := data[0], data[1:]
+			if i := bytes.IndexByte(rest, 0); i >= 0 && i+1 < len(rest) {
+				picType := int(rest[i+1])
+				t.setCover(skipID3String(enc, rest[i+2:]), picType)
+			}
+		case id == "PIC" && len(data) > 5:
+			// encoding, 3-byte format, picture type, description, data
+			t.setCover(skipID3String(data[0], data[5:]), int(data[4]))
+		case id3Frames[id] != "" && len(data) > 1:
+			t.set(id3Frames[id], decodeID3Text(data[0], data[1:]))
+		}
+	}
+	return end, nil
+}
+
+// decodeID3Text decodes a text frame; of v2.4 multi-value frames the first
+// value is kept
+func decodeID3Text(enc byte, b []byte) string {
+	var s string
+	switch enc {
+	case 1, 2:
+		s = decodeUTF16(b, enc == 2)
+	case 3:
+		s = string(b)
+	default:
+		s = latin1(b)
+	}
+	s, _, _ = strings.Cut(s, "\x00")
+	return s
+}
+
+// decodeUTF16 decodes UTF-16 with a BOM, or big-endian without one if be
+func decodeUTF16(b []byte, be bool) string {
+	if len(b) >= 2 {
+		switch {
+		case b[0] == 0xfe && b[1] == 0xff:
+			be, b = true, b[2:]
+		case b[0] == 0xff && b[1] == 0xfe:
+			be, b = false, b[2:]
+		}
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		if be {
+			u[i] = binary.BigEndian.Uint16(b[2*i:])
+		} else {
+			u[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
+func latin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// skipID3String returns what follows a NUL-terminated string in encoding enc
+func skipID3String(enc byte, b []byte) []byte {
+	if enc == 1 || enc == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[i+2:]
+			}
+		}
+		return nil
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[i+1:]
+	}
+	return nil
+}
+
+// parseID3v1 fills in what ID3v2 didn't from the 128-byte tag at the end
+func parseID3v1(r io.ReaderAt, size int64, t *audioTags) {
+	if size < 128 {
+		return
+	}
+	b := make([]byte, 128)
+	if _, err := r.ReadAt(b, size-128); err != nil || string(b[:3]) != "TAG" {
+		return
+	}
+	field := func(f []byte) string {
+		if i := bytes.IndexByte(f, 0); i >= 0 {
+			f = f[:i]
+		}
+		return latin1(f)
+	}
+	t.set("title", field(b[3:33]))
+	t.set("artist", field(b[33:63]))
+	t.set("album", field(b[63:93]))
+	t.set("year", field(b[93:97]))
+	if b[125] == 0 && b[126] != 0 {
+		// ID3v1.1 keeps the track number in the last comment byte
+		t.set("track", strconv.Itoa(int(b[126])))
+	}
+	if int(b[127]) < len(id3v1Genres) {
+		t.set("genre", id3v1Genres[b[127]])
+	}
+}
+
+// ---------------------- FLAC / Vorbis comments ----------------------
+
+// parseFLACTags reads the metadata blocks of the FLAC stream at off:
+// STREAMINFO for the duration, VORBIS_COMMENT and PICTURE
+func parseFLACTags(r io.ReaderAt, off int64, t *audioTags) error {
+	pos := off + 4
+	hdr := make([]byte, 4)
+	for read := 0; ; {
+		if _, err := r.ReadAt(hdr, pos); err != nil {
+			return fmt.Errorf("flac: %w", err)
+		}
+		last, typ := hdr[0]&0x80 != 0, hdr[0]&0x7f
+		n := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+		if read += n; read > maxAudioTagBytes {
+			return fmt.Errorf("flac: metadata too large")
+		}
+		if typ == 0 || typ == 4 || typ == 6 {
+			b := make([]byte, n)
+			if _, err := r.ReadAt(b, pos+4); err != nil {
+				return fmt.Errorf("flac: %w", err)
+			}
+			switch typ {
+			case 0:
+				if len(b) >= 18 {
+					rate := int(b[10])<<12 | int(b[11])<<4 | int(b[12])>>4
+					samples := uint64(b[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(b[14:18]))
+					if rate > 0 {
+						t.Duration = float64(samples) / float64(rate)
+					}
+				}
+			case 4:
+				parseVorbisComment(b, t)
+			case 6:
+				parseFLACPicture(b, t)
+			}
+		}
+		pos += 4 + int64(n)
+		if last {
+			return nil
+		}
+	}
+}
+
+// parseVorbisComment reads a Vorbis comment block (little-endian lengths,
+// "KEY=value" entries); cover art comes as base64 METADATA_BLOCK_PICTURE
+func parseVorbisComment(b []byte, t *audioTags) {
+	next := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		if n < 0 || n > len(b)-4 {
+			return nil, false
+		}
+		v := b[4 : 4+n]
+		b = b[4+n:]
+		return v, true
+	}
+	if _, ok := next(); !ok { // vendor string
+		return
+	}
+	if len(b) < 4 {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	for i := 0; i < count; i++ {
+		c, ok := next()
+		if !ok {
+			return
+		}
+		k, v, ok := strings.Cut(string(c), "=")
+		if !ok {
+			continue
+		}
+		k = strings.ToLower(k)
+		if k == "metadata_block_picture" {
+			if pic, err := base64.StdEncoding.DecodeString(v); err == nil {
+				parseFLACPicture(pic, t)
+			}
+			continue
+		}
+		t.set(k, v)
+	}
+}
+
+// parseFLACPicture reads a FLAC PICTURE block: type, MIME, description,
+// dimensions, then the image (big-endian lengths)
+func parseFLACPicture(b []byte, t *audioTags) {
+	u32 := func() (int, bool) {
+		if len(b) < 4 {
+			return 0, false
+		}
+		v := int(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		return v, v >= 0
+	}
+	skip := func() bool {
+		n, ok := u32()
+		if !ok || n > len(b) {
+			return false
+		}
+		b = b[n:]
+		return true
+	}
+	picType, ok := u32()
+	if !ok || !skip() || !skip() || len(b) < 16 {
+		return
+	}
+	b = b[16:] // width, height, depth, colors
+	n, ok := u32()
+	if !ok || n > len(b) {
+		return
+	}
+	t.setCover(b[:n], picType)
+}
+
+// parseOggTags reads the identification and comment headers of an Ogg
+// Vorbis or Opus stream, and the duration from the last page's granule
+func parseOggTags(f *os.File, size int64, t *audioTags) error {
+	br := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	var packets [][]byte
+	var cur []byte
+	var serial uint32
+	hdr := make([]byte, 27)
+	for read, first := 0, true; len(packets) < 2; first = false {
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return fmt.Errorf("ogg: %w", err)
+		}
+		if string(hdr[:4]) != "OggS" {
+			return fmt.Errorf("ogg: bad page")
+		}
+		segs := make([]byte, hdr[26])
+		if _, err := io.ReadFull(br, segs); err != nil {
+			return fmt.Errorf("ogg: %w", err)
+		}
+		total := 0
+		for _, s := range segs {
+			total += int(s)
+		}
+		if read += 27 + len(segs) + total; read > maxAudioTagBytes {
+			return fmt.Errorf("ogg: headers too large")
+		}
+		body := make([]byte, total)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return fmt.Errorf("ogg: %w", err)
+		}
+		// other logical streams (e.g. a video track) are skipped
+		if s := binary.LittleEndian.Uint32(hdr[14:18]); first {
+			serial = s
+		} else if s != serial {
+			continue
+		}
+		off := 0
+		for _, s := range segs {
+			cur = append(cur, body[off:off+int(s)]...)
+			off += int(s)
+			if s < 255 && len(packets) < 2 {
+				packets = append(packets, cur)
+				cur = nil
+			}
+		}
+	}
+
+	id, comments := packets[0], packets[1]
+	var rate float64
+	var preskip int64
+	switch {
+	case bytes.HasPrefix(id, []byte("\x01vorbis")) && len(id) >= 16 && bytes.HasPrefix(comments, []byte("\x03vorbis")):
+		rate = float64(binary.LittleEndian.Uint32(id[12:16]))
+		parseVorbisComment(comments[7:], t)
+	case bytes.HasPrefix(id, []byte("OpusHead")) && len(id) >= 12 && bytes.HasPrefix(comments, []byte("OpusTags")):
+		// Opus granules always count 48 kHz samples
+		rate, preskip = 48000, int64(binary.LittleEndian.Uint16(id[10:12]))
+		parseVorbisComment(comments[8:], t)
+	default:
+		return fmt.Errorf("ogg: not Vorbis or Opus")
+	}
+
+	tail := int64(65536)
+	if tail > size {
+		tail = size
+	}
+	buf := make([]byte, tail)
+	if _, err := f.ReadAt(buf, size-tail); err == nil || err == io.EOF {
+		if i := bytes.LastIndex(buf, []byte("OggS")); i >= 0 && i+14 <= len(buf) {
+			g := int64(binary.LittleEndian.Uint64(buf[i+6 : i+14]))
+			if rate > 0 && g > preskip {
+				t.Duration = float64(g-preskip) / rate
+			}
+		}
+	}
+	return nil
+}
+
+// ---------------------- MP4 / iTunes atoms ----------------------
+
+// mp4Items maps iTunes ilst atoms to Vorbis comment names
+var mp4Items = map[string]string{
+	"\xa9nam": "title",
+	"\xa9ART": "artist",
+	"aART":    "albumartist",
+	"\xa9alb": "album",
+	"\xa9day": "date",
+	"\xa9gen": "genre",
+}
+
+// mp4Children calls fn for each atom between start and end
+func mp4Children(r io.ReaderAt, start, end int64, fn func(typ string, body, end int64) error) error {
+	b := make([]byte, 16)
+	for off := start; off+8 <= end; {
+		if _, err := r.ReadAt(b[:8], off); err != nil {
+			return fmt.Errorf("mp4: %w", err)
+		}
+		size, typ, hdr := int64(binary.BigEndian.Uint32(b)), string(b[4:8]), int64(8)
+		switch size {
+		case 0:
+			size = end - off
+		case 1:
+			if _, err := r.ReadAt(b[8:16], off+8); err != nil {
+				return fmt.Errorf("mp4: %w", err)
+			}
+			size, hdr = int64(binary.BigEndian.Uint64(b[8:16])), 16
+		}
+		if size < hdr || off+size > end {
+			return fmt.Errorf("mp4: bad %q atom", typ)
+		}
+		if err := fn(typ, off+hdr, off+size); err != nil {
+			return err
+		}
+		off += size
+	}
+	return nil
+}
+
+// parseMP4Tags reads moov/mvhd for the duration and moov/udta/meta/ilst for
+// the iTunes tags
+func parseMP4Tags(r io.ReaderAt, size int64, t *audioTags) error {
+	var ilst func(typ string, body, end int64) error
+	ilst = func(typ string, body, end int64) error {
+		n := end - body
+		if n > maxAudioTagBytes || n < 16 {
+			return nil
+		}
+		b := make([]byte, n)
+		if _, err := r.ReadAt(b, body); err != nil {
+			return fmt.Errorf("mp4: %w", err)
+		}
+		// the value is in a "data" atom: size, "data", type, locale, value
+		dsize := int(binary.BigEndian.Uint32(b))
+		if string(b[4:8]) != "data" || dsize < 16 || dsize > len(b) {
+			return nil
+		}
+		v := b[16:dsize]
+		switch typ {
+		case "trkn", "disk":
+			if len(v) >= 4 {
+				key := map[string]string{"trkn": "track", "disk": "disc"}[typ]
+				t.set(key, strconv.Itoa(int(binary.BigEndian.Uint16(v[2:4]))))
+			}
+		case "gnre":
+			if len(v) >= 2 {
+				if g := int(binary.BigEndian.Uint16(v)) - 1; g >= 0 && g < len(id3v1Genres) {
+					t.set("genre", id3v1Genres[g])
+				}
+			}
+		case "covr":
+			t.setCover(v, 3)
+		default:
+			if key := mp4Items[typ]; key != "" {
+				t.set(key, string(v))
+			}
+		}
+		return nil
+	}
+	meta := func(typ string, body, end int64) error {
+		if typ == "ilst" {
+			return mp4Children(r, body, end, ilst)
+		}
+		return nil
+	}
+	udta := func(typ string, body, end int64) error {
+		if typ != "meta" {
+			return nil
+		}
+		// iTunes meta is a full box (4 bytes version/flags before the
+		// children); QuickTime's isn't
+		b := make([]byte, 8)
+		if _, err := r.ReadAt(b, body); err != nil {
+			return fmt.Errorf("mp4: %w", err)
+		}
+		if string(b[4:8]) != "hdlr" {
+			body += 4
+		}
+		return mp4Children(r, body, end, meta)
+	}
+	moov := func(typ string, body, end int64) error {
+		switch typ {
+		case "mvhd":
+			b := make([]byte, 32)
+			if _, err := r.ReadAt(b, body); err != nil {
+				return fmt.Errorf("mp4: %w", err)
+			}
+			var scale, dur float64
+			if b[0] == 1 {
+				scale, dur = float64(binary.BigEndian.Uint32(b[20:24])), float64(binary.BigEndian.Uint64(b[24:32]))
+			} else {
+				scale, dur = float64(binary.BigEndian.Uint32(b[12:16])), float64(binary.BigEndian.Uint32(b[16:20]))
+			}
+			if scale > 0 {
+				t.Duration = dur / scale
+			}
+		case "udta":
+			return mp4Children(r, body, end, udta)
+		}
+		return nil
+	}
+	return mp4Children(r, 0, size, func(typ string, body, end int64) error {
+		if typ == "moov" {
+			return mp4Children(r, body, end, moov)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The fixtures are built here rather than kept as files: only the tag
+// bytes matter, and building them shows what each one exercises.
+
+var testCover = []byte("\xff\xd8\xff\xe0 not really a JPEG \xff\xd9")
+
+func putSyncsafe(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+// synchronise applies ID3 unsynchronisation (0xFF -> 0xFF 0x00)
+func synchronise(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xff}, []byte{0xff, 0x00})
+}
+
+// id3Frame is a v2.3 frame, or a v2.4 frame when flags has v2.4 bits set;
+// v2.4 frames with the unsynchronisation flag (0x02) are synchronised here
+func id3Frame(ver byte, id string, flags byte, data []byte) []byte {
+	if ver == 4 && flags&0x02 != 0 {
+		data = synchronise(data)
+	}
+	b := []byte(id)
+	if ver == 4 {
+		b = append(b, putSyncsafe(len(data))...)
+	} else {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	}
+	return append(append(b, 0, flags), data...)
+}
+
+// id3Tag wraps frames in an ID3v2 header; flag 0x80 synchronises the whole
+// tag as v2.3 does
+func id3Tag(ver, flags byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	if flags&0x80 != 0 {
+		body = synchronise(body)
+	}
+	b := append([]byte{'I', 'D', '3', ver, 0, flags}, putSyncsafe(len(body))...)
+	return append(b, body...)
+}
+
+func latin1Text(s string) []byte { return append([]byte{0}, s...) }
+
+func apicFrame(picType byte) []byte {
+	b := append([]byte{0}, "image/jpeg\x00"...)
+	b = append(b, picType)
+	b = append(b, "cover\x00"...)
+	return append(b, testCover...)
+}
+
+// flacPicture is a PICTURE block body
+func flacPicture(picType uint32, data []byte) []byte {
+	var b []byte
+	b = binary.BigEndian.AppendUint32(b, picType)
+	b = binary.BigEndian.AppendUint32(b, uint32(len("image/jpeg")))
+	b = append(b, "image/jpeg"...)
+	b = binary.BigEndian.AppendUint32(b, 0) // description
+	b = append(b, make([]byte, 16)...)      // width, height, depth, colors
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// vorbisComment is a comment header body without any framing
+func vorbisComment(comments ...string) []byte {
+	var b []byte
+	b = binary.LittleEndian.AppendUint32(b, uint32(len("test")))
+	b = append(b, "test"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(comments)))
+	for _, c := range comments {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(c)))
+		b = append(b, c...)
+	}
+	return b
+}
+
+func flacBlock(typ byte, last bool, body []byte) []byte {
+	if last {
+		typ |= 0x80
+	}
+	n := len(body)
+	return append([]byte{typ, byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+}
+
+// flacFile has 3 minutes of 44.1 kHz audio, comments and a picture
+func flacFile() []byte {
+	info := make([]byte, 34)
+	rate, samples := 44100, uint64(180*44100)
+	info[10], info[11], info[12] = byte(rate>>12), byte(rate>>4), byte(rate<<4)
+	info[13] |= byte(samples >> 32 & 0x0f)
+	binary.BigEndian.PutUint32(info[14:18], uint32(samples))
+	b := []byte("fLaC")
+	b = append(b, flacBlock(0, false, info)...)
+	b = append(b, flacBlock(4, false, vorbisComment(
+		"TITLE=Blue in Green", "ARTIST=Miles Davis", "ALBUM=Kind of Blue",
+		"TRACKNUMBER=3/5", "DATE=1959-08-17", "GENRE=Jazz"))...)
+	b = append(b, flacBlock(6, true, flacPicture(3, testCover))...)
+	return append(b, make([]byte, 64)...) // audio frames
+}
+
+// oggPage is one page of stream serial; packets must fit a page
+func oggPage(serial uint32, seq uint32, granule uint64, packets ...[]byte) []byte {
+	var segs, body []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			segs = append(segs, 255)
+		}
+		segs = append(segs, byte(n))
+		body = append(body, p...)
+	}
+	b := append([]byte("OggS"), 0, 0)
+	b = binary.LittleEndian.AppendUint64(b, granule)
+	b = binary.LittleEndian.AppendUint32(b, serial)
+	b = binary.LittleEndian.AppendUint32(b, seq)
+	b = binary.LittleEndian.AppendUint32(b, 0) // CRC, not checked
+	b = append(b, byte(len(segs)))
+	b = append(b, segs...)
+	return append(b, body...)
+}
+
+// opusFile has 2.5 seconds of audio after a 312 sample pre-skip, tags with
+// a cover, and a page of another stream between the headers
+func opusFile() []byte {
+	head := append([]byte("OpusHead"), 1, 2)
+	head = binary.LittleEndian.AppendUint16(head, 312)
+	head = binary.LittleEndian.AppendUint32(head, 44100)
+	head = append(head, 0, 0, 0)
+	pic := base64.StdEncoding.EncodeToString(flacPicture(3, testCover))
+	tags := append([]byte("OpusTags"), vorbisComment(
+		"title=Intro", "Artist=The xx", "ALBUMARTIST=The xx", "album=xx",
+		"tracknumber=1", "discnumber=1/1", "date=2009", "genre=Indie",
+		"METADATA_BLOCK_PICTURE="+pic)...)
+	var b []byte
+	b = append(b, oggPage(7, 0, 0, head)...)
+	b = append(b, oggPage(9, 0, 0, []byte("other stream"))...)
+	b = append(b, oggPage(7, 1, 0, tags)...)
+	b = append(b, oggPage(7, 2, 312+120000, make([]byte, 100))...)
+	return b
+}
+
+func writeTestAudio(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	abs := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(abs, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return abs
+}
+
+func TestReadAudioTagsID3(t *testing.T) {
+	// "ÿ" is 0xFF in Latin-1, which unsynchronisation escapes
+	tests := []struct {
+		name string
+		data []byte
+		want audioTags
+	}{
+		{"v2.3 unsynchronised tag", id3Tag(3, 0x80,
+			id3Frame(3, "TIT2", 0, latin1Text("\xff Song")),
+			id3Frame(3, "TPE1", 0, []byte("\x01\xff\xfeA\x00r\x00t\x00")), // UTF-16 with BOM
+			id3Frame(3, "TRCK", 0, latin1Text("7/12")),
+			id3Frame(3, "TYER", 0, latin1Text("1999")),
+			id3Frame(3, "TCON", 0, latin1Text("(17)")),
+			id3Frame(3, "APIC", 0, apicFrame(3)),
+		), audioTags{Title: "ÿ Song", Artist: "Art", Track: 7, Year: 1999, Genre: "Rock", Cover: testCover, coverType: 3}},
+		{"v2.4 unsynchronised frames", id3Tag(4, 0,
+			id3Frame(4, "TIT2", 0, append([]byte{3}, "Ärger\x00Second"...)), // first of two values
+			id3Frame(4, "TPE2", 0, latin1Text("Various")),
+			id3Frame(4, "TALB", 0x03, append([]byte{0, 0, 0, 5}, latin1Text("Mix\xff")...)), // with data length
+			id3Frame(4, "TDRC", 0, latin1Text("2004-05-06")),
+			id3Frame(4, "TPOS", 0, latin1Text("2")),
+			id3Frame(4, "APIC", 0x02, apicFrame(0)),
+			id3Frame(4, "TPE1", 0x08, latin1Text("compressed, skipped")),
+		), audioTags{Title: "Ärger", AlbumArtist: "Various", Album: "Mixÿ", Year: 2004, Disc: 2, Cover: testCover}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readAudioTags(writeTestAudio(t, "a.mp3", append(tt.data, make([]byte, 64)...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadAudioTagsID3v1(t *testing.T) {
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	copy(v1[3:], "Old Title")
+	copy(v1[33:], "Old Artist")
+	copy(v1[93:], "1987")
+	v1[126], v1[127] = 4, 17
+	// ID3v2 wins where it has a value
+	data := append(id3Tag(3, 0, id3Frame(3, "TIT2", 0, latin1Text("New Title"))), make([]byte, 64)...)
+	got, err := readAudioTags(writeTestAudio(t, "a.mp3", append(data, v1...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := audioTags{Title: "New Title", Artist: "Old Artist", Year: 1987, Track: 4, Genre: "Rock"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestReadAudioTagsFLAC(t *testing.T) {
+	want := audioTags{Title: "Blue in Green", Artist: "Miles Davis", Album: "Kind of Blue",
+		Track: 3, Year: 1959, Genre: "Jazz", Duration: 180, Cover: testCover, coverType: 3}
+	for name, data := range map[string][]byte{
+		"plain":      flacFile(),
+		"behind ID3": append(id3Tag(3, 0, id3Frame(3, "TIT2", 0, latin1Text("Blue in Green"))), flacFile()...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := readAudioTags(writeTestAudio(t, "a.flac", data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadAudioTagsOpus(t *testing.T) {
+	got, err := readAudioTags(writeTestAudio(t, "a.opus", opusFile()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := audioTags{Title: "Intro", Artist: "The xx", AlbumArtist: "The xx", Album: "xx",
+		Track: 1, Disc: 1, Year: 2009, Genre: "Indie", Duration: 2.5, Cover: testCover, coverType: 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
+
+// Truncated and corrupted files may fail, but must not panic or hang.
+func TestReadAudioTagsDamaged(t *testing.T) {
+	fixtures := map[string][]byte{
+		"a.mp3":  id3Tag(3, 0x80, id3Frame(3, "TIT2", 0, latin1Text("Song")), id3Frame(3, "APIC", 0, apicFrame(3))),
+		"b.mp3":  id3Tag(4, 0, id3Frame(4, "TALB", 0x03, append([]byte{0, 0, 0, 4}, latin1Text("Mix")...))),
+		"a.flac": flacFile(),
+		"a.opus": opusFile(),
+	}
+	dir := t.TempDir()
+	abs := filepath.Join(dir, "damaged")
+	check := func(name string, data []byte) {
+		t.Helper()
+		if err := os.WriteFile(abs, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				t.Errorf("%s: panic: %v", name, r)
+			}
+		}()
+		readAudioTags(abs)
+	}
+	for name, data := range fixtures {
+		for n := 0; n < len(data); n++ {
+			check(name+" truncated", data[:n])
+		}
+		// every byte set to values that make sizes and counts absurd
+		for i := range data {
+			for _, v := range []byte{0x00, 0x7f, 0x80, 0xff} {
+				c := bytes.Clone(data)
+				c[i] = v
+				check(name+" corrupted", c)
+			}
+		}
+	}
+}
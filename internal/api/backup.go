@@ -15,15 +15,19 @@ type backupJob struct {
 	mediaID int64
 }
 
-var backupQueue chan backupJob
+var (
+	backupQueue chan backupJob
+	backupRoot  string // backupDir of the running worker; used by scrub/repair
+)
 
 // StartBackupWorker starts N worker goroutines that copy files to backupDir.
-// Call once at startup: e.g. StartBackupWorker(3, filepath.Join(config.DataDir,"backups"))
+// Call once at startup: e.g. StartBackupWorker(3, filepath.Join(config.DataDir, db.BackupDir))
 func StartBackupWorker(concurrency int, backupDir string) {
 	if backupQueue != nil {
 		return
 	}
 	backupQueue = make(chan backupJob, 4096)
+	backupRoot = backupDir
 	for i := 0; i < concurrency; i++ {
 		go func() {
 			for job := range backupQueue {
@@ -37,7 +41,7 @@ func StartBackupWorker(concurrency int, backupDir string) {
 func EnqueueBackup(absPath string, mediaID int64) {
 	if backupQueue == nil {
 		// If called before StartBackupWorker, best-effort start default worker to backup under DataDir/backups
-		go StartBackupWorker(2, filepath.Join(DataDir, "backups"))
+		go StartBackupWorker(2, filepath.Join(DataDir, db.BackupDir))
 	}
 	select {
 	case backupQueue <- backupJob{absPath: absPath, mediaID: mediaID}:
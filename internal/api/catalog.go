@@ -0,0 +1,41 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"localcloud/internal/db"
+)
+
+// catalogAbs resolves a files.filepath value to an absolute path on disk.
+// The indexer stores API-style paths ("/dir/file.jpg") while the upload
+// handlers store DataDir-joined paths, so both forms are accepted.
+func catalogAbs(p string) string {
+	root, _ := filepath.Abs(DataDir)
+	if a, err := filepath.Abs(p); err == nil && strings.HasPrefix(a, root+string(os.PathSeparator)) {
+		return a
+	}
+	return filepath.Join(root, strings.TrimPrefix(filepath.FromSlash(p), string(os.PathSeparator)))
+}
+
+// catalogKeys returns every files.filepath value that may refer to abs.
+func catalogKeys(abs string) []string {
+	return []string{relAPIPath(abs), abs}
+}
+
+// catalogFileID returns the files.id for abs, or 0 if it is not in the catalog.
+func catalogFileID(abs string) int64 {
+	keys := catalogKeys(abs)
+	var id int64
+	_ = db.DB.QueryRow("SELECT id FROM files WHERE filepath IN (?, ?) ORDER BY id LIMIT 1", keys[0], keys[1]).Scan(&id)
+	return id
+}
+
+// updateCatalog runs "UPDATE files SET <set> WHERE filepath IN (...)" for abs.
+func updateCatalog(abs, set string, args ...interface{}) error {
+	keys := catalogKeys(abs)
+	args = append(args, keys[0], keys[1])
+	_, err := db.DB.Exec("UPDATE files SET "+set+" WHERE filepath IN (?, ?)", args...)
+	return err
+}
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"localcloud/internal/db"
+)
+
+// Dedup modes accepted by ResolveDuplicates and POST /api/duplicates/resolve.
+const (
+	DedupHardlink  = "hardlink"  // replace duplicates with hardlinks to the canonical copy
+	DedupCanonical = "canonical" // delete duplicates, keep catalog rows pointing at the canonical copy
+)
+
+var hashQueue chan string
+
+// hashFile returns the hex SHA256 of the file at abs.
+func hashFile(abs string) (string, error) {
+	f, err := os.Open(abs)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// processHash hashes abs and stores sha256/size/mtime on its catalog row.
+func processHash(abs string) {
+	fi, err := os.Stat(abs)
+	if err != nil || fi.IsDir() {
+		return
+	}
+	sum, err := hashFile(abs)
+	if err != nil {
+		log.Printf("hash: %s: %v", abs, err)
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	mtime := fi.ModTime().UTC().Format(time.RFC3339)
+	if err := updateCatalog(abs, "sha256 = ?, size = ?, mtime = ?, hashed_at = ?", sum, fi.Size(), mtime, now); err != nil {
+		log.Printf("hash: db update %s: %v", abs, err)
+	}
+}
+
+// StartHashWorker starts N goroutines hashing files queued by EnqueueHash.
+func StartHashWorker(concurrency int) {
+	if hashQueue != nil {
+		return
+	}
+	hashQueue = make(chan string, 1024)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for p := range hashQueue {
+				processHash(p)
+			}
+		}()
+	}
+}
+
+// EnqueueHash queues a newly stored file for hashing (best-effort)
+func EnqueueHash(abs string) {
+	if hashQueue == nil {
+		return
+	}
+	select {
+	case hashQueue <- abs:
+	default:
+		// queue full - the next HashCatalog sweep picks it up
+	}
+}
+
+// HashCatalog hashes every catalog entry that has no sha256 yet and blocks
+// until done. Returns the number of files hashed.
+func HashCatalog(concurrency int) int {
+	rows, err := db.DB.Query("SELECT filepath FROM files WHERE (sha256 IS NULL OR sha256 = '') AND canonical_id IS NULL AND " + db.NotBackupSQL)
+	if err != nil {
+		log.Printf("HashCatalog: query: %v", err)
+		return 0
+	}
+	var paths []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	rows.Close()
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				processHash(catalogAbs(p))
+			}
+		}()
+	}
+	for _, p := range paths {
+		jobs <- p
+	}
+	close(jobs)
+	wg.Wait()
+	log.Printf("HashCatalog: hashed %d files", len(paths))
+	return len(paths)
+}
+
+// dupFile is a single catalog entry inside a duplicate group
+type dupFile struct {
+	ID     int64  `json:"id"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Linked bool   `json:"linked"` // already a hardlink of the canonical copy
+	abs    string
+}
+
+// dupGroup is a set of catalog entries sharing the same SHA256
+type dupGroup struct {
+	SHA256 string    `json:"sha256"`
+	Files  []dupFile `json:"files"`
+	Wasted int64     `json:"wasted_bytes"`
+}
+
+// loadDuplicateGroups returns groups of catalog entries with identical content.
+// The first file of each group (lowest id) is the canonical copy.
+func loadDuplicateGroups(sha string, limit, offset int) ([]dupGroup, error) {
+	hashes := []string{sha}
+	if sha == "" {
+		rows, err := db.DB.Query(`SELECT sha256 FROM files
+			WHERE sha256 IS NOT NULL AND sha256 != '' AND canonical_id IS NULL AND `+db.NotBackupSQL+`
+			GROUP BY sha256 HAVING COUNT(*) > 1
+			ORDER BY MAX(size) * (COUNT(*) - 1) DESC LIMIT ? OFFSET ?`, limit, offset)
+		if err != nil {
+			return nil, err
+		}
+		hashes = hashes[:0]
+		for rows.Next() {
+			var h string
+			if err := rows.Scan(&h); err == nil {
+				hashes = append(hashes, h)
+			}
+		}
+		rows.Close()
+	}
+
+	groups := []dupGroup{}
+	for _, h := range hashes {
+		frows, err := db.DB.Query("SELECT id, filepath, COALESCE(size, 0) FROM files WHERE sha256 = ? AND canonical_id IS NULL AND "+db.NotBackupSQL+" ORDER BY id", h)
+		if err != nil {
+			return nil, err
+		}
+		g := dupGroup{SHA256: h}
+		var canonical os.FileInfo
+		seen := map[string]bool{}
+		for frows.Next() {
+			var f dupFile
+			var p string
+			if err := frows.Scan(&f.ID, &p, &f.Size); err != nil {
+				continue
+			}
+			f.abs = catalogAbs(p)
+			// API-style and absolute rows for the same file are not duplicates
+			if seen[f.abs] {
+				continue
+			}
+			seen[f.abs] = true
+			f.Path = relAPIPath(f.abs)
+			fi, err := os.Stat(f.abs)
+			if err != nil {
+				// missing on disk; fsck territory
+				continue
+			}
+			if canonical == nil {
+				canonical = fi
+			} else if os.SameFile(canonical, fi) {
+				f.Linked = true
+			} else {
+				g.Wasted += f.Size
+			}
+			g.Files = append(g.Files, f)
+		}
+		frows.Close()
+		if len(g.Files) > 1 {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// dedupAction describes what ResolveDuplicates did (or would do) to one file
+type dedupAction struct {
+	Path      string `json:"path"`
+	Canonical string `json:"canonical"`
+	Action    string `json:"action"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ResolveDuplicates applies mode to every duplicate group (or only the group
+// with hash sha if non-empty). With dryRun nothing is changed on disk or in the DB.
+func ResolveDuplicates(mode, sha string, dryRun bool) ([]dedupAction, error) {
+	if mode != DedupHardlink && mode != DedupCanonical {
+		return nil, fmt.Errorf("unknown dedup mode %q", mode)
+	}
+	groups, err := loadDuplicateGroups(sha, -1, 0)
+	if err != nil {
+		return nil, err
+	}
+	actions := []dedupAction{}
+	for _, g := range groups {
+		canon := g.Files[0]
+		for _, f := range g.Files[1:] {
+			if mode == DedupHardlink && f.Linked {
+				continue
+			}
+			a := dedupAction{Path: f.Path, Canonical: canon.Path, Action: mode}
+			if !dryRun {
+				if err := resolveDuplicate(mode, canon, f, g.SHA256); err != nil {
+					a.Error = err.Error()
+				}
+			}
+			actions = append(actions, a)
+		}
+	}
+	return actions, nil
+}
+
+func resolveDuplicate(mode string, canon, dup dupFile, sha string) error {
+	// the catalog hash may be stale; never replace a file whose content changed
+	for _, f := range []dupFile{canon, dup} {
+		sum, err := hashFile(f.abs)
+		if err != nil {
+			return err
+		}
+		if sum != sha {
+			return fmt.Errorf("content of %s changed since hashing", f.Path)
+		}
+	}
+
+	switch mode {
+	case DedupHardlink:
+		tmp := filepath.Join(filepath.Dir(dup.abs), fmt.Sprintf(".dedup_%d_%s", time.Now().UnixNano(), filepath.Base(dup.abs)))
+		if err := os.Link(canon.abs, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, dup.abs); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+		return nil
+	default:
+		if _, err := db.DB.Exec("UPDATE files SET canonical_id = ? WHERE id = ?", canon.ID, dup.ID); err != nil {
+			return err
+		}
+		if err := os.Remove(dup.abs); err != nil {
+			_, _ = db.DB.Exec("UPDATE files SET canonical_id = NULL WHERE id = ?", dup.ID)
+			return err
+		}
+		return nil
+	}
+}
+
+// resolveFile returns abs itself, or the canonical copy's path when abs was
+// removed by canonical dedup and only its catalog reference remains.
+func resolveFile(abs string) string {
+	if _, err := os.Stat(abs); err == nil {
+		return abs
+	}
+	keys := catalogKeys(abs)
+	var p string
+	err := db.DB.QueryRow(`SELECT c.filepath FROM files f JOIN files c ON c.id = f.canonical_id
+		WHERE f.filepath IN (?, ?) LIMIT 1`, keys[0], keys[1]).Scan(&p)
+	if err != nil {
+		return abs
+	}
+	return catalogAbs(p)
+}
+
+// DuplicatesHandler reports catalog entries grouped by identical SHA256.
+// GET /api/duplicates?limit=50&offset=0
+func DuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	groups, err := loadDuplicateGroups("", limit, offset)
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var wasted int64
+	for _, g := range groups {
+		wasted += g.Wasted
+	}
+	var pending int
+	_ = db.DB.QueryRow("SELECT COUNT(*) FROM files WHERE (sha256 IS NULL OR sha256 = '') AND canonical_id IS NULL AND " + db.NotBackupSQL).Scan(&pending)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"groups":       groups,
+		"wasted_bytes": wasted,
+		"unhashed":     pending,
+		"offset":       offset,
+		"limit":        limit,
+	})
+}
+
+// DuplicatesResolveHandler replaces duplicates according to mode.
+// POST /api/duplicates/resolve?mode=hardlink|canonical&sha256=<optional>&dry_run=1
+func DuplicatesResolveHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	dryRun := q.Get("dry_run") == "1" || q.Get("dry_run") == "true"
+	actions, err := ResolveDuplicates(q.Get("mode"), q.Get("sha256"), dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"mode":    q.Get("mode"),
+		"dry_run": dryRun,
+		"actions": actions,
+	})
+}
@@ -24,6 +24,7 @@ func DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
+	abs = resolveFile(abs)
 	fi, err := os.Stat(abs)
 	if err != nil {
 		http.Error(w, "not found", http.StatusNotFound)
@@ -87,35 +88,15 @@ func DownloadZipHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	zipName = zipName + ".zip"
 
-	// set headers (streaming)
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", escapeQuotes(zipName)))
-	// do not set Content-Length
-
-	// stream with io.Pipe and write zip in goroutine
-	pr, pw := io.Pipe()
-	zipWriter := zip.NewWriter(pw)
-
-	go func() {
-		// ensure writer cleanup on any error
-		defer func() {
-			_ = zipWriter.Close()
-			_ = pw.Close()
-		}()
-
+	streamZip(w, zipName, func(zipWriter *zip.Writer) error {
 		// If the requested path is a file, add single entry
 		if !info.IsDir() {
-			if err := addFileToZip(zipWriter, absRoot, filepath.Base(absRoot)); err != nil {
-				log.Printf("zip add file error: %v", err)
-				_ = pw.CloseWithError(err)
-				return
-			}
-			return
+			return addFileToZip(zipWriter, absRoot, filepath.Base(absRoot))
 		}
 
 		// Walk directory recursively and add files.
 		// Use filepath.WalkDir to stream files.
-		err := filepath.Walk(absRoot, func(path string, fi os.FileInfo, err error) error {
+		return filepath.Walk(absRoot, func(path string, fi os.FileInfo, err error) error {
 			if err != nil {
 				// skip unreadable file/dir but continue
 				log.Printf("walk error %s: %v", path, err)
@@ -136,26 +117,44 @@ func DownloadZipHandler(w http.ResponseWriter, r *http.Request) {
 			if shouldIgnoreFile(fi.Name()) {
 				return nil
 			}
-			// add file
-			if err := addFileToZip(zipWriter, path, rel); err != nil {
-				log.Printf("zip add file error: %v", err)
-				// return err to abort zip generation
-				return err
-			}
-			return nil
+			// add file; an error aborts zip generation
+			return addFileToZip(zipWriter, path, rel)
 		})
-		if err != nil {
+	})
+}
+
+// streamZip streams a zip archive named zipName whose entries are written by
+// fill. An error from fill aborts the archive (the client sees a truncated
+// download).
+func streamZip(w http.ResponseWriter, zipName string, fill func(zw *zip.Writer) error) {
+	// set headers (streaming)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", escapeQuotes(zipName)))
+	// do not set Content-Length
+
+	// stream with io.Pipe and write zip in goroutine
+	pr, pw := io.Pipe()
+	zipWriter := zip.NewWriter(pw)
+
+	go func() {
+		// ensure writer cleanup on any error
+		defer func() {
+			_ = zipWriter.Close()
+			_ = pw.Close()
+		}()
+		if err := fill(zipWriter); err != nil {
+			log.Printf("zip add file error: %v", err)
 			_ = pw.CloseWithError(err)
-			return
 		}
 	}()
 
 	// copy the pipe reader to response writer
-	_, err = io.Copy(w, pr)
-	if err != nil {
+	if _, err := io.Copy(w, pr); err != nil {
 		// client disconnected or other copy error - log
 		log.Printf("zip stream copy error: %v", err)
 	}
+	// unblock the writer goroutine if we stopped reading early
+	_ = pr.Close()
 }
 
 // addFileToZip writes a file at absPath into zipWriter with entry name zipPath
@@ -0,0 +1,322 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"localcloud/internal/db"
+)
+
+// Fsck categories; each can be fixed independently.
+const (
+	FsckMissing   = "missing"   // catalog rows whose file is gone -> delete row
+	FsckUntracked = "untracked" // files on disk without a catalog row -> index
+	FsckPaths     = "paths"     // rows storing absolute/DataDir-joined paths -> rewrite to API path
+	FsckThumbs    = "thumbs"    // .thumbs entries whose source is gone or changed -> delete
+	FsckUploads   = "uploads"   // stale .upload_*/.dedup_* temp files -> delete
+)
+
+// FsckCategories lists every category in report order
+var FsckCategories = []string{FsckMissing, FsckUntracked, FsckPaths, FsckThumbs, FsckUploads}
+
+// temp files younger than this may still be in flight
+const staleTempAge = time.Hour
+
+// FsckEntry is one inconsistency found by RunFsck
+type FsckEntry struct {
+	Table string `json:"table,omitempty"`
+	ID    int64  `json:"id,omitempty"`
+	Path  string `json:"path"`
+	Fixed bool   `json:"fixed"`
+	Error string `json:"error,omitempty"`
+}
+
+// FsckReport groups inconsistencies by category
+type FsckReport struct {
+	DryRun     bool                   `json:"dry_run"`
+	Categories map[string][]FsckEntry `json:"categories"`
+}
+
+// diskScan is what RunFsck learns from a single walk of DataDir
+type diskScan struct {
+	files map[string]os.FileInfo // indexable files by API path
+	temps []string               // abs paths of stale upload/dedup temp files
+}
+
+func scanDataDir() diskScan {
+	scan := diskScan{files: map[string]os.FileInfo{}}
+	thumbsDir := filepath.Join(DataDir, ".thumbs")
+	_ = filepath.WalkDir(DataDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path == thumbsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(DataDir, path)
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		name := d.Name()
+		if strings.HasPrefix(name, ".upload_") || strings.HasPrefix(name, ".dedup_") {
+			if time.Since(info.ModTime()) > staleTempAge {
+				scan.temps = append(scan.temps, path)
+			}
+			return nil
+		}
+		if !db.SkipIndexPath(rel) {
+			scan.files["/"+filepath.ToSlash(rel)] = info
+		}
+		return nil
+	})
+	return scan
+}
+
+// RunFsck compares the files/media tables, DataDir and the thumbnail cache.
+// Categories in fix are repaired unless dryRun is set.
+func RunFsck(fix map[string]bool, dryRun bool) (*FsckReport, error) {
+	rep := &FsckReport{DryRun: dryRun, Categories: map[string][]FsckEntry{}}
+	for _, c := range FsckCategories {
+		rep.Categories[c] = []FsckEntry{}
+	}
+	apply := func(cat string) bool { return fix[cat] && !dryRun }
+	scan := scanDataDir()
+
+	// files table: missing files and non-canonical paths
+	rows, err := db.DB.Query("SELECT id, filepath, canonical_id IS NOT NULL FROM files")
+	if err != nil {
+		return nil, err
+	}
+	type fileRow struct {
+		id        int64
+		path      string
+		reference bool
+	}
+	var fileRows []fileRow
+	for rows.Next() {
+		var fr fileRow
+		if err := rows.Scan(&fr.id, &fr.path, &fr.reference); err == nil {
+			fileRows = append(fileRows, fr)
+		}
+	}
+	rows.Close()
+
+	tracked := map[string]bool{}
+	for _, fr := range fileRows {
+		abs := catalogAbs(fr.path)
+		apiPath := relAPIPath(abs)
+		target := abs
+		if fr.reference {
+			// canonical dedup references are fine as long as the canonical copy exists
+			target = resolveFile(abs)
+		}
+		if _, err := os.Stat(target); err != nil {
+			e := FsckEntry{Table: "files", ID: fr.id, Path: apiPath}
+			if apply(FsckMissing) {
+				_, err := db.DB.Exec("DELETE FROM files WHERE id = ?", fr.id)
+				e.Fixed, e.Error = fixResult(err)
+			}
+			rep.Categories[FsckMissing] = append(rep.Categories[FsckMissing], e)
+			continue
+		}
+		if fr.path != apiPath {
+			e := FsckEntry{Table: "files", ID: fr.id, Path: fr.path}
+			if apply(FsckPaths) {
+				e.Fixed, e.Error = fixResult(canonicalizeFileRow(fr.id, apiPath))
+			}
+			rep.Categories[FsckPaths] = append(rep.Categories[FsckPaths], e)
+		}
+		tracked[apiPath] = true
+	}
+
+	// media table: sync uploads whose file is gone
+	rows, err = db.DB.Query("SELECT id, filepath FROM media")
+	if err != nil {
+		return nil, err
+	}
+	type mediaRow struct {
+		id   int64
+		path string
+	}
+	var mediaRows []mediaRow
+	for rows.Next() {
+		var mr mediaRow
+		if err := rows.Scan(&mr.id, &mr.path); err == nil {
+			mediaRows = append(mediaRows, mr)
+		}
+	}
+	rows.Close()
+	for _, mr := range mediaRows {
+		abs := catalogAbs(mr.path)
+		if _, err := os.Stat(abs); err == nil {
+			continue
+		}
+		e := FsckEntry{Table: "media", ID: mr.id, Path: relAPIPath(abs)}
+		if apply(FsckMissing) {
+			_, err := db.DB.Exec("DELETE FROM media WHERE id = ?", mr.id)
+			e.Fixed, e.Error = fixResult(err)
+		}
+		rep.Categories[FsckMissing] = append(rep.Categories[FsckMissing], e)
+	}
+
+	// files on disk without a row
+	var untracked []string
+	for apiPath := range scan.files {
+		if !tracked[apiPath] {
+			untracked = append(untracked, apiPath)
+		}
+	}
+	sort.Strings(untracked)
+	for _, apiPath := range untracked {
+		info := scan.files[apiPath]
+		e := FsckEntry{Path: apiPath}
+		if apply(FsckUntracked) {
+			err := db.UpsertFile(apiPath, info)
+			e.Fixed, e.Error = fixResult(err)
+			if err == nil {
+				abs := filepath.Join(DataDir, filepath.FromSlash(strings.TrimPrefix(apiPath, "/")))
+				EnqueueThumbnail(abs)
+				EnqueueHash(abs)
+				EnqueueMetadata(abs, false)
+			}
+		}
+		rep.Categories[FsckUntracked] = append(rep.Categories[FsckUntracked], e)
+	}
+
+	// thumbnails whose source is gone
+	for _, thumb := range orphanThumbs() {
+		e := FsckEntry{Path: relAPIPath(thumb)}
+		if apply(FsckThumbs) {
+			e.Fixed, e.Error = fixResult(thumbs.remove(thumb))
+		}
+		rep.Categories[FsckThumbs] = append(rep.Categories[FsckThumbs], e)
+	}
+	if apply(FsckThumbs) {
+		removeEmptyDirs(filepath.Join(DataDir, ".thumbs"))
+	}
+
+	// abandoned upload/dedup temp files
+	for _, tmp := range scan.temps {
+		e := FsckEntry{Path: relAPIPath(tmp)}
+		if apply(FsckUploads) {
+			e.Fixed, e.Error = fixResult(os.Remove(tmp))
+		}
+		rep.Categories[FsckUploads] = append(rep.Categories[FsckUploads], e)
+	}
+	return rep, nil
+}
+
+// canonicalizeFileRow rewrites a row's filepath to its API path, or drops the
+// row when the indexer already created one for the same file. Album items,
+// tags and references of a dropped row move to the kept one first, so the
+// ON DELETE CASCADE doesn't take them along.
+func canonicalizeFileRow(id int64, apiPath string) error {
+	var existing int64
+	if err := db.DB.QueryRow("SELECT id FROM files WHERE filepath = ?", apiPath).Scan(&existing); err == nil {
+		tx, err := db.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, q := range []string{
+			"UPDATE OR IGNORE album_items SET file_id = ?1 WHERE file_id = ?2",
+			"UPDATE OR IGNORE file_tags SET file_id = ?1 WHERE file_id = ?2",
+			"UPDATE albums SET cover_file_id = ?1 WHERE cover_file_id = ?2",
+			"UPDATE files SET canonical_id = ?1 WHERE canonical_id = ?2",
+			"DELETE FROM files WHERE id = ?2",
+		} {
+			if _, err := tx.Exec(q, existing, id); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+	_, err := db.DB.Exec("UPDATE files SET filepath = ? WHERE id = ?", apiPath, id)
+	return err
+}
+
+// orphanThumbs returns cached thumbnails whose source was deleted, renamed or
+// edited since the thumbnail was generated.
+func orphanThumbs() []string {
+	root := filepath.Join(DataDir, ".thumbs")
+	var out []string
+	_ = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && !thumbIsLive(path) {
+			out = append(out, path)
+		}
+		return nil
+	})
+	return out
+}
+
+// removeEmptyDirs deletes empty directories below root (deepest first)
+func removeEmptyDirs(root string) {
+	var dirs []string
+	_ = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i]) // fails (and is ignored) unless empty
+	}
+}
+
+func fixResult(err error) (bool, string) {
+	if err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
+
+// ParseFsckFix turns "missing,thumbs" or "all" into a category set
+func ParseFsckFix(s string) map[string]bool {
+	fix := map[string]bool{}
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "all" {
+			for _, all := range FsckCategories {
+				fix[all] = true
+			}
+			continue
+		}
+		if c != "" {
+			fix[c] = true
+		}
+	}
+	return fix
+}
+
+// FsckHandler reports (GET) or repairs (POST) catalog/disk inconsistencies.
+// GET  /api/fsck
+// POST /api/fsck?fix=missing,untracked,paths,thumbs,uploads|all&dry_run=1
+func FsckHandler(w http.ResponseWriter, r *http.Request) {
+	fix := map[string]bool{}
+	dryRun := true
+	if r.Method == http.MethodPost {
+		fix = ParseFsckFix(r.URL.Query().Get("fix"))
+		dryRun = r.URL.Query().Get("dry_run") == "1" || r.URL.Query().Get("dry_run") == "true"
+	}
+	rep, err := RunFsck(fix, dryRun)
+	if err != nil {
+		log.Printf("fsck: %v", err)
+		http.Error(w, "fsck failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rep)
+}
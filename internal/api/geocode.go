@@ -0,0 +1,307 @@
+package api
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"localcloud/internal/db"
+)
+
+// ---------------------- offline reverse geocoding ----------------------
+
+//go:embed cities.tsv
+var bundledCities string
+
+type city struct {
+	name, region, country string
+	lat, lon              float64
+}
+
+// place renders a city as the searchable "Panaji, Goa, India" string
+func (c city) place() string {
+	parts := []string{c.name}
+	if c.region != "" && c.region != c.name {
+		parts = append(parts, c.region)
+	}
+	if c.country != "" && c.country != c.name {
+		parts = append(parts, c.country)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// maxGeocodeKm is how far a photo may be from a city and still get its name
+const maxGeocodeKm = 100
+
+// cities is sorted by latitude so lookups only scan a narrow band
+var cities []city
+
+// LoadGeocoder loads the bundled city list, or a GeoNames dump
+// (citiesNNNN.txt, tab-separated) if geonamesFile is set.
+func LoadGeocoder(geonamesFile string) {
+	var err error
+	if geonamesFile != "" {
+		var f *os.File
+		if f, err = os.Open(geonamesFile); err == nil {
+			cities, err = parseGeoNames(f)
+			f.Close()
+		}
+		if err == nil {
+			log.Printf("geocoder: %d places from %s", len(cities), geonamesFile)
+			return
+		}
+		log.Printf("geocoder: %s: %v; using bundled cities", geonamesFile, err)
+	}
+	if cities, err = parseCities(strings.NewReader(bundledCities)); err != nil {
+		log.Printf("geocoder: bundled cities: %v", err)
+	}
+}
+
+// parseCities reads "name, region, country, lat, lon" TSV rows ('#' = comment)
+func parseCities(r io.Reader) ([]city, error) {
+	var out []city
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Split(line, "\t")
+		if len(f) != 5 {
+			return nil, fmt.Errorf("bad row %q", line)
+		}
+		lat, err1 := strconv.ParseFloat(f[3], 64)
+		lon, err2 := strconv.ParseFloat(f[4], 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("bad coordinates in %q", line)
+		}
+		out = append(out, city{name: f[0], region: f[1], country: f[2], lat: lat, lon: lon})
+	}
+	sortCities(out)
+	return out, sc.Err()
+}
+
+// parseGeoNames reads the GeoNames "geoname" table format. Only the name,
+// coordinates and country code are used; admin codes aren't human readable.
+func parseGeoNames(r io.Reader) ([]city, error) {
+	var out []city
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		f := strings.Split(sc.Text(), "\t")
+		if len(f) < 9 {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(f[4], 64)
+		lon, err2 := strconv.ParseFloat(f[5], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		out = append(out, city{name: f[1], country: f[8], lat: lat, lon: lon})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no places found")
+	}
+	sortCities(out)
+	return out, nil
+}
+
+func sortCities(cs []city) {
+	sort.Slice(cs, func(i, j int) bool { return cs[i].lat < cs[j].lat })
+}
+
+// haversineKm is the great-circle distance between two points
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const r = 6371.0
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * r * math.Asin(math.Sqrt(a))
+}
+
+// reverseGeocode returns the nearest known place within maxGeocodeKm, or ""
+func reverseGeocode(lat, lon float64) string {
+	// 1 degree of latitude is ~111 km everywhere
+	band := maxGeocodeKm / 111.0
+	i := sort.Search(len(cities), func(i int) bool { return cities[i].lat >= lat-band })
+	best, bestKm := -1, float64(maxGeocodeKm)
+	for ; i < len(cities) && cities[i].lat <= lat+band; i++ {
+		if d := haversineKm(lat, lon, cities[i].lat, cities[i].lon); d <= bestKm {
+			best, bestKm = i, d
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	return cities[best].place()
+}
+
+// ---------------------- map endpoint ----------------------
+
+// mapCluster is a group of geotagged photos close together at the current zoom
+type mapCluster struct {
+	Lat    float64                `json:"lat"`
+	Lon    float64                `json:"lon"`
+	Count  int                    `json:"count"`
+	Bounds [4]float64             `json:"bbox"` // minLon, minLat, maxLon, maxLat
+	Cover  map[string]interface{} `json:"cover"`
+
+	sumLat, sumLon float64
+}
+
+// parseBBox parses "minLon,minLat,maxLon,maxLat". minLon may exceed maxLon
+// for a box that crosses the antimeridian.
+func parseBBox(s string) ([4]float64, error) {
+	var b [4]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return b, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return b, fmt.Errorf("bbox: %v", err)
+		}
+		b[i] = v
+	}
+	if b[1] > b[3] {
+		return b, fmt.Errorf("bbox minLat must not exceed maxLat")
+	}
+	return b, nil
+}
+
+// bboxLonRanges splits the longitudes of a bbox into ranges that don't cross
+// the antimeridian: one normally, two ([minLon,180] and [-180,maxLon]) when
+// minLon > maxLon.
+func bboxLonRanges(b [4]float64) [][2]float64 {
+	if b[0] <= b[2] {
+		return [][2]float64{{b[0], b[2]}}
+	}
+	return [][2]float64{{b[0], 180}, {-180, b[2]}}
+}
+
+// MapHandler returns geotagged photos inside a bounding box, clustered on a
+// grid of cells x cells so the response stays small at any zoom level.
+// GET /api/map?bbox=minLon,minLat,maxLon,maxLat&cells=16
+func MapHandler(w http.ResponseWriter, r *http.Request) {
+	bbox := [4]float64{-180, -90, 180, 90}
+	if v := r.URL.Query().Get("bbox"); v != "" {
+		var err error
+		if bbox, err = parseBBox(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	cells := 16
+	if v, err := strconv.Atoi(r.URL.Query().Get("cells")); err == nil && v > 0 && v <= 256 {
+		cells = v
+	}
+	var lonConds []string
+	args := []interface{}{bbox[1], bbox[3]}
+	for _, r := range bboxLonRanges(bbox) {
+		lonConds = append(lonConds, "gps_lon BETWEEN ? AND ?")
+		args = append(args, r[0], r[1])
+	}
+	rows, err := db.DB.Query(`SELECT filename, filepath, gps_lat, gps_lon, place FROM files
+		WHERE gps_lat BETWEEN ? AND ? AND (`+strings.Join(lonConds, " OR ")+`) AND canonical_id IS NULL
+		AND NOT `+rawPairedSQL+`
+		ORDER BY `+takenExpr+` DESC`, args...)
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// across the antimeridian, longitudes west of it are shifted by 360 so the
+	// box is contiguous, and shifted back when reported
+	lonSpan := bbox[2] - bbox[0]
+	if lonSpan < 0 {
+		lonSpan += 360
+	}
+	unwrap := func(lon float64) float64 {
+		if lon < bbox[0] {
+			return lon + 360
+		}
+		return lon
+	}
+	wrap := func(lon float64) float64 {
+		if lon > 180 {
+			return lon - 360
+		}
+		return lon
+	}
+	cellW := lonSpan / float64(cells)
+	cellH := (bbox[3] - bbox[1]) / float64(cells)
+	cell := func(v, min, size float64) int {
+		if size <= 0 {
+			return 0
+		}
+		c := int((v - min) / size)
+		if c >= cells {
+			c = cells - 1
+		}
+		return c
+	}
+	byCell := map[[2]int]*mapCluster{}
+	var order []*mapCluster
+	total := 0
+	for rows.Next() {
+		var name, p string
+		var lat, lon float64
+		var place *string
+		if err := rows.Scan(&name, &p, &lat, &lon, &place); err != nil {
+			continue
+		}
+		total++
+		lon = unwrap(lon)
+		key := [2]int{cell(lon, bbox[0], cellW), cell(lat, bbox[1], cellH)}
+		c, ok := byCell[key]
+		if !ok {
+			// rows are newest first, so the first photo seen is the cover
+			apiPath := relAPIPath(catalogAbs(p))
+			cover := map[string]interface{}{
+				"name":  name,
+				"path":  apiPath,
+				"thumb": thumbURL(apiPath, thumbRenditions[0]),
+			}
+			if place != nil && *place != "" {
+				cover["place"] = *place
+			}
+			c = &mapCluster{Bounds: [4]float64{lon, lat, lon, lat}, Cover: cover}
+			byCell[key] = c
+			order = append(order, c)
+		}
+		c.Count++
+		c.sumLat += lat
+		c.sumLon += lon
+		c.Bounds[0] = math.Min(c.Bounds[0], lon)
+		c.Bounds[1] = math.Min(c.Bounds[1], lat)
+		c.Bounds[2] = math.Max(c.Bounds[2], lon)
+		c.Bounds[3] = math.Max(c.Bounds[3], lat)
+	}
+	for _, c := range order {
+		c.Lat = c.sumLat / float64(c.Count)
+		c.Lon = wrap(c.sumLon / float64(c.Count))
+		c.Bounds[0], c.Bounds[2] = wrap(c.Bounds[0]), wrap(c.Bounds[2])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"bbox":     bbox,
+		"total":    total,
+		"clusters": order,
+	})
+}
@@ -14,6 +14,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -92,56 +93,144 @@ func relAPIPath(abs string) string {
 	return "/" + filepath.ToSlash(rel)
 }
 
-func thumbPathFor(abs string) string {
+// thumbPathFor returns the cached thumbnail path for abs at the given
+// rendition width, keyed by the source mtime (see thumbcache.go).
+func thumbPathFor(abs string, rendition int) string {
+	return thumbCachePath(abs, fmt.Sprintf("w%d", rendition))
+}
+
+// thumbCachePath returns the cache path of a JPEG rendering of abs;
+// variant is "w<width>" for thumbnails or "full" for full-size renderings.
+func thumbCachePath(abs, variant string) string {
 	rel, _ := filepath.Rel(DataDir, abs)
 	rel = filepath.ToSlash(rel)
 	thumbDir := filepath.Join(DataDir, ".thumbs", filepath.Dir(rel))
 	os.MkdirAll(thumbDir, 0755)
-	base := filepath.Base(rel)
-	ext := filepath.Ext(base)
-	name := strings.TrimSuffix(base, ext)
-	return filepath.Join(thumbDir, name+".jpg")
+	var mtime time.Time
+	if fi, err := os.Stat(abs); err == nil {
+		mtime = fi.ModTime()
+	}
+	return filepath.Join(thumbDir, fmt.Sprintf("%s.%s.%s.jpg", filepath.Base(rel), thumbCacheKey(mtime), variant))
+}
+
+// thumbURL is the API URL of a thumbnail rendition
+func thumbURL(apiPath string, w int) string {
+	return "/api/thumbnail?path=" + url.QueryEscape(apiPath) + "&w=" + strconv.Itoa(w)
+}
+
+// thumbSrcset lists every rendition for an <img srcset> attribute
+func thumbSrcset(apiPath string) string {
+	parts := make([]string, 0, len(thumbRenditions))
+	for _, r := range thumbRenditions {
+		parts = append(parts, fmt.Sprintf("%s %dw", thumbURL(apiPath, r), r))
+	}
+	return strings.Join(parts, ", ")
 }
 
 // ---------------------- thumbnail generation ----------------------
 
+// isImageExt reports whether ext (lowercase, with dot) is decoded in-process
+func isImageExt(ext string) bool {
+	switch ext {
+	case ".jpg", ".jpeg", ".png", ".webp", ".bmp", ".tiff", ".gif":
+		return true
+	}
+	return false
+}
+
 func generateImageThumbnail(abs, dst string, maxDim int) error {
-	img, err := imaging.Open(abs)
+	img, err := imaging.Open(abs, imaging.AutoOrientation(true))
 	if err != nil {
 		return err
 	}
 	thumb := imaging.Thumbnail(img, maxDim, maxDim, imaging.Lanczos)
+	b := img.Bounds()
+	storePerceptualHash(abs, thumb, b.Dx(), b.Dy())
 	return imaging.Save(thumb, dst, imaging.JPEGQuality(82))
 }
 
-func generateVideoThumbnailFFmpeg(abs, dst string, maxDim int) error {
-	// Use ffmpeg to extract a frame (requires ffmpeg installed)
-	cmd := exec.Command("ffmpeg", "-ss", "2", "-i", abs, "-vframes", "1", "-vf", fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)'", maxDim, maxDim), "-f", "image2", "pipe:1")
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-	if err := cmd.Run(); err != nil {
-		// fallback: return empty image
-		img := imaging.New(maxDim, maxDim, color.Black)
-		return imaging.Save(img, dst, imaging.JPEGQuality(70))
+func generateHEIFThumbnail(abs, dst string, maxDim int) error {
+	// reuse the full-size conversion if the viewer already asked for one
+	var img image.Image
+	var err error
+	if conv := convertedPathFor(abs); fileExists(conv) {
+		img, err = imaging.Open(conv)
+	} else {
+		img, err = decodeHEIF(abs)
 	}
-	img, _, err := image.Decode(&out)
 	if err != nil {
 		return err
 	}
 	thumb := imaging.Thumbnail(img, maxDim, maxDim, imaging.Lanczos)
+	b := img.Bounds()
+	storePerceptualHash(abs, thumb, b.Dx(), b.Dy())
+	return imaging.Save(thumb, dst, imaging.JPEGQuality(82))
+}
+
+func generateRawThumbnail(abs, dst string, maxDim int) error {
+	img, err := decodeRaw(abs)
+	if err != nil {
+		return err
+	}
+	thumb := imaging.Thumbnail(img, maxDim, maxDim, imaging.Lanczos)
+	b := img.Bounds()
+	storePerceptualHash(abs, thumb, b.Dx(), b.Dy())
 	return imaging.Save(thumb, dst, imaging.JPEGQuality(82))
 }
 
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func generateVideoThumbnailFFmpeg(abs, dst string, maxDim int) error {
+	// Use ffmpeg to extract a frame (requires ffmpeg installed); retry at the
+	// first frame if seeking fails, and never cache a blank image for a video
+	var lastErr error
+	for _, at := range []float64{videoThumbSeek(abs), 0} {
+		cmd := exec.Command("ffmpeg", "-ss", fmt.Sprintf("%.3f", at), "-i", abs, "-vframes", "1", "-vf", fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)'", maxDim, maxDim), "-f", "image2", "pipe:1")
+		var out, stderr bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			lastErr = fmt.Errorf("ffmpeg frame at %.1fs: %v: %s", at, err, strings.TrimSpace(stderr.String()))
+			continue
+		}
+		img, _, err := image.Decode(&out)
+		if err != nil {
+			// seeking past the end yields no frame
+			lastErr = fmt.Errorf("ffmpeg frame at %.1fs: %w", at, err)
+			continue
+		}
+		thumb := imaging.Thumbnail(img, maxDim, maxDim, imaging.Lanczos)
+		return imaging.Save(thumb, dst, imaging.JPEGQuality(82))
+	}
+	return lastErr
+}
+
 func generateThumbnail(abs, dst string, maxDim int) error {
 	// return early if exists
 	if _, err := os.Stat(dst); err == nil {
 		return nil
 	}
+	if err := renderThumbnail(abs, dst, maxDim); err != nil {
+		return err
+	}
+	thumbs.add(dst)
+	return nil
+}
+
+func renderThumbnail(abs, dst string, maxDim int) error {
 	ext := strings.ToLower(filepath.Ext(abs))
-	switch ext {
-	case ".jpg", ".jpeg", ".png", ".webp", ".bmp", ".tiff", ".gif":
+	switch {
+	case isImageExt(ext):
 		return generateImageThumbnail(abs, dst, maxDim)
+	case isHEIFExt(ext):
+		return generateHEIFThumbnail(abs, dst, maxDim)
+	case isRawExt(ext):
+		return generateRawThumbnail(abs, dst, maxDim)
+	case isAudioExt(ext):
+		return generateAudioThumbnail(abs, dst, maxDim)
 	default:
 		// treat as video-ish or unknown: try ffmpeg
 		if _, err := exec.LookPath("ffmpeg"); err == nil {
@@ -169,9 +258,15 @@ func StartThumbnailWorker(concurrency int) {
 				if shouldIgnoreFile(filepath.Base(p)) {
 					continue
 				}
-				dst := thumbPathFor(p)
-				if err := generateThumbnail(p, dst, 480); err != nil {
+				dst := thumbPathFor(p, defaultRendition)
+				if err := generateThumbnail(p, dst, defaultRendition); err != nil {
 					log.Println("thumb generate err:", err)
+					continue
+				}
+				if ext := strings.ToLower(filepath.Ext(p)); isImageExt(ext) || isHEIFExt(ext) || isRawExt(ext) {
+					backfillPerceptualHash(p, dst)
+				} else if strings.HasPrefix(mimeTypeFor(p), "video/") {
+					generateVideoExtras(p)
 				}
 			}
 		}()
@@ -223,7 +318,9 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := db.DB.Exec("INSERT OR IGNORE INTO files(filename, filepath) VALUES(?, ?)", header.Filename, savedPath)
+	// store the API-style path like the indexer does, so both agree on the key
+	res, err := db.DB.Exec("INSERT OR IGNORE INTO files(filename, filepath, mime) VALUES(?, ?, ?)",
+		header.Filename, relAPIPath(savedPath), mime.TypeByExtension(strings.ToLower(filepath.Ext(savedPath))))
 	if err != nil {
 		http.Error(w, "db insert error: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -234,8 +331,11 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 		_ = row.Scan(&lastID)
 	}
 
-	// enqueue thumbnail generation
+	// enqueue thumbnail generation, hashing and metadata extraction
 	EnqueueThumbnail(savedPath)
+	EnqueueHash(savedPath)
+	EnqueueMetadata(savedPath, false)
+	EnqueueProxy(savedPath, false)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -289,14 +389,22 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "refusing to delete hidden/system file", http.StatusBadRequest)
 		return
 	}
+	// thumbnail key depends on the source mtime, so resolve it before deleting
+	abs := filepath.Join(DataDir, filepath.Base(filename))
+	thumbPaths := thumbPathsFor(abs)
 	if err := storage.DeleteFile(DataDir, filename); err != nil {
 		http.Error(w, "delete failed: "+err.Error(), http.StatusNotFound)
 		return
 	}
-	if _, err := db.DB.Exec("DELETE FROM files WHERE filename = ?", filename); err != nil {
+	// only drop the rows for this file, not same-named files in other folders
+	keys := catalogKeys(abs)
+	if _, err := db.DB.Exec("DELETE FROM files WHERE filepath IN (?, ?)", keys[0], keys[1]); err != nil {
 		http.Error(w, "db delete failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	for _, t := range thumbPaths {
+		_ = thumbs.remove(t)
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("deleted"))
 }
@@ -347,8 +455,8 @@ func TreeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	items := []TreeItem{}
 	for _, e := range entries {
-		// skip hidden/system files
-		if shouldIgnoreFile(e.Name()) {
+		// skip hidden/system files and XMP sidecars
+		if shouldIgnoreFile(e.Name()) || (!e.IsDir() && isSidecar(e.Name())) {
 			continue
 		}
 
@@ -380,7 +488,9 @@ func TreeHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
 }
 
-// FileHandler streams file with Range support
+// FileHandler streams file with Range support. variant=web serves the
+// browser-playable proxy of a video (see proxy.go).
+// GET /api/file?path=/a.jpg[&oriented=1][&variant=web]
 func FileHandler(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query().Get("path")
 	if q == "" {
@@ -397,6 +507,7 @@ func FileHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
+	abs = resolveFile(abs)
 	f, err := os.Open(abs)
 	if err != nil {
 		http.Error(w, "open error: "+err.Error(), http.StatusNotFound)
@@ -404,11 +515,22 @@ func FileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer f.Close()
 
+	setCaptionInfo(w, r, abs)
+	if r.URL.Query().Get("variant") == "web" && serveWebVariant(w, r, abs) {
+		return
+	}
 	fi, err := f.Stat()
 	if err != nil {
 		http.Error(w, "stat error", http.StatusInternalServerError)
 		return
 	}
+	// oriented=1: serve an upright rendition with the EXIF rotation baked in
+	if r.URL.Query().Get("oriented") == "1" {
+		if convert := orientedConverterFor(abs); convert != nil {
+			serveConverted(w, r, abs, fi, convert)
+			return
+		}
+	}
 	size := fi.Size()
 	mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(fi.Name())))
 	if mimeType == "" {
@@ -496,7 +618,8 @@ func parseRange(rangeHeader string, size int64) (int64, int64, error) {
 
 // ---------------- Thumbnail endpoint ----------------
 
-// ThumbnailHandler: GET /api/thumbnail?path=/some.jpg&w=320
+// ThumbnailHandler: GET /api/thumbnail?path=/some.jpg&w=320[&format=webp]
+// The format is negotiated from the Accept header unless given explicitly.
 func ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query().Get("path")
 	if q == "" {
@@ -515,12 +638,37 @@ func ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 			width = v
 		}
 	}
+	width = nearestRendition(width)
 	abs, err := absClean(DataDir, q)
 	if err != nil {
 		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
-	dst := thumbPathFor(abs)
+	abs = resolveFile(abs)
+	srcInfo, err := os.Stat(abs)
+	if err != nil {
+		http.Error(w, "no thumbnail", http.StatusNotFound)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if _, ok := thumbContentTypes[format]; !ok || (format != thumbJPEG && thumbEncoder(format) == "") {
+		format = negotiateThumbFormat(r.Header.Get("Accept"))
+	}
+
+	// the validator only depends on source mtime, rendition and format, so a
+	// revalidation can be answered without touching the cache at all
+	etag := fmt.Sprintf(`"%s-w%d-%s"`, thumbCacheKey(srcInfo.ModTime()), width, format)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if inm := r.Header.Get("If-None-Match"); inm != "" && strings.Contains(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	dst := thumbPathFor(abs, width)
+	defer thumbs.pin(dst)()
 	// ensure generation (best-effort)
 	if err := generateThumbnail(abs, dst, width); err != nil {
 		// log, but continue to serve placeholder if exists
@@ -531,12 +679,70 @@ func ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no thumbnail", http.StatusNotFound)
 		return
 	}
-	w.Header().Set("Cache-Control", "public, max-age=86400")
-	http.ServeFile(w, r, dst)
+	thumbs.touch(dst)
+
+	if format != thumbJPEG {
+		variant := thumbVariantPath(dst, format)
+		defer thumbs.pin(variant)()
+		if _, err := os.Stat(variant); err != nil {
+			if err := encodeThumbVariant(dst, variant, format); err != nil {
+				log.Println("thumb encode err:", err)
+			} else {
+				thumbs.add(variant)
+			}
+		}
+		if _, err := os.Stat(variant); err == nil {
+			thumbs.touch(variant)
+			dst = variant
+		} else {
+			// fall back to the JPEG we already have
+			format = thumbJPEG
+			w.Header().Set("ETag", fmt.Sprintf(`"%s-w%d-%s"`, thumbCacheKey(srcInfo.ModTime()), width, format))
+		}
+	}
+
+	f, err := os.Open(dst)
+	if err != nil {
+		http.Error(w, "no thumbnail", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", thumbContentTypes[format])
+	// ServeContent also handles If-Modified-Since / If-None-Match -> 304
+	http.ServeContent(w, r, filepath.Base(dst), srcInfo.ModTime(), f)
 }
 
 // ---------------- Metadata endpoint ----------------
 
+// hasExif reports whether readExif understands files with extension ext
+func hasExif(ext string) bool {
+	return ext == ".jpg" || ext == ".jpeg" || isHEIFExt(ext) || isRawExt(ext)
+}
+
+// readExif decodes EXIF from JPEGs (APP1 segment), HEIF containers (Exif item)
+// and TIFF-based RAW files (IFD0 + Exif IFD)
+func readExif(abs string) (*exif.Exif, error) {
+	if isHEIFExt(strings.ToLower(filepath.Ext(abs))) {
+		raw, err := heifExif(abs)
+		if err != nil {
+			return nil, err
+		}
+		return exif.Decode(bytes.NewReader(raw))
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil && x != nil && isRawExt(strings.ToLower(filepath.Ext(abs))) {
+		// maker notes in RAW files often trip the parser after the
+		// standard fields were read; keep what we got
+		return x, nil
+	}
+	return x, err
+}
+
 // MetadataHandler: GET /api/metadata?path=/some.jpg
 func MetadataHandler(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query().Get("path")
@@ -566,30 +772,37 @@ func MetadataHandler(w http.ResponseWriter, r *http.Request) {
 		"path":     q,
 	}
 	ext := strings.ToLower(filepath.Ext(abs))
-	if ext == ".jpg" || ext == ".jpeg" {
-		if f, err := os.Open(abs); err == nil {
-			if x, err := exif.Decode(f); err == nil {
-				if dt, err := x.DateTime(); err == nil {
-					meta["exif_datetime"] = dt.Format(time.RFC3339)
-				}
-				if m, err := x.Get(exif.Model); err == nil {
-					if s, err := m.StringVal(); err == nil {
-						meta["camera_model"] = s
-					}
-				}
+	// served from the catalog; extracted here only if the worker hasn't got to
+	// the file yet
+	pm, extracted, inCatalog := loadMetadata(abs)
+	if !extracted {
+		pm = extractMetadata(abs)
+		if inCatalog {
+			if err := storeMetadata(abs, pm); err != nil {
+				log.Printf("metadata: db update %s: %v", abs, err)
 			}
-			f.Close()
 		}
-	} else if strings.HasPrefix(mime.TypeByExtension(ext), "video/") {
-		// ffprobe for duration
-		if _, err := exec.LookPath("ffprobe"); err == nil {
-			cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "format=duration", "-of", "default=nk=1:nw=1", abs)
-			out, _ := cmd.Output()
-			if len(out) > 0 {
-				if dur, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64); err == nil {
-					meta["duration_seconds"] = dur
-				}
-			}
+	}
+	pm.addTo(meta)
+	if fid := catalogFileID(abs); fid != 0 {
+		var fav int
+		_ = db.DB.QueryRow("SELECT COALESCE(favorite, 0) FROM files WHERE id = ?", fid).Scan(&fav)
+		meta["favorite"] = fav == 1
+		meta["tags"] = fileTags(fid)
+	}
+	if converterFor(abs) != nil {
+		meta["converted"] = "/api/convert?path=" + url.QueryEscape(q)
+	}
+	if strings.HasPrefix(mime.TypeByExtension(ext), "video/") {
+		if fid := catalogFileID(abs); fid != 0 {
+			meta["stream"] = streamURL(fid)
+		}
+		meta["storyboard"] = storyboardURL(q)
+		meta["preview"] = previewURL(q)
+		meta["subtitles"] = videoSubtitles(abs, q)
+		// kept for older clients; the catalog has it as "duration"
+		if pm.Duration > 0 {
+			meta["duration_seconds"] = pm.Duration
 		}
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -619,14 +832,32 @@ func GridHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "read dir: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	// build visible entries (skip hidden/system) then apply offset/limit
+	// build visible entries (skip hidden/system and XMP sidecars) then apply offset/limit
 	visible := []os.DirEntry{}
 	for _, e := range entries {
-		if shouldIgnoreFile(e.Name()) {
+		if shouldIgnoreFile(e.Name()) || (!e.IsDir() && isSidecar(e.Name())) {
 			continue
 		}
 		visible = append(visible, e)
 	}
+	// a RAW file with a JPEG of the same name is one asset: hide the RAW and
+	// attach it to the JPEG item
+	jpegStems := map[string]bool{}
+	for _, e := range visible {
+		if !e.IsDir() && isPairJPEG(e.Name()) {
+			jpegStems[pairKey(e.Name())] = true
+		}
+	}
+	rawSiblings := map[string]os.DirEntry{}
+	paired := visible[:0]
+	for _, e := range visible {
+		if !e.IsDir() && isRawExt(strings.ToLower(filepath.Ext(e.Name()))) && jpegStems[pairKey(e.Name())] {
+			rawSiblings[pairKey(e.Name())] = e
+			continue
+		}
+		paired = append(paired, e)
+	}
+	visible = paired
 	items := []map[string]interface{}{}
 	total := len(visible)
 	for i := offset; i < total && len(items) < limit; i++ {
@@ -649,7 +880,19 @@ func GridHandler(w http.ResponseWriter, r *http.Request) {
 				mt = "application/octet-stream"
 			}
 			item["mime"] = mt
-			item["thumb"] = "/api/thumbnail?path=" + url.QueryEscape(apiPath) + "&w=360"
+			item["thumb"] = thumbURL(apiPath, defaultRendition)
+			item["srcset"] = thumbSrcset(apiPath)
+			if re, ok := rawSiblings[pairKey(e.Name())]; ok {
+				ref := map[string]interface{}{
+					"name": re.Name(),
+					"path": path.Join(path.Dir(apiPath), re.Name()),
+					"mime": mime.TypeByExtension(strings.ToLower(filepath.Ext(re.Name()))),
+				}
+				if ri, err := re.Info(); err == nil {
+					ref["size"] = ri.Size()
+				}
+				item["raw"] = ref
+			}
 		}
 		items = append(items, item)
 	}
@@ -0,0 +1,459 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	// not in most system mime tables; the UI relies on image/* to pick a viewer
+	_ = mime.AddExtensionType(".heic", "image/heic")
+	_ = mime.AddExtensionType(".heif", "image/heif")
+	_ = mime.AddExtensionType(".hif", "image/heif")
+}
+
+// isHEIFExt reports whether ext (lowercase, with dot) is a HEIF container
+func isHEIFExt(ext string) bool {
+	return ext == ".heic" || ext == ".heif" || ext == ".hif"
+}
+
+// ---------------------- ISOBMFF box parsing ----------------------
+
+// heifBox is a parsed box header; data holds the payload after the header
+type heifBox struct {
+	typ  string
+	data []byte
+}
+
+// readBoxes splits buf into consecutive boxes
+func readBoxes(buf []byte) ([]heifBox, error) {
+	var boxes []heifBox
+	for len(buf) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(buf[0:4]))
+		typ := string(buf[4:8])
+		hdr := uint64(8)
+		switch size {
+		case 1:
+			if len(buf) < 16 {
+				return boxes, fmt.Errorf("heif: truncated large box")
+			}
+			size = binary.BigEndian.Uint64(buf[8:16])
+			hdr = 16
+		case 0:
+			size = uint64(len(buf))
+		}
+		if size < hdr || size > uint64(len(buf)) {
+			return boxes, fmt.Errorf("heif: bad box size for %q", typ)
+		}
+		boxes = append(boxes, heifBox{typ: typ, data: buf[hdr:size]})
+		buf = buf[size:]
+	}
+	return boxes, nil
+}
+
+func findBox(boxes []heifBox, typ string) (heifBox, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return heifBox{}, false
+}
+
+// beUint reads an n-byte big-endian unsigned int (n = 0, 2, 4 or 8)
+func beUint(b []byte, n int) (uint64, []byte, error) {
+	if len(b) < n {
+		return 0, b, io.ErrUnexpectedEOF
+	}
+	var v uint64
+	for i := 0; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, b[n:], nil
+}
+
+// heifExifItem finds the item id of type "Exif" in an iinf box payload
+func heifExifItem(iinf []byte) (uint32, bool) {
+	if len(iinf) < 4 {
+		return 0, false
+	}
+	version := iinf[0]
+	body := iinf[4:]
+	if version == 0 {
+		if len(body) < 2 {
+			return 0, false
+		}
+		body = body[2:]
+	} else {
+		if len(body) < 4 {
+			return 0, false
+		}
+		body = body[4:]
+	}
+	entries, _ := readBoxes(body)
+	for _, e := range entries {
+		if e.typ != "infe" || len(e.data) < 4 {
+			continue
+		}
+		v := e.data[0]
+		d := e.data[4:]
+		if v < 2 {
+			continue
+		}
+		var id uint64
+		var err error
+		if v == 2 {
+			id, d, err = beUint(d, 2)
+		} else {
+			id, d, err = beUint(d, 4)
+		}
+		if err != nil || len(d) < 6 {
+			continue
+		}
+		// skip item_protection_index, read item_type
+		if string(d[2:6]) == "Exif" {
+			return uint32(id), true
+		}
+	}
+	return 0, false
+}
+
+// heifItemExtents returns the (offset, length) extents of item id from iloc
+func heifItemExtents(iloc []byte, id uint32) ([][2]uint64, error) {
+	if len(iloc) < 6 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	version := iloc[0]
+	d := iloc[4:]
+	offsetSize := int(d[0] >> 4)
+	lengthSize := int(d[0] & 0x0f)
+	baseOffsetSize := int(d[1] >> 4)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(d[1] & 0x0f)
+	}
+	d = d[2:]
+	var count uint64
+	var err error
+	if version < 2 {
+		count, d, err = beUint(d, 2)
+	} else {
+		count, d, err = beUint(d, 4)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < count; i++ {
+		var itemID, base, extents uint64
+		if version < 2 {
+			itemID, d, err = beUint(d, 2)
+		} else {
+			itemID, d, err = beUint(d, 4)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if version == 1 || version == 2 {
+			// construction_method; only file offsets (0) are supported
+			var cm uint64
+			if cm, d, err = beUint(d, 2); err != nil {
+				return nil, err
+			}
+			if itemID == uint64(id) && cm&0x0f != 0 {
+				return nil, fmt.Errorf("heif: unsupported construction method %d", cm&0x0f)
+			}
+		}
+		if _, d, err = beUint(d, 2); err != nil { // data_reference_index
+			return nil, err
+		}
+		if base, d, err = beUint(d, baseOffsetSize); err != nil {
+			return nil, err
+		}
+		if extents, d, err = beUint(d, 2); err != nil {
+			return nil, err
+		}
+		var out [][2]uint64
+		for j := uint64(0); j < extents; j++ {
+			var off, length uint64
+			if _, d, err = beUint(d, indexSize); err != nil {
+				return nil, err
+			}
+			if off, d, err = beUint(d, offsetSize); err != nil {
+				return nil, err
+			}
+			if length, d, err = beUint(d, lengthSize); err != nil {
+				return nil, err
+			}
+			out = append(out, [2]uint64{base + off, length})
+		}
+		if itemID == uint64(id) {
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("heif: item %d not in iloc", id)
+}
+
+// heifMetaBoxes returns the children of the top-level meta box of f
+func heifMetaBoxes(f *os.File) ([]heifBox, error) {
+	// the meta box sits near the start; walk top-level headers until we find it
+	var meta []byte
+	var pos int64
+	hdr := make([]byte, 16)
+	for meta == nil {
+		if _, err := f.ReadAt(hdr[:8], pos); err != nil {
+			return nil, fmt.Errorf("heif: no meta box")
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		typ := string(hdr[4:8])
+		hlen := int64(8)
+		if size == 1 {
+			if _, err := f.ReadAt(hdr[8:16], pos+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			hlen = 16
+		}
+		if size < hlen {
+			return nil, fmt.Errorf("heif: bad top-level box %q", typ)
+		}
+		if typ == "meta" {
+			if size > 16<<20 {
+				return nil, fmt.Errorf("heif: meta box too large")
+			}
+			meta = make([]byte, size-hlen)
+			if _, err := f.ReadAt(meta, pos+hlen); err != nil {
+				return nil, err
+			}
+		}
+		pos += size
+	}
+	if len(meta) < 4 {
+		return nil, fmt.Errorf("heif: short meta box")
+	}
+	children, _ := readBoxes(meta[4:]) // meta is a full box
+	return children, nil
+}
+
+// heifIsGrid reports whether abs derives its image from tiles (an iref "dimg"
+// reference, as iPhones write). ffmpeg only decodes the first tile of those.
+func heifIsGrid(abs string) bool {
+	f, err := os.Open(abs)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	children, err := heifMetaBoxes(f)
+	if err != nil {
+		return false
+	}
+	iref, ok := findBox(children, "iref")
+	if !ok || len(iref.data) < 4 {
+		return false
+	}
+	refs, _ := readBoxes(iref.data[4:]) // iref is a full box
+	_, ok = findBox(refs, "dimg")
+	return ok
+}
+
+// heifExif returns the raw TIFF-structured EXIF block stored in a HEIF file
+func heifExif(abs string) ([]byte, error) {
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	children, err := heifMetaBoxes(f)
+	if err != nil {
+		return nil, err
+	}
+	iinf, ok1 := findBox(children, "iinf")
+	iloc, ok2 := findBox(children, "iloc")
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("heif: missing iinf/iloc")
+	}
+	id, ok := heifExifItem(iinf.data)
+	if !ok {
+		return nil, fmt.Errorf("heif: no Exif item")
+	}
+	extents, err := heifItemExtents(iloc.data, id)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, e := range extents {
+		if e[1] > 16<<20 {
+			return nil, fmt.Errorf("heif: Exif item too large")
+		}
+		chunk := make([]byte, e[1])
+		if _, err := f.ReadAt(chunk, int64(e[0])); err != nil {
+			return nil, err
+		}
+		buf.Write(chunk)
+	}
+	// payload: 4-byte offset to the TIFF header, then the EXIF block
+	data := buf.Bytes()
+	if len(data) < 4 {
+		return nil, fmt.Errorf("heif: short Exif item")
+	}
+	skip := uint64(binary.BigEndian.Uint32(data[:4])) + 4
+	if skip >= uint64(len(data)) {
+		return nil, fmt.Errorf("heif: bad Exif header offset")
+	}
+	data = data[skip:]
+	// some writers keep the "Exif\0\0" prefix
+	data = bytes.TrimPrefix(data, []byte("Exif\x00\x00"))
+	return data, nil
+}
+
+// ---------------------- pixel decoding ----------------------
+
+// heifDecoders convert a HEIF file to JPEG using whatever is installed.
+// Each entry gets the source path and a destination .jpg path.
+var heifDecoders = []struct {
+	bin  string
+	args func(src, dst string) []string
+}{
+	{"heif-convert", func(src, dst string) []string { return []string{"-q", "92", src, dst} }},
+	{"magick", func(src, dst string) []string { return []string{src + "[0]", "-quality", "92", dst} }},
+	{"convert", func(src, dst string) []string { return []string{src + "[0]", "-quality", "92", dst} }},
+	{"ffmpeg", func(src, dst string) []string {
+		return []string{"-hide_banner", "-loglevel", "error", "-y", "-i", src, "-frames:v", "1", "-q:v", "2", dst}
+	}},
+}
+
+// convertHEIF writes a full-resolution JPEG rendering of src to dst
+func convertHEIF(src, dst string) error {
+	tmp := dst + ".tmp.jpg"
+	defer os.Remove(tmp)
+	var errs []string
+	for _, d := range heifDecoders {
+		if _, err := exec.LookPath(d.bin); err != nil {
+			continue
+		}
+		if d.bin == "ffmpeg" && heifIsGrid(src) {
+			// would silently produce a 512x512 corner of the photo
+			errs = append(errs, "ffmpeg: can't decode grid images")
+			continue
+		}
+		out, err := exec.Command(d.bin, d.args(src, tmp)...).CombinedOutput()
+		if err == nil {
+			if fi, err := os.Stat(tmp); err == nil && fi.Size() > 0 {
+				return os.Rename(tmp, dst)
+			}
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v %s", d.bin, err, strings.TrimSpace(string(out))))
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("heif: no decoder installed (need heif-convert from libheif-examples, ImageMagick or ffmpeg)")
+	}
+	return fmt.Errorf("heif: decode failed: %s", strings.Join(errs, "; "))
+}
+
+// decodeHEIF decodes a HEIF image via a temporary JPEG conversion
+func decodeHEIF(abs string) (image.Image, error) {
+	tmp, err := os.CreateTemp("", "heif-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := convertHEIF(abs, tmp.Name()); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// convertedPathFor is the cached full-size JPEG rendering of abs. It lives in
+// the thumbnail cache as the "full" rendition, so it shares the LRU cap and GC.
+func convertedPathFor(abs string) string {
+	return thumbCachePath(abs, "full")
+}
+
+// ConvertHandler serves a browser-friendly JPEG rendering of formats browsers
+// can't display (HEIC/HEIF, and the embedded preview of RAW files).
+// GET /api/convert?path=/IMG_0001.HEIC
+func ConvertHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("path")
+	if q == "" {
+		http.Error(w, "path required", http.StatusBadRequest)
+		return
+	}
+	if shouldIgnoreFile(filepath.Base(q)) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	abs, err := absClean(DataDir, q)
+	if err != nil {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	abs = resolveFile(abs)
+	srcInfo, err := os.Stat(abs)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	convert := converterFor(abs)
+	if convert == nil {
+		// already browser-friendly
+		http.Redirect(w, r, "/api/file?path="+url.QueryEscape(q), http.StatusFound)
+		return
+	}
+	serveConverted(w, r, abs, srcInfo, convert)
+}
+
+// converterFor returns how to build the "full" rendition of abs, or nil if
+// browsers can display the file as-is.
+func converterFor(abs string) func(src, dst string) error {
+	ext := strings.ToLower(filepath.Ext(abs))
+	switch {
+	case isHEIFExt(ext):
+		return convertHEIF
+	case isRawExt(ext):
+		return convertRaw
+	}
+	return nil
+}
+
+// serveConverted serves the cached "full" rendition of abs, building it with
+// convert on first use.
+func serveConverted(w http.ResponseWriter, r *http.Request, abs string, srcInfo os.FileInfo, convert func(src, dst string) error) {
+	dst := convertedPathFor(abs)
+	defer thumbs.pin(dst)()
+	if _, err := os.Stat(dst); err != nil {
+		if err := convert(abs, dst); err != nil {
+			log.Println("convert err:", err)
+			http.Error(w, "conversion failed", http.StatusUnsupportedMediaType)
+			return
+		}
+		thumbs.add(dst)
+	}
+	thumbs.touch(dst)
+	f, err := os.Open(dst)
+	if err != nil {
+		http.Error(w, "conversion failed", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-full"`, thumbCacheKey(srcInfo.ModTime())))
+	http.ServeContent(w, r, filepath.Base(dst), srcInfo.ModTime(), f)
+}
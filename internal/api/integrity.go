@@ -0,0 +1,426 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"localcloud/internal/db"
+	"localcloud/internal/storage"
+)
+
+// Integrity issue kinds stored in integrity_issues.kind
+const (
+	issueMismatch         = "mismatch"          // primary content differs from stored sha256
+	issueUnreadable       = "unreadable"        // primary could not be read
+	issueBackupMismatch   = "backup_mismatch"   // backup copy differs from stored sha256
+	issueBackupUnreadable = "backup_unreadable" // backup copy could not be read
+)
+
+// scrubStatus describes the current/last scrub run
+type scrubStatus struct {
+	Running    bool   `json:"running"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	Checked    int    `json:"checked"`
+	Issues     int    `json:"issues"`
+}
+
+var (
+	scrubMu    sync.Mutex
+	scrubState scrubStatus
+)
+
+// InitIntegrityDB ensures the integrity_issues table exists.
+// Call once after db.InitDB()
+func InitIntegrityDB() error {
+	_, err := db.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS integrity_issues (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filepath TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		expected_sha256 TEXT,
+		actual_sha256 TEXT,
+		backup_path TEXT,
+		repairable INTEGER DEFAULT 0,
+		detail TEXT,
+		detected_at DATETIME DEFAULT (datetime('now')),
+		resolved_at DATETIME,
+		resolution TEXT
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	if _, err := db.DB.Exec(`CREATE INDEX IF NOT EXISTS idx_integrity_open ON integrity_issues(filepath, kind, resolved_at);`); err != nil {
+		return err
+	}
+	return nil
+}
+
+// scrubTarget is a file with a known-good hash and an optional backup copy
+type scrubTarget struct {
+	abs      string
+	sha      string
+	size     sql.NullInt64
+	mtime    sql.NullString
+	backup   string
+	fromSync bool
+	mediaID  int64 // media row of a sync upload
+}
+
+// backupPathFor returns where processBackup puts the copy of abs
+func backupPathFor(abs string) string {
+	if backupRoot == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(DataDir, abs)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(backupRoot, rel)
+}
+
+// loadScrubTargets collects every hashed file from the catalog and the media table.
+func loadScrubTargets() ([]scrubTarget, error) {
+	targets := map[string]*scrubTarget{}
+	var order []string
+
+	rows, err := db.DB.Query(`SELECT filepath, sha256, size, mtime FROM files
+		WHERE sha256 IS NOT NULL AND sha256 != '' AND canonical_id IS NULL AND ` + db.NotBackupSQL)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p string
+		t := scrubTarget{}
+		if err := rows.Scan(&p, &t.sha, &t.size, &t.mtime); err != nil {
+			continue
+		}
+		t.abs = catalogAbs(p)
+		if _, ok := targets[t.abs]; ok {
+			continue
+		}
+		targets[t.abs] = &t
+		order = append(order, t.abs)
+	}
+	rows.Close()
+
+	// sync uploads carry the authoritative hash and the recorded backup path
+	rows, err = db.DB.Query(`SELECT id, filepath, sha256, COALESCE(backup_path, ''), size, mtime FROM media
+		WHERE sha256 IS NOT NULL AND sha256 != ''`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var p, sha, backup string
+		var size sql.NullInt64
+		var mtime sql.NullString
+		if err := rows.Scan(&id, &p, &sha, &backup, &size, &mtime); err != nil {
+			continue
+		}
+		abs := catalogAbs(p)
+		t, ok := targets[abs]
+		if !ok {
+			t = &scrubTarget{abs: abs}
+			targets[abs] = t
+			order = append(order, abs)
+		}
+		// the catalog's size/mtime only vouch for the upload's hash if the
+		// catalog agrees on it; uploads from before media recorded them
+		// otherwise can't tell edits apart
+		if size.Valid && mtime.Valid {
+			t.size, t.mtime = size, mtime
+		} else if t.sha != sha {
+			t.size, t.mtime = sql.NullInt64{}, sql.NullString{}
+		}
+		t.sha = sha
+		t.backup = backup
+		t.fromSync = true
+		t.mediaID = id
+	}
+	rows.Close()
+
+	out := make([]scrubTarget, 0, len(order))
+	for _, abs := range order {
+		t := targets[abs]
+		if t.backup == "" {
+			if bp := backupPathFor(abs); bp != "" {
+				if _, err := os.Stat(bp); err == nil {
+					t.backup = bp
+				}
+			}
+		}
+		out = append(out, *t)
+	}
+	return out, nil
+}
+
+// recordIssue inserts an open issue unless the same one is already open
+func recordIssue(abs, kind, expected, actual, backup string, repairable bool, detail string) {
+	apiPath := relAPIPath(abs)
+	var id int64
+	err := db.DB.QueryRow("SELECT id FROM integrity_issues WHERE filepath = ? AND kind = ? AND resolved_at IS NULL LIMIT 1", apiPath, kind).Scan(&id)
+	if err == nil {
+		_, _ = db.DB.Exec("UPDATE integrity_issues SET actual_sha256 = ?, repairable = ?, detail = ? WHERE id = ?", actual, repairable, detail, id)
+		return
+	}
+	_, err = db.DB.Exec(`INSERT INTO integrity_issues(filepath, kind, expected_sha256, actual_sha256, backup_path, repairable, detail)
+		VALUES(?, ?, ?, ?, ?, ?, ?)`, apiPath, kind, expected, actual, backup, repairable, detail)
+	if err != nil {
+		log.Printf("scrub: record issue %s: %v", apiPath, err)
+	}
+}
+
+// scrubFile verifies one target and returns the number of issues found
+func scrubFile(t scrubTarget) int {
+	fi, err := os.Stat(t.abs)
+	if os.IsNotExist(err) {
+		// missing files are reported by fsck, not the scrubber
+		return 0
+	}
+	// an edit changes size or mtime; only silent changes count as corruption
+	if err == nil && t.size.Valid && t.mtime.Valid &&
+		(fi.Size() != t.size.Int64 || fi.ModTime().UTC().Format(time.RFC3339) != t.mtime.String) {
+		rebaseline(t)
+		return 0
+	}
+
+	found := 0
+	backupSum, backupErr := "", error(nil)
+	if t.backup != "" {
+		backupSum, backupErr = hashFile(t.backup)
+		switch {
+		case backupErr != nil && !os.IsNotExist(backupErr):
+			recordIssue(t.abs, issueBackupUnreadable, t.sha, "", t.backup, false, backupErr.Error())
+			found++
+		case backupErr == nil && backupSum != t.sha:
+			recordIssue(t.abs, issueBackupMismatch, t.sha, backupSum, t.backup, false, "")
+			found++
+		}
+	}
+	backupGood := t.backup != "" && backupErr == nil && backupSum == t.sha
+
+	sum, err := hashFile(t.abs)
+	if err != nil {
+		recordIssue(t.abs, issueUnreadable, t.sha, "", t.backup, backupGood, err.Error())
+		return found + 1
+	}
+	if sum != t.sha {
+		recordIssue(t.abs, issueMismatch, t.sha, sum, t.backup, backupGood, "")
+		return found + 1
+	}
+	return found
+}
+
+// rebaseline takes the current content of an edited file as the known-good
+// one. Sync uploads also get their backup copy refreshed.
+func rebaseline(t scrubTarget) {
+	processHash(t.abs)
+	if !t.fromSync {
+		return
+	}
+	fi, err := os.Stat(t.abs)
+	if err != nil {
+		return
+	}
+	sum, err := hashFile(t.abs)
+	if err != nil {
+		log.Printf("scrub: rehash %s: %v", t.abs, err)
+		return
+	}
+	_, err = db.DB.Exec("UPDATE media SET sha256 = ?, size = ?, mtime = ? WHERE id = ?",
+		sum, fi.Size(), fi.ModTime().UTC().Format(time.RFC3339), t.mediaID)
+	if err != nil {
+		log.Printf("scrub: rebaseline %s: %v", t.abs, err)
+		return
+	}
+	// the backup worker skips existing copies, so refresh this one here
+	if t.backup != "" {
+		if err := storage.CopyFile(t.abs, t.backup); err != nil {
+			log.Printf("scrub: refresh backup %s: %v", t.backup, err)
+		}
+	}
+}
+
+// RunScrub re-hashes every known file (and its backup copy) against the stored
+// SHA256. Returns an error if a scrub is already running.
+func RunScrub() error {
+	scrubMu.Lock()
+	if scrubState.Running {
+		scrubMu.Unlock()
+		return fmt.Errorf("scrub already running")
+	}
+	scrubState = scrubStatus{Running: true, StartedAt: time.Now().UTC().Format(time.RFC3339)}
+	scrubMu.Unlock()
+
+	targets, err := loadScrubTargets()
+	if err != nil {
+		log.Printf("scrub: %v", err)
+	}
+	checked, issues := 0, 0
+	for _, t := range targets {
+		issues += scrubFile(t)
+		checked++
+		scrubMu.Lock()
+		scrubState.Checked, scrubState.Issues = checked, issues
+		scrubMu.Unlock()
+	}
+
+	scrubMu.Lock()
+	scrubState.Running = false
+	scrubState.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	scrubMu.Unlock()
+	log.Printf("scrub: checked %d files, %d issues", checked, issues)
+	return err
+}
+
+// StartScrubScheduler runs RunScrub every interval. interval <= 0 disables it.
+func StartScrubScheduler(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			if err := RunScrub(); err != nil {
+				log.Printf("scheduled scrub: %v", err)
+			}
+		}
+	}()
+}
+
+// IntegrityHandler lists integrity issues and the scrub status.
+// GET /api/integrity?all=1
+func IntegrityHandler(w http.ResponseWriter, r *http.Request) {
+	q := `SELECT id, filepath, kind, COALESCE(expected_sha256, ''), COALESCE(actual_sha256, ''), COALESCE(backup_path, ''),
+		repairable, COALESCE(detail, ''), detected_at, COALESCE(resolved_at, ''), COALESCE(resolution, '') FROM integrity_issues`
+	if r.URL.Query().Get("all") != "1" {
+		q += " WHERE resolved_at IS NULL"
+	}
+	rows, err := db.DB.Query(q + " ORDER BY detected_at DESC LIMIT 1000")
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	issues := []map[string]interface{}{}
+	for rows.Next() {
+		var (
+			id                                        int64
+			p, kind, expected, actual, backup, detail string
+			detected, resolved, resolution            string
+			repairable                                bool
+		)
+		if err := rows.Scan(&id, &p, &kind, &expected, &actual, &backup, &repairable, &detail, &detected, &resolved, &resolution); err != nil {
+			continue
+		}
+		issues = append(issues, map[string]interface{}{
+			"id":         id,
+			"path":       p,
+			"kind":       kind,
+			"expected":   expected,
+			"actual":     actual,
+			"backupPath": backup,
+			"repairable": repairable,
+			"detail":     detail,
+			"detectedAt": detected,
+			"resolvedAt": resolved,
+			"resolution": resolution,
+		})
+	}
+	scrubMu.Lock()
+	status := scrubState
+	scrubMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"issues": issues, "scrub": status})
+}
+
+// IntegrityScrubHandler starts a scrub in the background.
+// POST /api/integrity/scrub
+func IntegrityScrubHandler(w http.ResponseWriter, r *http.Request) {
+	scrubMu.Lock()
+	running := scrubState.Running
+	scrubMu.Unlock()
+	if running {
+		http.Error(w, "scrub already running", http.StatusConflict)
+		return
+	}
+	go func() {
+		if err := RunScrub(); err != nil {
+			log.Printf("scrub: %v", err)
+		}
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "started"})
+}
+
+// IntegrityRepairHandler restores a corrupted file from its verified backup copy,
+// or refreshes a corrupted backup from a verified primary.
+// POST /api/integrity/repair?id=N
+func IntegrityRepairHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "id required", http.StatusBadRequest)
+		return
+	}
+	var apiPath, kind, expected, backup string
+	err = db.DB.QueryRow(`SELECT filepath, kind, COALESCE(expected_sha256, ''), COALESCE(backup_path, '')
+		FROM integrity_issues WHERE id = ? AND resolved_at IS NULL`, id).Scan(&apiPath, &kind, &expected, &backup)
+	if err != nil {
+		http.Error(w, "open issue not found", http.StatusNotFound)
+		return
+	}
+	abs, err := absClean(DataDir, apiPath)
+	if err != nil || backup == "" || expected == "" {
+		http.Error(w, "issue is not repairable", http.StatusConflict)
+		return
+	}
+
+	// copy from whichever side still matches the stored hash
+	src, dst, resolution := backup, abs, "restored_from_backup"
+	if kind == issueBackupMismatch || kind == issueBackupUnreadable {
+		src, dst, resolution = abs, backup, "backup_refreshed"
+	}
+	if sum, err := hashFile(src); err != nil || sum != expected {
+		http.Error(w, "no known-good copy available", http.StatusConflict)
+		return
+	}
+	var keepMtime time.Time
+	if fi, err := os.Stat(dst); err == nil {
+		keepMtime = fi.ModTime()
+	}
+	if err := storage.CopyFile(src, dst); err != nil {
+		http.Error(w, "repair failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// keep the original mtime so the indexer doesn't see the repair as an edit
+	if !keepMtime.IsZero() {
+		_ = os.Chtimes(dst, keepMtime, keepMtime)
+	}
+	if sum, err := hashFile(dst); err != nil || sum != expected {
+		http.Error(w, "repair did not verify", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err := db.DB.Exec("UPDATE integrity_issues SET resolved_at = ?, resolution = ? WHERE id = ?", now, resolution, id); err != nil {
+		http.Error(w, "db update: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if dst == abs {
+		EnqueueThumbnail(abs)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "path": apiPath, "resolution": resolution})
+}
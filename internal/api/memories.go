@@ -0,0 +1,261 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"localcloud/internal/db"
+)
+
+// memoryDupThreshold is the dHash distance under which two photos of the same
+// day count as near-duplicates (bursts, retakes); only the best one is shown.
+const memoryDupThreshold = 8
+
+// memoryMaxItems caps how many photos a single year's memory shows
+const memoryMaxItems = 12
+
+// memory is "N years ago today": the photos of one earlier year
+type memory struct {
+	Year     int                      `json:"year"`
+	YearsAgo int                      `json:"years_ago"`
+	Title    string                   `json:"title"`
+	Count    int                      `json:"count"` // photos that day, before curation
+	Cover    map[string]interface{}   `json:"cover"`
+	Items    []map[string]interface{} `json:"items"`
+}
+
+// memoryCandidate is a catalog row considered for a memory
+type memoryCandidate struct {
+	item   map[string]interface{}
+	taken  string
+	place  string
+	rating int
+	pixels int
+	hash   uint64
+	hashed bool
+}
+
+// memoriesCacheMax bounds how many dates memoriesCache holds
+const memoriesCacheMax = 32
+
+// memoriesCache holds the memories per calendar day (YYYY-MM-DD); they only
+// change when the date does (or on an explicit refresh).
+var memoriesCache = struct {
+	sync.Mutex
+	days map[string][]memory
+}{days: map[string][]memory{}}
+
+// memoriesFor returns the memories of day, cached per day
+func memoriesFor(day time.Time, refresh bool) ([]memory, error) {
+	key := day.Format("2006-01-02")
+	memoriesCache.Lock()
+	defer memoriesCache.Unlock()
+	if data, ok := memoriesCache.days[key]; ok && !refresh {
+		return data, nil
+	}
+	data, err := buildMemories(day)
+	if err != nil {
+		return nil, err
+	}
+	if len(memoriesCache.days) >= memoriesCacheMax {
+		memoriesCache.days = map[string][]memory{}
+	}
+	memoriesCache.days[key] = data
+	return data, nil
+}
+
+// memoryDays lists the month-days ("01-02") whose photos are remembered on
+// day: Feb 29 photos come back on Feb 28 in non-leap years.
+func memoryDays(day time.Time) []interface{} {
+	days := []interface{}{day.Format("01-02")}
+	leap := time.Date(day.Year(), time.February, 29, 0, 0, 0, 0, time.UTC).Day() == 29
+	if day.Month() == time.February && day.Day() == 28 && !leap {
+		days = append(days, "02-29")
+	}
+	return days
+}
+
+// buildMemories finds photos taken on day's month/day in earlier years and
+// curates each year: near-duplicates dropped, then a diverse pick.
+func buildMemories(day time.Time) ([]memory, error) {
+	days := memoryDays(day)
+	rows, err := db.DB.Query(`SELECT id, filename, filepath, mime, `+takenExpr+`,
+			COALESCE(place, ''), COALESCE(rating, 0), COALESCE(width, 0) * COALESCE(height, 0), COALESCE(phash, '')
+		FROM files
+		WHERE mime LIKE 'image/%' AND canonical_id IS NULL
+			AND substr(`+takenExpr+`, 6, 5) IN (?`+strings.Repeat(", ?", len(days)-1)+`) AND substr(`+takenExpr+`, 1, 4) < ?
+		ORDER BY `+takenExpr,
+		append(days, day.Format("2006"))...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byYear := map[int][]memoryCandidate{}
+	for rows.Next() {
+		var (
+			id                           int64
+			name, p, taken, place, phash string
+			mimeS                        sql.NullString
+			c                            memoryCandidate
+		)
+		if err := rows.Scan(&id, &name, &p, &mimeS, &taken, &place, &c.rating, &c.pixels, &phash); err != nil {
+			log.Printf("memories: row scan: %v", err)
+			continue
+		}
+		if len(taken) < 4 {
+			continue
+		}
+		year, err := strconv.Atoi(taken[:4])
+		if err != nil {
+			continue
+		}
+		apiPath := relAPIPath(catalogAbs(p))
+		c.item = map[string]interface{}{
+			"id":     id,
+			"name":   name,
+			"path":   apiPath,
+			"mime":   mimeS.String,
+			"type":   "file",
+			"taken":  taken,
+			"thumb":  thumbURL(apiPath, defaultRendition),
+			"srcset": thumbSrcset(apiPath),
+		}
+		if place != "" {
+			c.item["place"] = place
+		}
+		c.taken, c.place = taken, place
+		c.hash, c.hashed = parsePHash(phash)
+		byYear[year] = append(byYear[year], c)
+	}
+
+	var out []memory
+	for year, cands := range byYear {
+		picked := pickDiverse(dropNearDuplicates(cands), memoryMaxItems)
+		if len(picked) == 0 {
+			continue
+		}
+		m := memory{
+			Year:     year,
+			YearsAgo: day.Year() - year,
+			Count:    len(cands),
+			Cover:    picked[0].item,
+		}
+		if m.YearsAgo == 1 {
+			m.Title = "1 year ago today"
+		} else {
+			m.Title = fmt.Sprintf("%d years ago today", m.YearsAgo)
+		}
+		// the cover is the best photo; show the rest in capture order
+		sort.SliceStable(picked[1:], func(i, j int) bool { return picked[1+i].taken < picked[1+j].taken })
+		for _, c := range picked {
+			m.Items = append(m.Items, c.item)
+		}
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].YearsAgo < out[j].YearsAgo })
+	if out == nil {
+		out = []memory{}
+	}
+	return out, nil
+}
+
+// betterMemory orders candidates by rating, then resolution
+func betterMemory(a, b memoryCandidate) bool {
+	if a.rating != b.rating {
+		return a.rating > b.rating
+	}
+	return a.pixels > b.pixels
+}
+
+// dropNearDuplicates keeps the best photo of each group of perceptually
+// similar ones. Unhashed photos are always kept.
+func dropNearDuplicates(cands []memoryCandidate) []memoryCandidate {
+	sorted := append([]memoryCandidate(nil), cands...)
+	sort.SliceStable(sorted, func(i, j int) bool { return betterMemory(sorted[i], sorted[j]) })
+	var kept []memoryCandidate
+	for _, c := range sorted {
+		dup := false
+		if c.hashed {
+			for _, k := range kept {
+				if k.hashed && bits.OnesCount64(c.hash^k.hash) <= memoryDupThreshold {
+					dup = true
+					break
+				}
+			}
+		}
+		if !dup {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// pickDiverse chooses up to n photos spread across the day's moments (place,
+// else hour of capture), taking the best of each moment round-robin.
+// cands must be ordered best first.
+func pickDiverse(cands []memoryCandidate, n int) []memoryCandidate {
+	var order []string
+	moments := map[string][]memoryCandidate{}
+	for _, c := range cands {
+		key := c.place
+		if key == "" && len(c.taken) >= 13 {
+			key = c.taken[:13] // YYYY-MM-DDTHH
+		}
+		if _, ok := moments[key]; !ok {
+			order = append(order, key)
+		}
+		moments[key] = append(moments[key], c)
+	}
+	var out []memoryCandidate
+	for len(out) < n {
+		added := false
+		for _, k := range order {
+			if len(moments[k]) == 0 || len(out) >= n {
+				continue
+			}
+			out = append(out, moments[k][0])
+			moments[k] = moments[k][1:]
+			added = true
+		}
+		if !added {
+			break
+		}
+	}
+	return out
+}
+
+// MemoriesHandler returns "N years ago today" memories for the home screen.
+// date defaults to today; refresh=1 rebuilds the cached result.
+// GET /api/memories?date=2024-06-12&refresh=1
+func MemoriesHandler(w http.ResponseWriter, r *http.Request) {
+	day := time.Now()
+	if v := r.URL.Query().Get("date"); v != "" {
+		d, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		day = d
+	}
+	mems, err := memoriesFor(day, r.URL.Query().Get("refresh") == "1")
+	if err != nil {
+		log.Printf("memories: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"date":     day.Format("2006-01-02"),
+		"memories": mems,
+	})
+}
@@ -0,0 +1,617 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"localcloud/internal/db"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// ---------------------- extraction ----------------------
+
+// photoMeta is everything the metadata worker stores in the catalog.
+// Zero values mean "not present" and are stored as NULL.
+type photoMeta struct {
+	DateTime     string   `json:"exif_datetime,omitempty"`
+	Make         string   `json:"camera_make,omitempty"`
+	Model        string   `json:"camera_model,omitempty"`
+	Lens         string   `json:"lens_model,omitempty"`
+	FocalLength  float64  `json:"focal_length,omitempty"` // mm
+	Aperture     float64  `json:"aperture,omitempty"`     // f-number
+	ISO          int      `json:"iso,omitempty"`
+	ExposureTime string   `json:"exposure_time,omitempty"` // "1/250", "2.5"
+	Width        int      `json:"width,omitempty"`
+	Height       int      `json:"height,omitempty"`
+	Orientation  int      `json:"orientation,omitempty"`
+	GPS          *gpsFix  `json:"gps,omitempty"`
+	Place        string   `json:"place,omitempty"` // reverse-geocoded from GPS
+	Rating       int      `json:"rating,omitempty"`
+	Keywords     []string `json:"keywords,omitempty"`
+	Title        string   `json:"title,omitempty"`
+	Description  string   `json:"description,omitempty"`
+
+	// videos, from ffprobe (see videometa.go)
+	Duration    float64      `json:"duration,omitempty"` // seconds
+	VideoCodec  string       `json:"video_codec,omitempty"`
+	FrameRate   float64      `json:"frame_rate,omitempty"`
+	Bitrate     int64        `json:"bitrate,omitempty"`  // bits/s, whole file
+	Rotation    int          `json:"rotation,omitempty"` // degrees clockwise
+	AudioTracks []audioTrack `json:"audio_tracks,omitempty"`
+
+	// music, from ID3/Vorbis/iTunes tags (see audiotags.go). The song
+	// title is kept apart from Title, which belongs to XMP and the API.
+	SongTitle   string `json:"song_title,omitempty"`
+	Artist      string `json:"artist,omitempty"`
+	AlbumArtist string `json:"album_artist,omitempty"`
+	Album       string `json:"album,omitempty"`
+	Track       int    `json:"track,omitempty"`
+	Disc        int    `json:"disc,omitempty"`
+	Year        int    `json:"year,omitempty"`
+	Genre       string `json:"genre,omitempty"`
+}
+
+// addTo sets the non-empty fields of m on out, under their JSON names
+func (m photoMeta) addTo(out map[string]interface{}) {
+	set := func(key string, v interface{}, ok bool) {
+		if ok {
+			out[key] = v
+		}
+	}
+	set("exif_datetime", m.DateTime, m.DateTime != "")
+	set("camera_make", m.Make, m.Make != "")
+	set("camera_model", m.Model, m.Model != "")
+	set("lens_model", m.Lens, m.Lens != "")
+	set("focal_length", m.FocalLength, m.FocalLength != 0)
+	set("aperture", m.Aperture, m.Aperture != 0)
+	set("iso", m.ISO, m.ISO != 0)
+	set("exposure_time", m.ExposureTime, m.ExposureTime != "")
+	set("width", m.Width, m.Width != 0)
+	set("height", m.Height, m.Height != 0)
+	set("orientation", m.Orientation, m.Orientation != 0)
+	set("gps", m.GPS, m.GPS != nil)
+	set("place", m.Place, m.Place != "")
+	set("rating", m.Rating, m.Rating != 0)
+	set("keywords", m.Keywords, len(m.Keywords) > 0)
+	set("title", m.Title, m.Title != "")
+	set("description", m.Description, m.Description != "")
+	set("duration", m.Duration, m.Duration != 0)
+	set("video_codec", m.VideoCodec, m.VideoCodec != "")
+	set("frame_rate", m.FrameRate, m.FrameRate != 0)
+	set("bitrate", m.Bitrate, m.Bitrate != 0)
+	set("rotation", m.Rotation, m.Rotation != 0)
+	set("audio_tracks", m.AudioTracks, len(m.AudioTracks) > 0)
+	set("song_title", m.SongTitle, m.SongTitle != "")
+	set("artist", m.Artist, m.Artist != "")
+	set("album_artist", m.AlbumArtist, m.AlbumArtist != "")
+	set("album", m.Album, m.Album != "")
+	set("track", m.Track, m.Track != 0)
+	set("disc", m.Disc, m.Disc != 0)
+	set("year", m.Year, m.Year != 0)
+	set("genre", m.Genre, m.Genre != "")
+}
+
+type gpsFix struct {
+	Lat float64  `json:"lat"`
+	Lon float64  `json:"lon"`
+	Alt *float64 `json:"alt,omitempty"`
+}
+
+// extractMetadata reads EXIF and XMP (embedded and sidecar) from abs,
+// probes videos with ffprobe and reads the tags of music files
+func extractMetadata(abs string) photoMeta {
+	var m photoMeta
+	ext := strings.ToLower(filepath.Ext(abs))
+	if ext == ".xmp" {
+		// a sidecar describes another file, not itself
+		return m
+	}
+	if hasExif(ext) {
+		if x, err := readExif(abs); err == nil {
+			m.fromExif(x)
+		}
+	} else if strings.HasPrefix(mimeTypeFor(abs), "video/") {
+		if err := probeVideoMeta(abs, &m); err != nil {
+			log.Printf("metadata: %s: %v", abs, err)
+		}
+	} else if isAudioExt(ext) {
+		m.fromAudio(abs)
+	}
+	if xmp, ok := readXMP(abs); ok {
+		m.Rating = xmp.Rating
+		m.Keywords = xmp.Keywords
+		if xmp.Title != "" {
+			m.Title = xmp.Title
+		}
+		m.Description = xmp.Description
+	}
+	return m
+}
+
+// fromAudio fills in the music fields from the file's tags. MP3 doesn't
+// record its duration, so that (and the audio track) comes from ffprobe.
+func (m *photoMeta) fromAudio(abs string) {
+	t, err := readAudioTags(abs)
+	if err != nil {
+		log.Printf("metadata: %s: %v", abs, err)
+	}
+	m.SongTitle, m.Artist, m.AlbumArtist, m.Album = t.Title, t.Artist, t.AlbumArtist, t.Album
+	m.Track, m.Disc, m.Year, m.Genre = t.Track, t.Disc, t.Year, t.Genre
+	m.Duration = t.Duration
+	var p photoMeta
+	if err := probeVideoMeta(abs, &p); err == nil {
+		if m.Duration == 0 {
+			m.Duration = p.Duration
+		}
+		m.Bitrate, m.AudioTracks = p.Bitrate, p.AudioTracks
+	}
+}
+
+func (m *photoMeta) fromExif(x *exif.Exif) {
+	str := func(f exif.FieldName) string {
+		if t, err := x.Get(f); err == nil {
+			if s, err := t.StringVal(); err == nil {
+				return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+			}
+		}
+		return ""
+	}
+	num := func(f exif.FieldName) int {
+		if t, err := x.Get(f); err == nil {
+			if v, err := t.Int(0); err == nil {
+				return v
+			}
+		}
+		return 0
+	}
+	rat := func(f exif.FieldName) (int64, int64, bool) {
+		if t, err := x.Get(f); err == nil {
+			if n, d, err := t.Rat2(0); err == nil && d != 0 {
+				return n, d, true
+			}
+		}
+		return 0, 0, false
+	}
+
+	if dt, err := x.DateTime(); err == nil {
+		m.DateTime = dt.Format(takenLayout)
+	}
+	m.Make = str(exif.Make)
+	m.Model = str(exif.Model)
+	m.Lens = str(exif.LensModel)
+	if n, d, ok := rat(exif.FocalLength); ok {
+		m.FocalLength = float64(n) / float64(d)
+	}
+	if n, d, ok := rat(exif.FNumber); ok {
+		m.Aperture = math.Round(float64(n)/float64(d)*10) / 10
+	}
+	m.ISO = num(exif.ISOSpeedRatings)
+	if n, d, ok := rat(exif.ExposureTime); ok && n > 0 {
+		m.ExposureTime = formatExposure(n, d)
+	}
+	m.Width = num(exif.PixelXDimension)
+	m.Height = num(exif.PixelYDimension)
+	m.Orientation = num(exif.Orientation)
+	if lat, lon, err := x.LatLong(); err == nil && !math.IsNaN(lat) && !math.IsNaN(lon) && (lat != 0 || lon != 0) {
+		m.GPS = &gpsFix{Lat: lat, Lon: lon}
+		if n, d, ok := rat(exif.GPSAltitude); ok {
+			alt := float64(n) / float64(d)
+			if num(exif.GPSAltitudeRef) == 1 {
+				alt = -alt
+			}
+			m.GPS.Alt = &alt
+		}
+		m.Place = reverseGeocode(lat, lon)
+	}
+}
+
+// formatExposure renders a shutter speed the way cameras display it
+func formatExposure(n, d int64) string {
+	if n >= d {
+		return strconv.FormatFloat(float64(n)/float64(d), 'f', -1, 64)
+	}
+	return fmt.Sprintf("1/%d", int64(math.Round(float64(d)/float64(n))))
+}
+
+// ---------------------- XMP ----------------------
+
+const (
+	nsXMP = "http://ns.adobe.com/xap/1.0/"
+	nsDC  = "http://purl.org/dc/elements/1.1/"
+)
+
+// xmpMeta is the subset of XMP we catalog
+type xmpMeta struct {
+	Rating      int
+	Keywords    []string
+	Title       string
+	Description string
+}
+
+// maxXMPScan bounds how much of a file is searched for an embedded XMP packet
+const maxXMPScan = 8 << 20
+
+// readXMP returns XMP from the sidecar of abs (see sidecarPath) if there is
+// one, else from the packet embedded in the file itself. The JPEG of a
+// RAW+JPEG pair without a sidecar of its own reads the RAW's, as both are the
+// same shot; it is never written through the JPEG.
+func readXMP(abs string) (xmpMeta, bool) {
+	var sides []string
+	if side, ok := sidecarPath(abs); ok {
+		sides = append(sides, side)
+	}
+	if raw := rawSibling(abs); raw != "" {
+		if side, ok := sidecarPath(raw); ok {
+			sides = append(sides, side)
+		}
+	}
+	for _, p := range sides {
+		if data, err := os.ReadFile(p); err == nil {
+			if m, err := parseXMP(data); err == nil {
+				return m, true
+			}
+		}
+	}
+	if !hasEmbeddedXMP(strings.ToLower(filepath.Ext(abs))) {
+		return xmpMeta{}, false
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return xmpMeta{}, false
+	}
+	defer f.Close()
+	packet := scanXMPPacket(io.LimitReader(f, maxXMPScan))
+	if packet == nil {
+		return xmpMeta{}, false
+	}
+	m, err := parseXMP(packet)
+	return m, err == nil
+}
+
+// hasEmbeddedXMP reports whether files with extension ext are worth
+// searching for an embedded XMP packet
+func hasEmbeddedXMP(ext string) bool {
+	return ext == ".jpg" || ext == ".jpeg" || ext == ".tif" || ext == ".tiff" || isRawExt(ext) || isHEIFExt(ext)
+}
+
+// maxXMPPacket bounds the size of an embedded XMP packet
+const maxXMPPacket = 1 << 20
+
+// scanXMPPacket returns the first "<x:xmpmeta ...</x:xmpmeta>" packet in r,
+// reading it in chunks rather than all at once, or nil if there is none.
+func scanXMPPacket(r io.Reader) []byte {
+	open, end := []byte("<x:xmpmeta"), []byte("</x:xmpmeta>")
+	chunk := make([]byte, 64<<10)
+	var window, packet []byte
+	for {
+		n, err := r.Read(chunk)
+		if packet == nil {
+			// keep a tail so a marker split across reads is still found
+			window = append(window, chunk[:n]...)
+			if i := bytes.Index(window, open); i >= 0 {
+				packet = append([]byte(nil), window[i:]...)
+			} else if len(window) >= len(open) {
+				window = append(window[:0], window[len(window)-len(open)+1:]...)
+			}
+		} else {
+			packet = append(packet, chunk[:n]...)
+		}
+		if packet != nil {
+			if i := bytes.Index(packet, end); i >= 0 {
+				return packet[:i+len(end)]
+			}
+			if len(packet) > maxXMPPacket {
+				return nil
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// parseXMP extracts xmp:Rating, dc:subject, dc:title and dc:description from
+// an XMP packet. Rating may be an attribute of rdf:Description or an element
+// of its own; for the language alternatives of title/description the first
+// entry (x-default by convention) is used.
+func parseXMP(data []byte) (xmpMeta, error) {
+	var m xmpMeta
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var stack []xml.Name
+	inSubject := false
+	var inAlt *string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name)
+			for _, a := range t.Attr {
+				if a.Name.Space == nsXMP && a.Name.Local == "Rating" {
+					m.Rating, _ = strconv.Atoi(strings.TrimSpace(a.Value))
+				}
+			}
+			if t.Name.Space == nsDC {
+				switch t.Name.Local {
+				case "subject":
+					inSubject = true
+				case "title":
+					inAlt = &m.Title
+				case "description":
+					inAlt = &m.Description
+				}
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			if t.Name.Space == nsDC {
+				switch t.Name.Local {
+				case "subject":
+					inSubject = false
+				case "title", "description":
+					inAlt = nil
+				}
+			}
+		case xml.CharData:
+			if len(stack) == 0 {
+				continue
+			}
+			cur := stack[len(stack)-1]
+			s := strings.TrimSpace(string(t))
+			if s == "" {
+				continue
+			}
+			switch {
+			case cur.Space == nsXMP && cur.Local == "Rating":
+				m.Rating, _ = strconv.Atoi(s)
+			case inSubject && cur.Local == "li":
+				m.Keywords = append(m.Keywords, s)
+			case inAlt != nil && cur.Local == "li" && *inAlt == "":
+				*inAlt = s
+			}
+		}
+	}
+	// -1 means "rejected" in Lightroom; keep 0-5 only
+	if m.Rating < 0 || m.Rating > 5 {
+		m.Rating = 0
+	}
+	return m, nil
+}
+
+// ---------------------- catalog storage ----------------------
+
+func nullStr(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullNum(v float64) interface{} {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+// storeMetadata writes m into the catalog row(s) of abs. Width/height only
+// fill in when unknown; the thumbnailer records the decoded size. XMP
+// rating, title and description replace the stored ones; when XMP has none,
+// values set through the API are kept. XMP keywords are imported as tags.
+func storeMetadata(abs string, m photoMeta) error {
+	var lat, lon, alt, place interface{}
+	if m.GPS != nil {
+		// "" (not NULL) marks "geocoded, nothing nearby"
+		lat, lon, place = m.GPS.Lat, m.GPS.Lon, m.Place
+		if m.GPS.Alt != nil {
+			alt = *m.GPS.Alt
+		}
+	}
+	var keywords, audioTracks, audioCodec interface{}
+	if len(m.Keywords) > 0 {
+		b, _ := json.Marshal(m.Keywords)
+		keywords = string(b)
+	}
+	if len(m.AudioTracks) > 0 {
+		b, _ := json.Marshal(m.AudioTracks)
+		audioTracks, audioCodec = string(b), nullStr(m.AudioTracks[0].Codec)
+	}
+	err := updateCatalog(abs, `exif_datetime = ?, camera_make = ?, camera_model = ?, lens_model = ?,
+		focal_length = ?, aperture = ?, iso = ?, exposure_time = ?,
+		width = COALESCE(width, ?), height = COALESCE(height, ?), orientation = ?,
+		gps_lat = ?, gps_lon = ?, gps_alt = ?, place = ?, rating = COALESCE(?, rating), keywords = ?,
+		title = COALESCE(?, title), description = COALESCE(?, description),
+		duration = ?, video_codec = ?, frame_rate = ?, bitrate = ?, rotation = ?, audio_codec = ?, audio_tracks = ?,
+		song_title = ?, artist = ?, album_artist = ?, album = ?, track = ?, disc = ?, year = ?, genre = ?,
+		metadata_at = ?`,
+		nullStr(m.DateTime), nullStr(m.Make), nullStr(m.Model), nullStr(m.Lens),
+		nullNum(m.FocalLength), nullNum(m.Aperture), nullNum(float64(m.ISO)), nullStr(m.ExposureTime),
+		nullNum(float64(m.Width)), nullNum(float64(m.Height)), nullNum(float64(m.Orientation)),
+		lat, lon, alt, place, nullNum(float64(m.Rating)), keywords,
+		nullStr(m.Title), nullStr(m.Description),
+		nullNum(m.Duration), nullStr(m.VideoCodec), nullNum(m.FrameRate), nullNum(float64(m.Bitrate)),
+		nullNum(float64(m.Rotation)), audioCodec, audioTracks,
+		nullStr(m.SongTitle), nullStr(m.Artist), nullStr(m.AlbumArtist), nullStr(m.Album),
+		nullNum(float64(m.Track)), nullNum(float64(m.Disc)), nullNum(float64(m.Year)), nullStr(m.Genre),
+		time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return importXMPTags(abs, m.Keywords)
+}
+
+func processMetadata(abs string) {
+	if fi, err := os.Stat(abs); err != nil || fi.IsDir() {
+		return
+	}
+	if err := storeMetadata(abs, extractMetadata(abs)); err != nil {
+		log.Printf("metadata: db update %s: %v", abs, err)
+	}
+}
+
+// loadMetadata reads the stored metadata of abs from the catalog. extracted
+// is false while the worker hasn't processed the current version of the file.
+func loadMetadata(abs string) (m photoMeta, extracted, ok bool) {
+	keys := catalogKeys(abs)
+	var (
+		dt, mk, model, lens, exposure, place, keywords, at sql.NullString
+		title, description, videoCodec, audioTracks        sql.NullString
+		songTitle, artist, albumArtist, album, genre       sql.NullString
+		focal, aperture, lat, lon, alt                     sql.NullFloat64
+		duration, frameRate                                sql.NullFloat64
+		iso, width, height, orientation, rating            sql.NullInt64
+		bitrate, rotation, track, disc, year               sql.NullInt64
+	)
+	err := db.DB.QueryRow(`SELECT exif_datetime, camera_make, camera_model, lens_model,
+		focal_length, aperture, iso, exposure_time, width, height, orientation,
+		gps_lat, gps_lon, gps_alt, place, rating, keywords, title, description,
+		duration, video_codec, frame_rate, bitrate, rotation, audio_tracks,
+		song_title, artist, album_artist, album, track, disc, year, genre, metadata_at
+		FROM files WHERE filepath IN (?, ?) ORDER BY id LIMIT 1`, keys[0], keys[1]).Scan(
+		&dt, &mk, &model, &lens, &focal, &aperture, &iso, &exposure, &width, &height, &orientation,
+		&lat, &lon, &alt, &place, &rating, &keywords, &title, &description,
+		&duration, &videoCodec, &frameRate, &bitrate, &rotation, &audioTracks,
+		&songTitle, &artist, &albumArtist, &album, &track, &disc, &year, &genre, &at)
+	if err != nil {
+		return m, false, false
+	}
+	m.DateTime, m.Make, m.Model, m.Lens = dt.String, mk.String, model.String, lens.String
+	m.FocalLength, m.Aperture, m.ISO = focal.Float64, aperture.Float64, int(iso.Int64)
+	m.ExposureTime = exposure.String
+	m.Width, m.Height, m.Orientation = int(width.Int64), int(height.Int64), int(orientation.Int64)
+	if lat.Valid && lon.Valid {
+		m.GPS = &gpsFix{Lat: lat.Float64, Lon: lon.Float64}
+		if alt.Valid {
+			m.GPS.Alt = &alt.Float64
+		}
+		m.Place = place.String
+	}
+	m.Rating = int(rating.Int64)
+	m.Title, m.Description = title.String, description.String
+	if keywords.Valid {
+		_ = json.Unmarshal([]byte(keywords.String), &m.Keywords)
+	}
+	m.Duration, m.VideoCodec, m.FrameRate = duration.Float64, videoCodec.String, frameRate.Float64
+	m.Bitrate, m.Rotation = bitrate.Int64, int(rotation.Int64)
+	if audioTracks.Valid {
+		_ = json.Unmarshal([]byte(audioTracks.String), &m.AudioTracks)
+	}
+	m.SongTitle, m.Artist, m.AlbumArtist = songTitle.String, artist.String, albumArtist.String
+	m.Album, m.Genre = album.String, genre.String
+	m.Track, m.Disc, m.Year = int(track.Int64), int(disc.Int64), int(year.Int64)
+	return m, at.Valid, true
+}
+
+// ---------------------- worker ----------------------
+
+var metadataQueue chan metadataJob
+
+// metadataJob is a file queued for extraction. notify is set for new arrivals
+// that smart albums should hear about once their metadata is known.
+type metadataJob struct {
+	abs    string
+	notify bool
+}
+
+func (j metadataJob) run() {
+	processMetadata(j.abs)
+	if j.notify {
+		notifySmartAlbums(relAPIPath(j.abs))
+	}
+}
+
+// StartMetadataWorker starts N goroutines extracting metadata for files
+// queued by EnqueueMetadata.
+func StartMetadataWorker(concurrency int) {
+	if metadataQueue != nil {
+		return
+	}
+	metadataQueue = make(chan metadataJob, 1024)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for j := range metadataQueue {
+				j.run()
+			}
+		}()
+	}
+}
+
+// EnqueueMetadata queues a newly stored file for extraction (best-effort),
+// notifying smart albums afterwards if notify is set.
+func EnqueueMetadata(abs string, notify bool) {
+	j := metadataJob{abs: abs, notify: notify}
+	if metadataQueue != nil {
+		select {
+		case metadataQueue <- j:
+			return
+		default:
+		}
+	}
+	// queue full or no worker: the next ExtractCatalogMetadata sweep picks it
+	// up, but a notification can't wait for that
+	if notify {
+		go j.run()
+	}
+}
+
+// ExtractCatalogMetadata extracts metadata for every catalog row that has
+// none yet (new files, and files whose size/mtime changed since), whose
+// coordinates haven't been reverse-geocoded, or videos and music not probed
+// yet.
+func ExtractCatalogMetadata(concurrency int) int {
+	rows, err := db.DB.Query(`SELECT filepath FROM files
+		WHERE (metadata_at IS NULL OR (gps_lat IS NOT NULL AND place IS NULL)
+			OR (mime LIKE 'video/%' AND video_codec IS NULL)
+			OR (mime LIKE 'audio/%' AND duration IS NULL AND artist IS NULL AND album IS NULL))
+			AND canonical_id IS NULL`)
+	if err != nil {
+		log.Printf("ExtractCatalogMetadata: query: %v", err)
+		return 0
+	}
+	var paths []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	rows.Close()
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				processMetadata(catalogAbs(p))
+			}
+		}()
+	}
+	for _, p := range paths {
+		jobs <- p
+	}
+	close(jobs)
+	wg.Wait()
+	log.Printf("ExtractCatalogMetadata: processed %d files", len(paths))
+	return len(paths)
+}
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"localcloud/internal/db"
+)
+
+// musicWhere selects the music in the catalog; tags come from audiotags.go
+const musicWhere = `mime LIKE 'audio/%' AND canonical_id IS NULL`
+
+// Albums group under their album artist, so compilations stay together;
+// untagged tracks land in "Unknown Artist" / "Unknown Album".
+const (
+	musicArtistExpr = `COALESCE(NULLIF(album_artist, ''), NULLIF(artist, ''), 'Unknown Artist')`
+	musicAlbumExpr  = `COALESCE(NULLIF(album, ''), 'Unknown Album')`
+)
+
+type musicArtist struct {
+	Name   string `json:"name"`
+	Albums int    `json:"albums"`
+	Tracks int    `json:"tracks"`
+}
+
+type musicAlbum struct {
+	Name     string  `json:"name"`
+	Artist   string  `json:"artist"`
+	Year     int     `json:"year,omitempty"`
+	Genre    string  `json:"genre,omitempty"`
+	Tracks   int     `json:"tracks"`
+	Duration float64 `json:"duration,omitempty"` // seconds
+	Cover    string  `json:"cover"`              // API path of the track whose art stands for the album
+	Created  string  `json:"created,omitempty"`  // when its first track was added
+}
+
+type musicTrack struct {
+	ID       int64   `json:"id"`
+	Path     string  `json:"path"`
+	Title    string  `json:"title"`
+	Artist   string  `json:"artist,omitempty"`
+	Album    string  `json:"album"`
+	AlbumArt string  `json:"album_artist"`
+	Track    int     `json:"track,omitempty"`
+	Disc     int     `json:"disc,omitempty"`
+	Year     int     `json:"year,omitempty"`
+	Genre    string  `json:"genre,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Bitrate  int64   `json:"bitrate,omitempty"`
+	Size     int64   `json:"size,omitempty"`
+	Mime     string  `json:"mime"`
+}
+
+// musicArtists lists album artists alphabetically, optionally only those
+// whose name contains match
+func musicArtists(match string, limit, offset int) ([]musicArtist, error) {
+	rows, err := db.DB.Query(`SELECT `+musicArtistExpr+` AS a, COUNT(DISTINCT `+musicAlbumExpr+`), COUNT(*)
+		FROM files WHERE `+musicWhere+` GROUP BY a HAVING a LIKE ? ORDER BY a COLLATE NOCASE LIMIT ? OFFSET ?`,
+		"%"+match+"%", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []musicArtist{}
+	for rows.Next() {
+		var a musicArtist
+		if err := rows.Scan(&a.Name, &a.Albums, &a.Tracks); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// musicAlbums lists the albums of artist (oldest first), or of everyone
+// (alphabetically) when artist is "", optionally only titles containing match
+func musicAlbums(artist, match string, limit, offset int) ([]musicAlbum, error) {
+	qry := `SELECT ` + musicAlbumExpr + ` AS al, ` + musicArtistExpr + ` AS a, MAX(year), MAX(genre),
+		COUNT(*), SUM(duration), MIN(filepath), MIN(uploaded_at) FROM files WHERE ` + musicWhere
+	args := []interface{}{}
+	order := "al COLLATE NOCASE, a COLLATE NOCASE"
+	if artist != "" {
+		qry += " AND " + musicArtistExpr + " = ?"
+		args = append(args, artist)
+		order = "MAX(year), al COLLATE NOCASE"
+	}
+	qry += " GROUP BY a, al HAVING al LIKE ? ORDER BY " + order + " LIMIT ? OFFSET ?"
+	args = append(args, "%"+match+"%", limit, offset)
+	rows, err := db.DB.Query(qry, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []musicAlbum{}
+	for rows.Next() {
+		var a musicAlbum
+		var year sql.NullInt64
+		var genre, created sql.NullString
+		var dur sql.NullFloat64
+		if err := rows.Scan(&a.Name, &a.Artist, &year, &genre, &a.Tracks, &dur, &a.Cover, &created); err != nil {
+			return nil, err
+		}
+		a.Year, a.Genre, a.Duration, a.Created = int(year.Int64), genre.String, dur.Float64, created.String
+		a.Cover = relAPIPath(catalogAbs(a.Cover))
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// musicTracks lists the tracks of one album in disc and track order
+func musicTracks(artist, album string) ([]musicTrack, error) {
+	return queryMusicTracks(` AND `+musicArtistExpr+` = ? AND `+musicAlbumExpr+` = ?
+		ORDER BY COALESCE(disc, 1), COALESCE(track, 9999), filename COLLATE NOCASE`, artist, album)
+}
+
+// queryMusicTracks runs a track query; tail adds conditions and ordering
+func queryMusicTracks(tail string, args ...interface{}) ([]musicTrack, error) {
+	rows, err := db.DB.Query(`SELECT id, filepath, filename, song_title, artist, `+musicAlbumExpr+`, `+musicArtistExpr+`,
+		track, disc, year, genre, duration, bitrate, size, mime
+		FROM files WHERE `+musicWhere+tail, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []musicTrack{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		var t musicTrack
+		var name string
+		var title, artist, genre, mt sql.NullString
+		var track, disc, year, bitrate, size sql.NullInt64
+		var dur sql.NullFloat64
+		if err := rows.Scan(&t.ID, &t.Path, &name, &title, &artist, &t.Album, &t.AlbumArt,
+			&track, &disc, &year, &genre, &dur, &bitrate, &size, &mt); err != nil {
+			return nil, err
+		}
+		// legacy rows store absolute paths; one may sit next to the row the
+		// indexer added for the same file
+		if t.Path = relAPIPath(catalogAbs(t.Path)); seen[t.Path] {
+			continue
+		}
+		seen[t.Path] = true
+		t.Title, t.Artist, t.Genre, t.Mime = title.String, artist.String, genre.String, mt.String
+		if t.Title == "" {
+			t.Title = name
+		}
+		t.Track, t.Disc, t.Year = int(track.Int64), int(disc.Int64), int(year.Int64)
+		t.Duration, t.Bitrate, t.Size = dur.Float64, bitrate.Int64, size.Int64
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// musicPage reads limit/offset, defaulting limit to def
+func musicPage(r *http.Request, def int) (limit, offset int) {
+	limit = def
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && v > 0 {
+		offset = v
+	}
+	return limit, offset
+}
+
+func musicAlbumURL(artist, album string) string {
+	return "/api/music/album?artist=" + url.QueryEscape(artist) + "&album=" + url.QueryEscape(album)
+}
+
+// MusicArtistsHandler lists the artists of the music library.
+// GET /api/music/artists?limit=200&offset=0
+func MusicArtistsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset := musicPage(r, 200)
+	artists, err := musicArtists("", limit, offset)
+	if err != nil {
+		log.Printf("music: artists: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	items := make([]map[string]interface{}, 0, len(artists))
+	for _, a := range artists {
+		items = append(items, map[string]interface{}{
+			"name":   a.Name,
+			"albums": a.Albums,
+			"tracks": a.Tracks,
+			"url":    "/api/music/albums?artist=" + url.QueryEscape(a.Name),
+		})
+	}
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{"artists": items, "offset": offset, "limit": limit})
+}
+
+// MusicAlbumsHandler lists the albums of an artist, or all albums.
+// GET /api/music/albums?artist=Name&limit=200&offset=0
+func MusicAlbumsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset := musicPage(r, 200)
+	artist := r.URL.Query().Get("artist")
+	albums, err := musicAlbums(artist, "", limit, offset)
+	if err != nil {
+		log.Printf("music: albums: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	items := make([]map[string]interface{}, 0, len(albums))
+	for _, a := range albums {
+		items = append(items, map[string]interface{}{
+			"name":     a.Name,
+			"artist":   a.Artist,
+			"year":     a.Year,
+			"genre":    a.Genre,
+			"tracks":   a.Tracks,
+			"duration": a.Duration,
+			"cover":    thumbURL(a.Cover, defaultRendition),
+			"url":      musicAlbumURL(a.Artist, a.Name),
+		})
+	}
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{"artist": artist, "albums": items, "offset": offset, "limit": limit})
+}
+
+// MusicAlbumHandler lists the tracks of an album, ready to play.
+// GET /api/music/album?artist=Name&album=Title
+func MusicAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	artist, album := r.URL.Query().Get("artist"), r.URL.Query().Get("album")
+	if artist == "" || album == "" {
+		http.Error(w, "artist and album are required", http.StatusBadRequest)
+		return
+	}
+	tracks, err := musicTracks(artist, album)
+	if err != nil {
+		log.Printf("music: album: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if len(tracks) == 0 {
+		http.Error(w, "album not found", http.StatusNotFound)
+		return
+	}
+	items := make([]map[string]interface{}, 0, len(tracks))
+	var total float64
+	year := 0
+	for _, t := range tracks {
+		total += t.Duration
+		if t.Year > year {
+			year = t.Year
+		}
+		items = append(items, map[string]interface{}{
+			"path":     t.Path,
+			"title":    t.Title,
+			"artist":   t.Artist,
+			"track":    t.Track,
+			"disc":     t.Disc,
+			"genre":    t.Genre,
+			"duration": t.Duration,
+			"mime":     t.Mime,
+			"url":      "/api/file?path=" + url.QueryEscape(t.Path),
+			"thumb":    thumbURL(t.Path, defaultRendition),
+		})
+	}
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{
+		"name":     album,
+		"artist":   artist,
+		"year":     year,
+		"duration": total,
+		"cover":    thumbURL(tracks[0].Path, defaultRendition),
+		"tracks":   items,
+	})
+}
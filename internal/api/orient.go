@@ -0,0 +1,81 @@
+package api
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// exifOrientation returns the EXIF Orientation tag (1-8) of abs, or 1 when
+// the file has none.
+func exifOrientation(abs string) int {
+	if !hasExif(strings.ToLower(filepath.Ext(abs))) {
+		return 1
+	}
+	x, err := readExif(abs)
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// applyOrientation transforms img so it displays upright for the given EXIF
+// orientation value.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// convertOriented writes a full-size copy of src with its EXIF rotation baked in
+func convertOriented(src, dst string) error {
+	img, err := imaging.Open(src)
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp.jpg"
+	defer os.Remove(tmp)
+	if err := imaging.Save(applyOrientation(img, exifOrientation(src)), tmp, imaging.JPEGQuality(92)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// orientedConverterFor returns how to build an upright rendition of abs for
+// /api/file?oriented=1, or nil when the original already displays upright.
+func orientedConverterFor(abs string) func(src, dst string) error {
+	if convert := converterFor(abs); convert != nil {
+		// HEIF/RAW renderings are already upright
+		return convert
+	}
+	if isImageExt(strings.ToLower(filepath.Ext(abs))) && exifOrientation(abs) > 1 {
+		return convertOriented
+	}
+	return nil
+}
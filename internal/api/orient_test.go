@@ -0,0 +1,80 @@
+package api
+
+import (
+	"image"
+	"image/color"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// testdata/orientation/<n>.jpg are the same 64x32 picture (red, green / blue,
+// white quadrants when upright) stored the way a camera writes EXIF
+// orientation n, with the tag set accordingly.
+func TestApplyOrientation(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	white := color.RGBA{255, 255, 255, 255}
+
+	tests := []struct {
+		name        string
+		orientation int
+	}{
+		{"normal", 1},
+		{"mirrored horizontally", 2},
+		{"rotated 180", 3},
+		{"mirrored vertically", 4},
+		{"transposed", 5},
+		{"rotated 90 CW", 6},
+		{"transversed", 7},
+		{"rotated 90 CCW", 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join("testdata", "orientation", strconv.Itoa(tt.orientation)+".jpg")
+			if got := exifOrientation(src); got != tt.orientation {
+				t.Fatalf("exifOrientation = %d, want %d", got, tt.orientation)
+			}
+			img, err := imaging.Open(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := applyOrientation(img, tt.orientation)
+			if b := out.Bounds(); b.Dx() != 64 || b.Dy() != 32 {
+				t.Fatalf("size = %dx%d, want 64x32", b.Dx(), b.Dy())
+			}
+			for _, q := range []struct {
+				x, y int
+				want color.RGBA
+			}{
+				{16, 8, red}, {48, 8, green}, {16, 24, blue}, {48, 24, white},
+			} {
+				if got := out.At(q.x, q.y); !colorNear(got, q.want) {
+					t.Errorf("pixel (%d,%d) = %v, want %v", q.x, q.y, got, q.want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyOrientationUnknown(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for _, o := range []int{0, 9, -1} {
+		if out := applyOrientation(img, o); out != image.Image(img) {
+			t.Errorf("orientation %d: image was transformed", o)
+		}
+	}
+}
+
+// colorNear compares colors with room for JPEG artifacts
+func colorNear(c color.Color, want color.RGBA) bool {
+	r, g, b, _ := c.RGBA()
+	near := func(v uint32, w uint8) bool {
+		d := int(v>>8) - int(w)
+		return d > -40 && d < 40
+	}
+	return near(r, want.R) && near(g, want.G) && near(b, want.B)
+}
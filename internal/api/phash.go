@@ -0,0 +1,222 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"math/bits"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+
+	"localcloud/internal/db"
+
+	"github.com/disintegration/imaging"
+)
+
+// dHash computes a 64-bit difference hash: the image is shrunk to 9x8
+// grayscale and each bit records whether a pixel is brighter than its right
+// neighbour. Resizes, recompression and small edits barely change it.
+func dHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			l := small.Pix[small.PixOffset(x, y)]
+			r := small.Pix[small.PixOffset(x+1, y)]
+			h <<= 1
+			if l > r {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+func formatPHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+func parsePHash(s string) (uint64, bool) {
+	h, err := strconv.ParseUint(s, 16, 64)
+	return h, err == nil
+}
+
+// storePerceptualHash saves the perceptual hash (computed from the already
+// downscaled thumbnail) and the original dimensions of abs
+func storePerceptualHash(abs string, thumb image.Image, width, height int) {
+	if err := updateCatalog(abs, "phash = ?, width = ?, height = ?", formatPHash(dHash(thumb)), width, height); err != nil {
+		log.Printf("phash: db update %s: %v", abs, err)
+	}
+}
+
+// backfillPerceptualHash hashes images whose thumbnail already existed before
+// perceptual hashing was added. The cached thumbnail is decoded instead of the
+// original since dHash only looks at a 9x8 version anyway.
+func backfillPerceptualHash(abs, thumb string) {
+	keys := catalogKeys(abs)
+	var ph string
+	err := db.DB.QueryRow("SELECT COALESCE(phash, '') FROM files WHERE filepath IN (?, ?) LIMIT 1", keys[0], keys[1]).Scan(&ph)
+	if err != nil || ph != "" {
+		return
+	}
+	img, err := imaging.Open(thumb)
+	if err != nil {
+		return
+	}
+	width, height := 0, 0
+	if f, err := os.Open(abs); err == nil {
+		if cfg, _, err := image.DecodeConfig(f); err == nil {
+			width, height = cfg.Width, cfg.Height
+		}
+		f.Close()
+	}
+	storePerceptualHash(abs, img, width, height)
+}
+
+// similarImage is one member of a near-duplicate cluster
+type similarImage struct {
+	ID       int64  `json:"id"`
+	Path     string `json:"path"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Size     int64  `json:"size"`
+	PHash    string `json:"phash"`
+	Distance int    `json:"distance"` // hamming distance to the suggested keeper
+	Keep     bool   `json:"keep"`
+	hash     uint64
+}
+
+// betterKeeper orders images by resolution, then file size
+func betterKeeper(a, b similarImage) bool {
+	if pa, pb := a.Width*a.Height, b.Width*b.Height; pa != pb {
+		return pa > pb
+	}
+	return a.Size > b.Size
+}
+
+// loadSimilarClusters groups catalog images whose perceptual hashes are within
+// threshold bits of each other (single-linkage). Pairwise comparison is fine
+// for a home library; 64-bit popcounts are cheap.
+func loadSimilarClusters(threshold int) ([][]similarImage, error) {
+	rows, err := db.DB.Query(`SELECT id, filepath, phash, COALESCE(width, 0), COALESCE(height, 0), COALESCE(size, 0)
+		FROM files WHERE phash IS NOT NULL AND phash != '' AND canonical_id IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	imgs := []similarImage{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		var im similarImage
+		var p string
+		if err := rows.Scan(&im.ID, &p, &im.PHash, &im.Width, &im.Height, &im.Size); err != nil {
+			continue
+		}
+		h, ok := parsePHash(im.PHash)
+		if !ok {
+			continue
+		}
+		abs := catalogAbs(p)
+		if seen[abs] {
+			continue
+		}
+		seen[abs] = true
+		im.hash = h
+		im.Path = relAPIPath(abs)
+		imgs = append(imgs, im)
+	}
+	rows.Close()
+
+	// union-find over all pairs within threshold
+	parent := make([]int, len(imgs))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	for i := 0; i < len(imgs); i++ {
+		for j := i + 1; j < len(imgs); j++ {
+			if bits.OnesCount64(imgs[i].hash^imgs[j].hash) <= threshold {
+				if ri, rj := find(i), find(j); ri != rj {
+					parent[rj] = ri
+				}
+			}
+		}
+	}
+	groups := map[int][]similarImage{}
+	for i := range imgs {
+		r := find(i)
+		groups[r] = append(groups[r], imgs[i])
+	}
+
+	clusters := [][]similarImage{}
+	for _, g := range groups {
+		if len(g) < 2 {
+			continue
+		}
+		sort.SliceStable(g, func(a, b int) bool { return betterKeeper(g[a], g[b]) })
+		g[0].Keep = true
+		for i := range g {
+			g[i].Distance = bits.OnesCount64(g[i].hash ^ g[0].hash)
+		}
+		clusters = append(clusters, g)
+	}
+	// biggest clusters first, stable by keeper id
+	sort.Slice(clusters, func(a, b int) bool {
+		if len(clusters[a]) != len(clusters[b]) {
+			return len(clusters[a]) > len(clusters[b])
+		}
+		return clusters[a][0].ID < clusters[b][0].ID
+	})
+	return clusters, nil
+}
+
+// SimilarHandler returns clusters of visually similar images.
+// GET /api/similar?threshold=10&limit=50&offset=0
+func SimilarHandler(w http.ResponseWriter, r *http.Request) {
+	threshold := 10
+	if v, err := strconv.Atoi(r.URL.Query().Get("threshold")); err == nil && v >= 0 && v <= 32 {
+		threshold = v
+	}
+	limit := 50
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	clusters, err := loadSimilarClusters(threshold)
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	total := len(clusters)
+	page := [][]similarImage{}
+	for i := offset; i < total && len(page) < limit; i++ {
+		page = append(page, clusters[i])
+	}
+	out := []map[string]interface{}{}
+	for _, c := range page {
+		out = append(out, map[string]interface{}{
+			"keep":   c[0].Path,
+			"images": c,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"clusters":  out,
+		"threshold": threshold,
+		"offset":    offset,
+		"limit":     limit,
+		"total":     total,
+	})
+}
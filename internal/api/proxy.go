@@ -0,0 +1,567 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"localcloud/internal/db"
+)
+
+// Web proxies are H.264/AAC MP4 copies of videos browsers can't play (HEVC,
+// 10-bit, odd containers), made in the background. They live under
+// DataDir/.proxies mirroring the source tree as "<source name>.<mtime key>.mp4",
+// so an edited source gets a new proxy and the old one becomes garbage.
+
+// codecInfo is what ffprobe says about a video's streams
+type codecInfo struct {
+	Format   string  // container, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+	Video    string  // e.g. "hevc"
+	PixFmt   string  // e.g. "yuv420p10le"
+	Audio    string  // "" when there is no audio stream
+	Duration float64 // seconds
+}
+
+// webPlayable reports whether browsers play the file as-is: H.264 8-bit 4:2:0
+// in MP4/MOV with AAC/MP3 audio, or VP8/VP9/AV1 in WebM with Opus/Vorbis.
+func (c codecInfo) webPlayable() bool {
+	in := func(v string, set ...string) bool {
+		for _, s := range set {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case strings.Contains(c.Format, "mp4"):
+		return c.Video == "h264" && in(c.PixFmt, "yuv420p", "yuvj420p") && in(c.Audio, "", "aac", "mp3")
+	case strings.Contains(c.Format, "webm"):
+		return in(c.Video, "vp8", "vp9", "av1") && in(c.Audio, "", "opus", "vorbis")
+	}
+	return false
+}
+
+// ProxyEncoder probes videos and encodes web proxies; proxyEncoder is the
+// ffmpeg implementation.
+type ProxyEncoder interface {
+	ProbeCodecs(src string) (codecInfo, error)
+	// Encode writes the proxy of src to dst, reporting progress in [0,1],
+	// and returns when done or when ctx is cancelled.
+	Encode(ctx context.Context, src, dst string, info codecInfo, progress func(float64)) error
+}
+
+var proxyEncoder ProxyEncoder = ffmpegProxyEncoder{}
+
+// proxyMaxDim caps the long side of proxies; 4K phone video at 1080p is
+// plenty for a browser over the tunnel.
+const proxyMaxDim = 1920
+
+type ffmpegProxyEncoder struct{}
+
+func (ffmpegProxyEncoder) ProbeCodecs(src string) (codecInfo, error) {
+	var c codecInfo
+	out, err := exec.Command("ffprobe", "-v", "error",
+		"-show_entries", "stream=codec_type,codec_name,pix_fmt:format=format_name,duration",
+		"-of", "json", src).Output()
+	if err != nil {
+		return c, fmt.Errorf("ffprobe: %w", err)
+	}
+	var probe struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			PixFmt    string `json:"pix_fmt"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return c, fmt.Errorf("ffprobe: %w", err)
+	}
+	for _, s := range probe.Streams {
+		switch {
+		case s.CodecType == "video" && c.Video == "" && s.CodecName != "mjpeg" && s.CodecName != "png":
+			// skip cover art, which ffprobe also reports as a video stream
+			c.Video, c.PixFmt = s.CodecName, s.PixFmt
+		case s.CodecType == "audio" && c.Audio == "":
+			c.Audio = s.CodecName
+		}
+	}
+	if c.Video == "" {
+		return c, fmt.Errorf("ffprobe: no video stream")
+	}
+	c.Format = probe.Format.FormatName
+	c.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	return c, nil
+}
+
+func (ffmpegProxyEncoder) Encode(ctx context.Context, src, dst string, info codecInfo, progress func(float64)) error {
+	scale := fmt.Sprintf("scale='if(gte(iw,ih),min(%[1]d,iw),-2)':'if(gte(iw,ih),-2,min(%[1]d,ih))',format=yuv420p", proxyMaxDim)
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error", "-nostdin", "-y", "-i", src,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", scale,
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-profile:v", "high",
+		"-c:a", "aac", "-b:a", "160k", "-ac", "2",
+		// moov atom first so browsers can start playing before the end arrives
+		"-movflags", "+faststart",
+		"-progress", "pipe:1", "-nostats",
+		"-f", "mp4", dst)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// -progress writes key=value blocks; out_time_us is the position reached
+	sc := bufio.NewScanner(stdout)
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), "=")
+		if ok && k == "out_time_us" && info.Duration > 0 {
+			if us, err := strconv.ParseInt(v, 10, 64); err == nil {
+				progress(float64(us) / 1e6 / info.Duration)
+			}
+		}
+	}
+	_, _ = io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// proxyPathFor returns where the proxy of abs (at its current mtime) lives
+func proxyPathFor(abs string) string {
+	rel, _ := filepath.Rel(DataDir, abs)
+	var mtime time.Time
+	if fi, err := os.Stat(abs); err == nil {
+		mtime = fi.ModTime()
+	}
+	return filepath.Join(DataDir, ".proxies", filepath.Dir(rel), fmt.Sprintf("%s.%s.mp4", filepath.Base(rel), thumbKey(mtime)))
+}
+
+// ---------------------- jobs ----------------------
+
+// proxy job states
+const (
+	proxyQueued    = "queued"
+	proxyRunning   = "running"
+	proxyDone      = "done"
+	proxyNotNeeded = "not_needed" // browsers play the original
+	proxyFailed    = "failed"
+	proxyCancelled = "cancelled"
+)
+
+// proxyJob is the state of one proxy, as reported by /api/proxies
+type proxyJob struct {
+	Path      string    `json:"path"`
+	State     string    `json:"state"`
+	Progress  float64   `json:"progress"`
+	Codec     string    `json:"codec,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	abs    string
+	key    string // thumbKey of the source mtime the job is for
+	cancel context.CancelFunc
+}
+
+// proxyJobs tracks proxies by source path. Finished entries are kept so
+// clients can see the outcome, and not_needed ones so FileHandler doesn't
+// probe the same file again; they go stale once the source is edited.
+var proxyJobs = struct {
+	sync.Mutex
+	m     map[string]*proxyJob
+	queue chan *proxyJob
+}{m: map[string]*proxyJob{}}
+
+// snapshot returns a copy of j safe to encode outside the lock
+func (j *proxyJob) snapshot() proxyJob {
+	proxyJobs.Lock()
+	defer proxyJobs.Unlock()
+	return *j
+}
+
+func (j *proxyJob) set(state string, progress float64, err error) {
+	proxyJobs.Lock()
+	j.State, j.Progress = state, progress
+	j.Error = ""
+	if err != nil {
+		j.Error = err.Error()
+	}
+	j.UpdatedAt = time.Now().UTC()
+	proxyJobs.Unlock()
+}
+
+// StartProxyWorker starts N goroutines encoding proxies queued by
+// EnqueueProxy. Encoding is heavy, so 1 is the sensible default.
+func StartProxyWorker(concurrency int) {
+	proxyJobs.Lock()
+	if proxyJobs.queue != nil {
+		proxyJobs.Unlock()
+		return
+	}
+	proxyJobs.queue = make(chan *proxyJob, 4096)
+	proxyJobs.Unlock()
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for j := range proxyJobs.queue {
+				runProxyJob(j)
+			}
+		}()
+	}
+}
+
+// errProxyQueueFull is returned by EnqueueProxy when the queue has no room;
+// the next StartProxySweep run picks the video up.
+var errProxyQueueFull = errors.New("proxy queue full")
+
+// EnqueueProxy queues abs for a proxy if it is a video that doesn't have a
+// current one and isn't queued or running already. force re-queues files
+// whose previous attempt failed or was cancelled; a finished job for an
+// earlier version of the source is always replaced. Returns the job, or an
+// error if abs is not a video, the worker isn't running or the queue is full.
+func EnqueueProxy(abs string, force bool) (*proxyJob, error) {
+	if !strings.HasPrefix(mimeTypeFor(abs), "video/") {
+		return nil, fmt.Errorf("not a video")
+	}
+	var key string
+	if fi, err := os.Stat(abs); err == nil {
+		key = thumbKey(fi.ModTime())
+	}
+	proxyJobs.Lock()
+	defer proxyJobs.Unlock()
+	if proxyJobs.queue == nil {
+		return nil, fmt.Errorf("proxy worker not running")
+	}
+	if j, ok := proxyJobs.m[abs]; ok {
+		switch {
+		case j.State == proxyQueued || j.State == proxyRunning:
+			return j, nil
+		case j.key != key:
+			// the source changed since; start over
+		case j.State == proxyDone:
+			// unless the proxy was removed since
+			if _, err := os.Stat(proxyPathFor(abs)); err == nil {
+				return j, nil
+			}
+		case j.State == proxyNotNeeded:
+			return j, nil
+		case !force:
+			return j, nil
+		}
+	}
+	j := &proxyJob{Path: relAPIPath(abs), State: proxyQueued, UpdatedAt: time.Now().UTC(), abs: abs, key: key}
+	select {
+	case proxyJobs.queue <- j:
+		proxyJobs.m[abs] = j
+	default:
+		return nil, errProxyQueueFull
+	}
+	return j, nil
+}
+
+func runProxyJob(j *proxyJob) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxyJobs.Lock()
+	if j.State != proxyQueued {
+		// cancelled while waiting in the queue
+		proxyJobs.Unlock()
+		return
+	}
+	j.State, j.cancel = proxyRunning, cancel
+	proxyJobs.Unlock()
+
+	info, err := proxyEncoder.ProbeCodecs(j.abs)
+	if err != nil {
+		j.set(proxyFailed, 0, err)
+		return
+	}
+	proxyJobs.Lock()
+	j.Codec = info.Video
+	proxyJobs.Unlock()
+	if info.webPlayable() {
+		j.set(proxyNotNeeded, 1, nil)
+		return
+	}
+	dst := proxyPathFor(j.abs)
+	if _, err := os.Stat(dst); err == nil {
+		j.set(proxyDone, 1, nil)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		j.set(proxyFailed, 0, err)
+		return
+	}
+	// encode under a hidden name, so a half-written proxy is never served
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	err = proxyEncoder.Encode(ctx, j.abs, tmp, info, func(p float64) {
+		if p > 1 {
+			p = 1
+		}
+		j.set(proxyRunning, p, nil)
+	})
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		if ctx.Err() != nil {
+			j.set(proxyCancelled, 0, nil)
+			return
+		}
+		log.Printf("proxy: %s: %v", j.abs, err)
+		j.set(proxyFailed, 0, err)
+		return
+	}
+	removeStaleProxies(j.abs, dst)
+	j.set(proxyDone, 1, nil)
+}
+
+// cancelProxy stops the queued or running job for abs
+func cancelProxy(abs string) (*proxyJob, bool) {
+	proxyJobs.Lock()
+	defer proxyJobs.Unlock()
+	j, ok := proxyJobs.m[abs]
+	if !ok || (j.State != proxyQueued && j.State != proxyRunning) {
+		return j, false
+	}
+	if j.cancel != nil {
+		j.cancel()
+	} else {
+		j.State = proxyCancelled
+		j.UpdatedAt = time.Now().UTC()
+	}
+	return j, true
+}
+
+// removeStaleProxies deletes proxies of earlier versions of abs
+func removeStaleProxies(abs, current string) {
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(current), globEscape(filepath.Base(abs))+".m*.mp4"))
+	for _, m := range matches {
+		if m != current {
+			_ = os.Remove(m)
+		}
+	}
+}
+
+// globEscape escapes glob metacharacters in a file name
+func globEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+	return r.Replace(s)
+}
+
+// storedWebPlayable reports from the codecs the metadata worker stored
+// whether browsers play a video as-is, so sweeps don't probe it again. The
+// pixel format isn't stored; a 10-bit H.264 file is found out when played.
+// Rows not extracted yet report false.
+func storedWebPlayable(mimeType, video, audio string) bool {
+	containers := map[string]string{
+		"video/mp4":       "mp4",
+		"video/x-m4v":     "mp4",
+		"video/quicktime": "mov,mp4",
+		"video/webm":      "webm",
+	}
+	if video == "" {
+		return false
+	}
+	return codecInfo{Format: containers[mimeType], Video: video, PixFmt: "yuv420p", Audio: audio}.webPlayable()
+}
+
+// ProxyCatalog queues every catalog video for a proxy and removes proxies
+// whose source was deleted or edited. Videos browsers play are skipped,
+// going by the codecs in the catalog, or else probed once per run.
+func ProxyCatalog() int {
+	root := filepath.Join(DataDir, ".proxies")
+	_ = filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			// encoder output; only remove leftovers of a crashed run
+			if fi, err := d.Info(); err == nil && time.Since(fi.ModTime()) > time.Hour {
+				_ = os.Remove(p)
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		name := strings.TrimSuffix(d.Name(), ".mp4")
+		i := strings.LastIndex(name, ".")
+		live := false
+		if i > 0 {
+			if fi, err := os.Stat(filepath.Join(DataDir, filepath.Dir(rel), name[:i])); err == nil {
+				live = thumbKey(fi.ModTime()) == name[i+1:]
+			}
+		}
+		if !live {
+			_ = os.Remove(p)
+		}
+		return nil
+	})
+	removeEmptyDirs(root)
+
+	rows, err := db.DB.Query(`SELECT filepath, mime, COALESCE(video_codec, ''), COALESCE(audio_codec, '')
+		FROM files WHERE mime LIKE 'video/%' AND canonical_id IS NULL`)
+	if err != nil {
+		log.Printf("ProxyCatalog: query: %v", err)
+		return 0
+	}
+	var paths []string
+	for rows.Next() {
+		var p, mt, video, audio string
+		if err := rows.Scan(&p, &mt, &video, &audio); err == nil && !storedWebPlayable(mt, video, audio) {
+			paths = append(paths, p)
+		}
+	}
+	rows.Close()
+	queued := 0
+	for _, p := range paths {
+		abs := catalogAbs(p)
+		if _, err := os.Stat(abs); err != nil {
+			continue
+		}
+		if _, err := os.Stat(proxyPathFor(abs)); err == nil {
+			continue
+		}
+		if j, err := EnqueueProxy(abs, false); err == nil && j.snapshot().State == proxyQueued {
+			queued++
+		}
+	}
+	log.Printf("ProxyCatalog: queued %d videos", queued)
+	return queued
+}
+
+// StartProxySweep runs ProxyCatalog every interval, picking up videos
+// dropped while the queue was full and collecting stale proxies; 0
+// disables it.
+func StartProxySweep(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			ProxyCatalog()
+		}
+	}()
+}
+
+// ---------------------- handlers ----------------------
+
+// serveWebVariant handles FileHandler's ?variant=web for abs: the proxy if
+// there is one, the original if browsers play it, else 503 with the job
+// state while the proxy is made. Returns false if abs is not a video (the
+// caller serves it normally).
+func serveWebVariant(w http.ResponseWriter, r *http.Request, abs string) bool {
+	if !strings.HasPrefix(mimeTypeFor(abs), "video/") {
+		return false
+	}
+	dst := proxyPathFor(abs)
+	if f, err := os.Open(dst); err == nil {
+		defer f.Close()
+		if fi, err := f.Stat(); err == nil {
+			w.Header().Set("Content-Type", "video/mp4")
+			// http.ServeContent handles Range requests for seeking
+			http.ServeContent(w, r, filepath.Base(dst), fi.ModTime(), f)
+			return true
+		}
+	}
+	// failed and cancelled jobs are only retried on POST /api/proxies, so
+	// players polling a broken file don't re-encode it forever
+	j, err := EnqueueProxy(abs, false)
+	if err != nil {
+		if err == errProxyQueueFull {
+			w.Header().Set("Retry-After", "60")
+		}
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	snap := j.snapshot()
+	switch snap.State {
+	case proxyNotNeeded:
+		return false
+	case proxyFailed:
+		http.Error(w, "proxy failed: "+snap.Error, http.StatusUnsupportedMediaType)
+		return true
+	case proxyQueued, proxyRunning:
+		w.Header().Set("Retry-After", "10")
+	}
+	writeAlbumJSON(w, http.StatusServiceUnavailable, snap)
+	return true
+}
+
+// ProxiesHandler lists proxy jobs (GET), queues a video (POST, also retries a
+// failed or cancelled one) or cancels a queued/running one (DELETE).
+// GET    /api/proxies
+// POST   /api/proxies?path=/clip.mov
+// DELETE /api/proxies?path=/clip.mov
+func ProxiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		proxyJobs.Lock()
+		jobs := make([]proxyJob, 0, len(proxyJobs.m))
+		for _, j := range proxyJobs.m {
+			jobs = append(jobs, *j)
+		}
+		proxyJobs.Unlock()
+		sort.Slice(jobs, func(a, b int) bool { return jobs[a].UpdatedAt.After(jobs[b].UpdatedAt) })
+		writeAlbumJSON(w, http.StatusOK, map[string]interface{}{"jobs": jobs})
+		return
+	}
+
+	q := r.URL.Query().Get("path")
+	abs, err := absClean(DataDir, q)
+	if q == "" || err != nil || shouldIgnoreFile(filepath.Base(q)) {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	abs = resolveFile(abs)
+	if r.Method == http.MethodDelete {
+		j, ok := cancelProxy(abs)
+		if !ok {
+			http.Error(w, "no queued or running proxy for "+q, http.StatusNotFound)
+			return
+		}
+		writeAlbumJSON(w, http.StatusOK, j.snapshot())
+		return
+	}
+	if _, err := os.Stat(abs); err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if !strings.HasPrefix(mimeTypeFor(abs), "video/") {
+		http.Error(w, "not a video", http.StatusBadRequest)
+		return
+	}
+	j, err := EnqueueProxy(abs, true)
+	if err != nil {
+		if err == errProxyQueueFull {
+			w.Header().Set("Retry-After", "60")
+		}
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeAlbumJSON(w, http.StatusAccepted, j.snapshot())
+}
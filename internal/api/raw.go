@@ -0,0 +1,350 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+
+	"localcloud/internal/db"
+)
+
+func init() {
+	_ = mime.AddExtensionType(".dng", "image/x-adobe-dng")
+	_ = mime.AddExtensionType(".cr2", "image/x-canon-cr2")
+	_ = mime.AddExtensionType(".nef", "image/x-nikon-nef")
+	_ = mime.AddExtensionType(".arw", "image/x-sony-arw")
+}
+
+// rawExts are the TIFF-based RAW containers we can read previews from
+var rawExts = []string{".dng", ".cr2", ".nef", ".arw"}
+
+// isRawExt reports whether ext (lowercase, with dot) is a supported RAW format
+func isRawExt(ext string) bool {
+	for _, e := range rawExts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------- TIFF IFD walking ----------------------
+
+const (
+	tagCompression     = 0x0103
+	tagPhotometric     = 0x0106
+	tagOrientation     = 0x0112
+	tagStripOffsets    = 0x0111
+	tagStripByteCounts = 0x0117
+	tagSubIFDs         = 0x014A
+	tagJPEGOffset      = 0x0201
+	tagJPEGLength      = 0x0202
+)
+
+// photometric values used by the sensor data itself (never a preview)
+const (
+	photometricCFA       = 32803
+	photometricLinearRaw = 34892
+)
+
+// maxIFDs bounds the walk so a corrupt file can't loop forever
+const maxIFDs = 64
+
+type tiffReader struct {
+	r           io.ReaderAt
+	order       binary.ByteOrder
+	seen        map[uint32]bool
+	orientation int // from IFD0
+}
+
+// ifd reads the SHORT/LONG values of every entry in the IFD at off and
+// returns them with the offset of the next IFD.
+func (t *tiffReader) ifd(off uint32) (map[uint16][]uint32, uint32, error) {
+	var n [2]byte
+	if _, err := t.r.ReadAt(n[:], int64(off)); err != nil {
+		return nil, 0, err
+	}
+	count := int(t.order.Uint16(n[:]))
+	buf := make([]byte, count*12+4)
+	if _, err := t.r.ReadAt(buf, int64(off)+2); err != nil {
+		return nil, 0, err
+	}
+	tags := map[uint16][]uint32{}
+	for i := 0; i < count; i++ {
+		e := buf[i*12 : i*12+12]
+		tag := t.order.Uint16(e[0:2])
+		typ := t.order.Uint16(e[2:4])
+		cnt := t.order.Uint32(e[4:8])
+		var size uint32
+		switch typ {
+		case 3: // SHORT
+			size = 2
+		case 4, 13: // LONG, IFD
+			size = 4
+		default:
+			continue
+		}
+		if cnt == 0 || cnt > 1024 {
+			continue
+		}
+		data := e[8:12]
+		if size*cnt > 4 {
+			data = make([]byte, size*cnt)
+			if _, err := t.r.ReadAt(data, int64(t.order.Uint32(e[8:12]))); err != nil {
+				continue
+			}
+		}
+		vals := make([]uint32, cnt)
+		for j := range vals {
+			if size == 2 {
+				vals[j] = uint32(t.order.Uint16(data[j*2:]))
+			} else {
+				vals[j] = t.order.Uint32(data[j*4:])
+			}
+		}
+		tags[tag] = vals
+	}
+	return tags, t.order.Uint32(buf[count*12:]), nil
+}
+
+// jpegCandidate is an embedded JPEG stream found in a RAW file
+type jpegCandidate struct {
+	off, size int64
+}
+
+// walk collects JPEG streams from the IFD chain starting at off and its SubIFDs
+func (t *tiffReader) walk(off uint32, out *[]jpegCandidate) {
+	for off != 0 && len(t.seen) < maxIFDs && !t.seen[off] {
+		t.seen[off] = true
+		tags, next, err := t.ifd(off)
+		if err != nil {
+			return
+		}
+		first := func(tag uint16) uint32 {
+			if v := tags[tag]; len(v) > 0 {
+				return v[0]
+			}
+			return 0
+		}
+		if len(t.seen) == 1 {
+			t.orientation = int(first(tagOrientation))
+		}
+		if o, l := first(tagJPEGOffset), first(tagJPEGLength); o != 0 && l != 0 {
+			*out = append(*out, jpegCandidate{int64(o), int64(l)})
+		}
+		// single-strip JPEG-compressed images (DNG/NEF previews, CR2 IFD0)
+		if c := first(tagCompression); c == 6 || c == 7 {
+			p := first(tagPhotometric)
+			so, sc := tags[tagStripOffsets], tags[tagStripByteCounts]
+			if p != photometricCFA && p != photometricLinearRaw && len(so) == 1 && len(sc) == 1 {
+				*out = append(*out, jpegCandidate{int64(so[0]), int64(sc[0])})
+			}
+		}
+		for _, sub := range tags[tagSubIFDs] {
+			t.walk(sub, out)
+		}
+		off = next
+	}
+}
+
+// rawPreviewCandidates lists the embedded JPEGs of a TIFF-based RAW file,
+// largest first, and the EXIF orientation the previews should be shown with.
+func rawPreviewCandidates(r io.ReaderAt) ([]jpegCandidate, int, error) {
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return nil, 0, err
+	}
+	t := &tiffReader{r: r, seen: map[uint32]bool{}}
+	switch string(hdr[0:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("raw: not a TIFF container")
+	}
+	if t.order.Uint16(hdr[2:4]) != 42 {
+		return nil, 0, fmt.Errorf("raw: unsupported TIFF variant")
+	}
+	var out []jpegCandidate
+	t.walk(t.order.Uint32(hdr[4:8]), &out)
+	sort.Slice(out, func(i, j int) bool { return out[i].size > out[j].size })
+	return out, t.orientation, nil
+}
+
+// rawPreview returns the largest embedded JPEG preview that Go can decode
+// (lossless-JPEG sensor data looks like a JPEG but isn't baseline). Previews
+// are stored unrotated; orientation comes from IFD0.
+func rawPreview(abs string) ([]byte, int, error) {
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	cands, orientation, err := rawPreviewCandidates(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, c := range cands {
+		if c.size < 2 || c.size > 64<<20 {
+			continue
+		}
+		sec := io.NewSectionReader(f, c.off, c.size)
+		if _, err := jpeg.DecodeConfig(sec); err != nil {
+			continue
+		}
+		buf := make([]byte, c.size)
+		if _, err := f.ReadAt(buf, c.off); err != nil {
+			continue
+		}
+		return buf, orientation, nil
+	}
+	return nil, 0, fmt.Errorf("raw: no embedded JPEG preview in %s", filepath.Base(abs))
+}
+
+// decodeRaw decodes the embedded preview of a RAW file, upright
+func decodeRaw(abs string) (image.Image, error) {
+	buf, orientation, err := rawPreview(abs)
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	return applyOrientation(img, orientation), nil
+}
+
+// convertRaw writes the embedded preview of src to dst, re-encoding only when
+// it has to be rotated
+func convertRaw(src, dst string) error {
+	buf, orientation, err := rawPreview(src)
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp.jpg"
+	defer os.Remove(tmp)
+	if orientation > 1 {
+		img, err := jpeg.Decode(bytes.NewReader(buf))
+		if err != nil {
+			return err
+		}
+		err = imaging.Save(applyOrientation(img, orientation), tmp, imaging.JPEGQuality(92))
+		if err != nil {
+			return err
+		}
+	} else if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// ---------------------- RAW+JPEG pairing ----------------------
+
+// pairKey groups files that are the same shot: same directory, same
+// case-insensitive name without extension.
+func pairKey(p string) string {
+	return strings.ToLower(strings.TrimSuffix(p, path.Ext(p)))
+}
+
+func isPairJPEG(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+// rawSibling returns the RAW file shot together with the JPEG abs (same
+// directory and stem), or "" if abs isn't a JPEG or has none.
+func rawSibling(abs string) string {
+	if !isPairJPEG(abs) {
+		return ""
+	}
+	stem := strings.TrimSuffix(abs, filepath.Ext(abs))
+	for _, e := range rawExts {
+		for _, ext := range []string{e, strings.ToUpper(e)} {
+			if fileExists(stem + ext) {
+				return stem + ext
+			}
+		}
+	}
+	return ""
+}
+
+// rawPairedSQL is true for a RAW row whose JPEG sibling (same directory and
+// case-insensitive stem) is in the catalog too. Listings page with
+// "NOT rawPairedSQL" so a pair counts as one asset, then pairRawJPEG hangs the
+// RAW off the JPEG. Every entry of rawExts is four characters long.
+var rawPairedSQL = func() string {
+	exts := make([]string, len(rawExts))
+	for i, e := range rawExts {
+		exts[i] = "'" + e + "'"
+	}
+	stem := "lower(substr(files.filepath, 1, length(files.filepath) - 4))"
+	return "(lower(substr(files.filepath, -4)) IN (" + strings.Join(exts, ", ") + `) AND EXISTS (
+		SELECT 1 FROM files j WHERE lower(j.filepath) IN (` + stem + " || '.jpg', " + stem + ` || '.jpeg')
+		AND j.canonical_id IS NULL))`
+}()
+
+// pairRawJPEG adds a "raw" field to the JPEG items of a grid/search page that
+// have a RAW sibling; the query hid the RAW itself with rawPairedSQL.
+func pairRawJPEG(items []map[string]interface{}) []map[string]interface{} {
+	jpegs := map[string]map[string]interface{}{}
+	var keys []interface{}
+	for _, it := range items {
+		p, _ := it["path"].(string)
+		if it["type"] != "file" || !isPairJPEG(p) {
+			continue
+		}
+		jpegs[pairKey(p)] = it
+		for _, e := range rawExts {
+			for _, k := range catalogKeys(catalogAbs(strings.TrimSuffix(p, path.Ext(p)) + e)) {
+				keys = append(keys, strings.ToLower(k))
+			}
+		}
+	}
+	if len(jpegs) == 0 {
+		return items
+	}
+	rows, err := db.DB.Query(`SELECT filename, filepath, mime, size FROM files
+		WHERE lower(filepath) IN (?`+strings.Repeat(", ?", len(keys)-1)+`)`, keys...)
+	if err != nil {
+		log.Printf("raw pairing: %v", err)
+		return items
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, fp string
+		var mt sql.NullString
+		var size sql.NullInt64
+		if err := rows.Scan(&name, &fp, &mt, &size); err != nil {
+			continue
+		}
+		p := relAPIPath(catalogAbs(fp))
+		if j, ok := jpegs[pairKey(p)]; ok {
+			j["raw"] = rawRef(map[string]interface{}{"name": name, "path": p, "mime": mt.String, "size": size.Int64})
+		}
+	}
+	return items
+}
+
+func rawRef(it map[string]interface{}) map[string]interface{} {
+	ref := map[string]interface{}{}
+	for _, k := range []string{"name", "path", "mime", "size"} {
+		if v, ok := it[k]; ok {
+			ref[k] = v
+		}
+	}
+	return ref
+}
@@ -18,16 +18,84 @@ func RegisterRoutes(r *mux.Router, dataDir string) {
 	// filesystem browsing & file serving
 	r.HandleFunc("/api/tree", TreeHandler).Methods("GET")
 	r.HandleFunc("/api/file", FileHandler).Methods("GET")
+	r.HandleFunc("/api/convert", ConvertHandler).Methods("GET")
 
 	// thumbnails, metadata, grid view
 	r.HandleFunc("/api/thumbnail", ThumbnailHandler).Methods("GET")
 	r.HandleFunc("/api/metadata", MetadataHandler).Methods("GET")
 	r.HandleFunc("/api/grid", GridHandler).Methods("GET")
+	r.HandleFunc("/api/map", MapHandler).Methods("GET")
+	r.HandleFunc("/api/timeline", TimelineHandler).Methods("GET")
+	r.HandleFunc("/api/timeline/counts", TimelineCountsHandler).Methods("GET")
+	r.HandleFunc("/api/timeline/bucket", TimelineBucketHandler).Methods("GET")
+	r.HandleFunc("/api/memories", MemoriesHandler).Methods("GET")
+	r.HandleFunc("/api/thumbnails/cache", ThumbCacheHandler).Methods("GET", "POST")
+
+	// albums (curated collections across folders)
+	r.HandleFunc("/api/albums", AlbumsHandler).Methods("GET", "POST")
+	r.HandleFunc("/api/albums/{id}", AlbumHandler).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/api/albums/{id}/items", AlbumItemsHandler).Methods("POST", "DELETE")
+	r.HandleFunc("/api/albums/{id}/order", AlbumOrderHandler).Methods("PUT")
+	r.HandleFunc("/api/albums/{id}/zip", AlbumZipHandler).Methods("GET")
+
+	// smart albums (saved queries evaluated on demand)
+	r.HandleFunc("/api/smart-albums", SmartAlbumsHandler).Methods("GET", "POST")
+	r.HandleFunc("/api/smart-albums/events", SmartAlbumEventsHandler).Methods("GET")
+	r.HandleFunc("/api/smart-albums/{id}", SmartAlbumHandler).Methods("GET", "PUT", "DELETE")
+
+	// tags, favorites and ratings
+	r.HandleFunc("/api/tags", TagsHandler).Methods("GET")
+	r.HandleFunc("/api/tags/apply", TagsApplyHandler).Methods("POST")
+	r.HandleFunc("/api/favorites", FavoritesHandler).Methods("POST")
+	r.HandleFunc("/api/rating", RatingHandler).Methods("POST")
+	r.HandleFunc("/api/describe", DescribeHandler).Methods("POST")
+	r.HandleFunc("/api/xmp/sync", SidecarSyncHandler).Methods("POST")
+
+	// HLS streaming (on-demand transcodes, cached)
+	r.HandleFunc("/api/stream/cache", StreamCacheHandler).Methods("GET")
+	r.HandleFunc("/api/stream/{id}/master.m3u8", StreamMasterHandler).Methods("GET")
+	r.HandleFunc("/api/stream/{id}/{rendition}/{file}", StreamFileHandler).Methods("GET")
+
+	// video storyboards (hover scrubbing, seek-bar thumbnails) and preview clips
+	r.HandleFunc("/api/video/storyboard.vtt", VideoStoryboardHandler).Methods("GET")
+	r.HandleFunc("/api/video/sprite", VideoSpriteHandler).Methods("GET")
+	r.HandleFunc("/api/video/preview", VideoPreviewHandler).Methods("GET")
+
+	// subtitles (sidecar files and embedded text streams) as WebVTT
+	r.HandleFunc("/api/subtitles", SubtitlesHandler).Methods("GET")
+	r.HandleFunc("/api/subtitles/vtt", SubtitleVTTHandler).Methods("GET")
+
+	// music library (artist/album browsing over ID3/Vorbis/iTunes tags)
+	r.HandleFunc("/api/music/artists", MusicArtistsHandler).Methods("GET")
+	r.HandleFunc("/api/music/albums", MusicAlbumsHandler).Methods("GET")
+	r.HandleFunc("/api/music/album", MusicAlbumHandler).Methods("GET")
+
+	// Subsonic-compatible API for music apps (authenticates by token/salt)
+	for method, h := range subsonicMethods {
+		r.HandleFunc("/rest/"+method, subsonicAuth(h)).Methods("GET", "POST")
+		r.HandleFunc("/rest/"+method+".view", subsonicAuth(h)).Methods("GET", "POST")
+	}
+
+	// web-playable MP4 proxies of videos, made in the background
+	r.HandleFunc("/api/proxies", ProxiesHandler).Methods("GET", "POST", "DELETE")
 
 	// sync & backup
 	r.HandleFunc("/api/sync/upload", SyncUploadHandler).Methods("POST")
 	r.HandleFunc("/api/sync/status", SyncStatusHandler).Methods("GET")
 
+	// library-wide deduplication
+	r.HandleFunc("/api/duplicates", DuplicatesHandler).Methods("GET")
+	r.HandleFunc("/api/duplicates/resolve", DuplicatesResolveHandler).Methods("POST")
+	r.HandleFunc("/api/similar", SimilarHandler).Methods("GET")
+
+	// integrity scrubbing & repair
+	r.HandleFunc("/api/integrity", IntegrityHandler).Methods("GET")
+	r.HandleFunc("/api/integrity/scrub", IntegrityScrubHandler).Methods("POST")
+	r.HandleFunc("/api/integrity/repair", IntegrityRepairHandler).Methods("POST")
+
+	// catalog vs. disk consistency
+	r.HandleFunc("/api/fsck", FsckHandler).Methods("GET", "POST")
+
 	// search
 	r.HandleFunc("/api/search", SearchHandler).Methods("GET")
 
@@ -6,7 +6,6 @@ import (
 	"log"
 	"mime"
 	"net/http"
-	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -15,6 +14,8 @@ import (
 )
 
 // SearchHandler is a robust LIKE-based search that always returns JSON.
+// Tags match too; query=tag:<name> returns only assets with that exact tag,
+// and other filter queries (codec:hevc duration:>60) work as in smart albums.
 // GET /api/search?query=pan&limit=100&offset=0
 func SearchHandler(w http.ResponseWriter, r *http.Request) {
 	// ensure we always return JSON
@@ -37,7 +38,7 @@ func SearchHandler(w http.ResponseWriter, r *http.Request) {
 	// if empty query -> return recent items (files ordered by uploaded_at desc)
 	if q == "" {
 		rows, err := db.DB.Query(`SELECT id, filename, filepath, mime, uploaded_at, exif_datetime, camera_model
-			FROM files ORDER BY uploaded_at DESC LIMIT ? OFFSET ?`, limit, offset)
+			FROM files WHERE NOT `+rawPairedSQL+` ORDER BY uploaded_at DESC LIMIT ? OFFSET ?`, limit, offset)
 		if err != nil {
 			log.Printf("SearchHandler recent db query error: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -45,24 +46,64 @@ func SearchHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		defer rows.Close()
-		items := scanMediaRows(rows)
+		items := pairRawJPEG(scanMediaRows(rows))
 		_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "offset": offset, "limit": limit})
 		return
 	}
 
+	// "tag:passport" matches that tag exactly
+	if t, ok := strings.CutPrefix(q, "tag:"); ok {
+		rows, err := db.DB.Query(`SELECT id, filename, filepath, mime, uploaded_at, exif_datetime, camera_model
+			FROM files WHERE id IN (SELECT ft.file_id FROM file_tags ft JOIN tags t ON t.id = ft.tag_id WHERE t.name = ?)
+			AND NOT `+rawPairedSQL+` ORDER BY uploaded_at DESC LIMIT ? OFFSET ?`, normalizeTag(t), limit, offset)
+		if err != nil {
+			log.Printf("SearchHandler tag query error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": "internal db error"})
+			return
+		}
+		defer rows.Close()
+		items := pairRawJPEG(scanMediaRows(rows))
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "offset": offset, "limit": limit})
+		return
+	}
+
+	// filter queries ("codec:hevc duration:>60 taken:2023") use the smart
+	// album syntax; anything that doesn't compile as one is searched as text
+	if strings.Contains(q, ":") {
+		if sq, err := parseSmartQuery(q); err == nil {
+			rows, err := db.DB.Query(`SELECT id, filename, filepath, mime, uploaded_at, exif_datetime, camera_model
+				FROM files WHERE `+sq.where+` ORDER BY `+takenExpr+` DESC, id DESC LIMIT ? OFFSET ?`,
+				append(sq.args, limit, offset)...)
+			if err != nil {
+				log.Printf("SearchHandler filter query error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": "internal db error"})
+				return
+			}
+			defer rows.Close()
+			items := pairRawJPEG(scanMediaRows(rows))
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "offset": offset, "limit": limit})
+			return
+		}
+	}
+
 	// Build LIKE pattern
 	pat := "%" + q + "%"
 
-	// Parameterized query searching filename, camera_model, filepath (case-insensitive)
+	// Parameterized query searching filename, camera_model, filepath, place, tags (case-insensitive)
 	qry := `
 	SELECT id, filename, filepath, mime, uploaded_at, exif_datetime, camera_model
 	FROM files
-	WHERE LOWER(filename) LIKE LOWER(?) OR LOWER(camera_model) LIKE LOWER(?) OR LOWER(filepath) LIKE LOWER(?)
+	WHERE (LOWER(filename) LIKE LOWER(?) OR LOWER(camera_model) LIKE LOWER(?) OR LOWER(filepath) LIKE LOWER(?)
+		OR LOWER(place) LIKE LOWER(?)
+		OR id IN (SELECT ft.file_id FROM file_tags ft JOIN tags t ON t.id = ft.tag_id WHERE LOWER(t.name) LIKE LOWER(?)))
+		AND NOT ` + rawPairedSQL + `
 	ORDER BY uploaded_at DESC
 	LIMIT ? OFFSET ?;
 	`
 
-	rows, err := db.DB.Query(qry, pat, pat, pat, limit, offset)
+	rows, err := db.DB.Query(qry, pat, pat, pat, pat, pat, limit, offset)
 	if err != nil {
 		log.Printf("SearchHandler db query error: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -71,7 +112,7 @@ func SearchHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
-	items := scanMediaRows(rows)
+	items := pairRawJPEG(scanMediaRows(rows))
 	_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "offset": offset, "limit": limit})
 }
 
@@ -93,7 +134,7 @@ func scanMediaRows(rows *sql.Rows) []map[string]interface{} {
 			log.Printf("scanMediaRows: row scan error: %v", err)
 			continue
 		}
-		itemPath := relAPIPath(filepathS)
+		itemPath := relAPIPath(catalogAbs(filepathS))
 		mt := mimeS.String
 		if mt == "" {
 			ext := strings.ToLower(filepath.Ext(filename))
@@ -109,13 +150,19 @@ func scanMediaRows(rows *sql.Rows) []map[string]interface{} {
 			"mime":       mt,
 			"modified":   uploaded.String,
 			"uploadedAt": uploaded.String,
-			"thumb":      "/api/thumbnail?path=" + url.QueryEscape(itemPath) + "&w=360",
+			"thumb":      thumbURL(itemPath, defaultRendition),
+			"srcset":     thumbSrcset(itemPath),
 			"type":       "file",
 			"exif": map[string]interface{}{
 				"datetime":    exifDT.String,
 				"cameraModel": camera.String,
 			},
 		}
+		if strings.HasPrefix(mt, "video/") {
+			item["stream"] = streamURL(id)
+			item["storyboard"] = storyboardURL(itemPath)
+			item["preview"] = previewURL(itemPath)
+		}
 		out = append(out, item)
 	}
 	return out
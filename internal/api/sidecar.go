@@ -0,0 +1,378 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"localcloud/internal/db"
+)
+
+// XMPWrite enables writing catalog tags/rating/title/description back to
+// .xmp sidecars. Off (the default), sidecars are only read.
+var XMPWrite = false
+
+// isSidecar reports whether name is an XMP sidecar; listings hide them since
+// they describe the file next to them rather than being assets themselves.
+func isSidecar(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".xmp")
+}
+
+// sidecarPath returns the sidecar of abs: an existing one in either naming
+// (darktable "IMG_1.CR2.xmp", Lightroom "IMG_1.xmp"), else the darktable
+// name, which can't clash between a RAW and its JPEG. In a RAW+JPEG pair
+// "IMG_1.xmp" is the RAW's, so the JPEG never adopts it.
+func sidecarPath(abs string) (string, bool) {
+	paths := []string{abs + ".xmp"}
+	if rawSibling(abs) == "" {
+		paths = append(paths, strings.TrimSuffix(abs, filepath.Ext(abs))+".xmp")
+	}
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p, true
+		}
+	}
+	return abs + ".xmp", false
+}
+
+// emptyXMP is the packet new sidecars start from
+const emptyXMP = `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="localcloud">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:xmp="` + nsXMP + `"
+    xmlns:dc="` + nsDC + `">
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+
+var (
+	// first rdf:Description start tag; group 1 is "/" when self-closing
+	xmpDescription = regexp.MustCompile(`<rdf:Description\b[^>]*?(/?)>`)
+	// properties we own, as attributes of rdf:Description ...
+	xmpOwnedAttr = regexp.MustCompile(`\s+(?:xmp:Rating|dc:title|dc:description)="[^"]*"`)
+	// ... or as elements (these never nest in one another)
+	xmpOwnedElem = regexp.MustCompile(`(?s)\s*<(?:xmp:Rating|dc:subject|dc:title|dc:description)\b[^>]*?(?:/>|>.*?</(?:xmp:Rating|dc:subject|dc:title|dc:description)>)`)
+)
+
+// xmpEscape escapes s for XML character data
+func xmpEscape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xmpProps renders m as rdf:Description child elements
+func xmpProps(m xmpMeta) string {
+	const ind = "\n   "
+	var b strings.Builder
+	if m.Rating > 0 {
+		fmt.Fprintf(&b, "%s<xmp:Rating>%d</xmp:Rating>", ind, m.Rating)
+	}
+	alt := func(name, v string) {
+		if v != "" {
+			fmt.Fprintf(&b, `%s<dc:%s><rdf:Alt><rdf:li xml:lang="x-default">%s</rdf:li></rdf:Alt></dc:%s>`, ind, name, xmpEscape(v), name)
+		}
+	}
+	alt("title", m.Title)
+	alt("description", m.Description)
+	if len(m.Keywords) > 0 {
+		b.WriteString(ind + "<dc:subject><rdf:Bag>")
+		for _, k := range m.Keywords {
+			b.WriteString("<rdf:li>" + xmpEscape(k) + "</rdf:li>")
+		}
+		b.WriteString("</rdf:Bag></dc:subject>")
+	}
+	return b.String()
+}
+
+// mergeXMP replaces the properties we own in packet with m, leaving everything
+// else (develop settings, history, other namespaces) byte-for-byte intact.
+// The standard xmp:/dc: prefixes are assumed, as every editor writes them.
+func mergeXMP(packet []byte, m xmpMeta) ([]byte, error) {
+	s := xmpOwnedElem.ReplaceAllString(string(packet), "")
+	s = xmpOwnedAttr.ReplaceAllString(s, "")
+	loc := xmpDescription.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return nil, fmt.Errorf("no rdf:Description")
+	}
+	tag := s[loc[0]:loc[1]]
+	selfClosing := loc[3] > loc[2]
+	open := strings.TrimSuffix(strings.TrimSuffix(tag, ">"), "/")
+	// declaring a prefix again on the element is legal; twice on it is not
+	for prefix, ns := range map[string]string{"xmp": nsXMP, "dc": nsDC} {
+		if !strings.Contains(open, "xmlns:"+prefix+"=") {
+			open += fmt.Sprintf(` xmlns:%s="%s"`, prefix, ns)
+		}
+	}
+	body := open + ">" + xmpProps(m)
+	if selfClosing {
+		body += "\n  </rdf:Description>"
+	}
+	out := s[:loc[0]] + body + s[loc[1]:]
+	if _, err := parseXMP([]byte(out)); err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+// writeSidecar writes the catalog's tags, rating, title and description of
+// fid into its sidecar and records the sidecar's mtime so the next sync
+// doesn't import our own write back.
+func writeSidecar(fid int64) error {
+	var (
+		p, title, desc string
+		rating         int
+	)
+	err := db.DB.QueryRow(`SELECT filepath, COALESCE(rating, 0), COALESCE(title, ''), COALESCE(description, '')
+		FROM files WHERE id = ?`, fid).Scan(&p, &rating, &title, &desc)
+	if err != nil {
+		return err
+	}
+	abs := catalogAbs(p)
+	if _, err := os.Stat(abs); err != nil {
+		return nil
+	}
+	m := xmpMeta{Rating: rating, Title: title, Description: desc, Keywords: fileTags(fid)}
+
+	side, exists := sidecarPath(abs)
+	packet := []byte(emptyXMP)
+	if exists {
+		if packet, err = os.ReadFile(side); err != nil {
+			return err
+		}
+	} else if m.Rating == 0 && m.Title == "" && m.Description == "" && len(m.Keywords) == 0 {
+		// nothing to say; don't litter the folder
+		return nil
+	}
+	out, err := mergeXMP(packet, m)
+	if err != nil {
+		return fmt.Errorf("%s: %w", side, err)
+	}
+	// write next to the target and rename so editors never see half a file
+	tmp := filepath.Join(filepath.Dir(side), fmt.Sprintf(".%s.%d.tmp", filepath.Base(side), time.Now().UnixNano()))
+	if err := os.WriteFile(tmp, out, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, side); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	fi, err := os.Stat(side)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.Exec("UPDATE files SET xmp_mtime = ? WHERE id = ?", fi.ModTime().UnixNano(), fid)
+	return err
+}
+
+// writeSidecars writes the sidecars of ids, logging failures
+func writeSidecars(ids []int64) {
+	if !XMPWrite {
+		return
+	}
+	for _, id := range ids {
+		if err := writeSidecar(id); err != nil {
+			log.Printf("xmp: write sidecar for file %d: %v", id, err)
+		}
+	}
+}
+
+// importSidecar makes the catalog row fid match the sidecar side: rating,
+// title and description are replaced, and the sidecar keywords become the
+// complete tag set. With merge (the sidecar was never synced, so neither side
+// is known to be newer) nothing is lost instead: the tags are united and
+// only empty catalog values are filled in from the sidecar.
+// Without XMPWrite the catalog is never written back, so its edits would be
+// lost on every import: it always merges, and only tags that came from XMP
+// follow the sidecar.
+func importSidecar(fid int64, side string, mtime int64, merge bool) error {
+	data, err := os.ReadFile(side)
+	if err != nil {
+		return err
+	}
+	m, err := parseXMP(data)
+	if err != nil {
+		return err
+	}
+	if !XMPWrite {
+		merge = true
+	}
+	set := "rating = ?, title = ?, description = ?"
+	if merge {
+		set = "rating = COALESCE(NULLIF(rating, 0), ?), title = COALESCE(NULLIF(title, ''), ?), description = COALESCE(NULLIF(description, ''), ?)"
+	}
+	if merge && XMPWrite {
+		seen := map[string]bool{}
+		var union []string
+		for _, k := range append(fileTags(fid), m.Keywords...) {
+			if n := normalizeTag(k); n != "" && !seen[n] {
+				seen[n] = true
+				union = append(union, k)
+			}
+		}
+		m.Keywords = union
+	}
+	var keywords interface{}
+	if len(m.Keywords) > 0 {
+		b, _ := json.Marshal(m.Keywords)
+		keywords = string(b)
+	}
+	_, err = db.DB.Exec("UPDATE files SET "+set+", keywords = ?, xmp_mtime = ? WHERE id = ?",
+		nullNum(float64(m.Rating)), nullStr(m.Title), nullStr(m.Description), keywords, mtime, fid)
+	if err != nil {
+		return err
+	}
+	return syncFileTags(fid, m.Keywords, XMPWrite)
+}
+
+// SyncSidecars imports every sidecar that changed on disk since it was last
+// imported or written (e.g. edited in Lightroom or darktable). Returns the
+// number imported.
+func SyncSidecars() int {
+	rows, err := db.DB.Query("SELECT id, filepath, COALESCE(xmp_mtime, 0) FROM files WHERE canonical_id IS NULL")
+	if err != nil {
+		log.Printf("SyncSidecars: query: %v", err)
+		return 0
+	}
+	type row struct {
+		id    int64
+		path  string
+		mtime int64
+	}
+	var all []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.path, &r.mtime); err == nil {
+			all = append(all, r)
+		}
+	}
+	rows.Close()
+
+	imported := 0
+	for _, r := range all {
+		side, exists := sidecarPath(catalogAbs(r.path))
+		if !exists {
+			if r.mtime != 0 {
+				// sidecar deleted: keep the catalog values, forget the sync point
+				_, _ = db.DB.Exec("UPDATE files SET xmp_mtime = NULL WHERE id = ?", r.id)
+			}
+			continue
+		}
+		fi, err := os.Stat(side)
+		if err != nil || fi.ModTime().UnixNano() == r.mtime {
+			continue
+		}
+		merge := r.mtime == 0
+		if err := importSidecar(r.id, side, fi.ModTime().UnixNano(), merge); err != nil {
+			log.Printf("xmp: import %s: %v", side, err)
+			continue
+		}
+		if merge {
+			// the catalog may now know more than the sidecar
+			writeSidecars([]int64{r.id})
+		}
+		imported++
+	}
+	if imported > 0 {
+		pruneTags()
+		log.Printf("SyncSidecars: imported %d sidecars", imported)
+	}
+	return imported
+}
+
+// StartSidecarSync runs SyncSidecars every interval; 0 disables it.
+func StartSidecarSync(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			SyncSidecars()
+		}
+	}()
+}
+
+// SidecarSyncHandler imports changed sidecars now (POST), or with
+// ?write=1 rewrites the sidecars of every asset that has tags, a rating,
+// a title or a description.
+// POST /api/xmp/sync?write=1
+func SidecarSyncHandler(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]interface{}{"imported": SyncSidecars()}
+	if r.URL.Query().Get("write") == "1" {
+		if !XMPWrite {
+			http.Error(w, "sidecar writing is disabled", http.StatusConflict)
+			return
+		}
+		rows, err := db.DB.Query(`SELECT id FROM files WHERE canonical_id IS NULL AND (rating > 0
+			OR COALESCE(title, '') != '' OR COALESCE(description, '') != ''
+			OR id IN (SELECT file_id FROM file_tags))`)
+		if err != nil {
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+		writeSidecars(ids)
+		resp["written"] = len(ids)
+	}
+	writeAlbumJSON(w, http.StatusOK, resp)
+}
+
+// describeRequest is the body of DescribeHandler; nil fields are left alone
+type describeRequest struct {
+	Paths       []string `json:"paths"`
+	Title       *string  `json:"title"`
+	Description *string  `json:"description"`
+}
+
+// DescribeHandler sets the title and/or description of many assets; "" clears.
+// POST /api/describe  {"paths":["/a.jpg"],"title":"Passport photo","description":"2024 renewal"}
+func DescribeHandler(w http.ResponseWriter, r *http.Request) {
+	var req describeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Title == nil && req.Description == nil {
+		http.Error(w, "title or description required", http.StatusBadRequest)
+		return
+	}
+	var sets []string
+	var args []interface{}
+	if req.Title != nil {
+		sets = append(sets, "title = ?")
+		args = append(args, nullStr(strings.TrimSpace(*req.Title)))
+	}
+	if req.Description != nil {
+		sets = append(sets, "description = ?")
+		args = append(args, nullStr(strings.TrimSpace(*req.Description)))
+	}
+	bulkApply(w, bulkRequest{Paths: req.Paths}, true, func(tx *sql.Tx, fid int64) (bool, error) {
+		res, err := tx.Exec("UPDATE files SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, fid)...)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n > 0, nil
+	})
+}
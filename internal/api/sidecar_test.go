@@ -0,0 +1,117 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"localcloud/internal/db"
+)
+
+// sidecarTestPhoto catalogs an (empty) photo in a fresh DataDir and returns
+// its path and id
+func sidecarTestPhoto(t *testing.T) (string, int64) {
+	t.Helper()
+	oldDataDir, oldWrite := DataDir, XMPWrite
+	DataDir = t.TempDir()
+	t.Cleanup(func() { DataDir, XMPWrite = oldDataDir, oldWrite })
+	db.InitDB(filepath.Join(DataDir, "test.db"))
+	t.Cleanup(func() { db.DB.Close() })
+	if err := InitTagsDB(); err != nil {
+		t.Fatal(err)
+	}
+	abs := filepath.Join(DataDir, "a.jpg")
+	if err := os.WriteFile(abs, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.DB.Exec(`INSERT INTO files(filename, filepath, mime) VALUES('a.jpg', '/a.jpg', 'image/jpeg')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return abs, id
+}
+
+// writeTestSidecar writes side as an editor would, with a distinct mtime so
+// SyncSidecars sees the change
+func writeTestSidecar(t *testing.T, side string, m xmpMeta, mtime time.Time) {
+	t.Helper()
+	out, err := mergeXMP([]byte(emptyXMP), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(side, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(side, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func postJSON(t *testing.T, h http.HandlerFunc, body string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSyncSidecarsKeepsAPIEdits(t *testing.T) {
+	abs, id := sidecarTestPhoto(t)
+	XMPWrite = false
+	side := abs + ".xmp"
+	start := time.Now().Add(-time.Hour)
+
+	writeTestSidecar(t, side, xmpMeta{Rating: 2, Keywords: []string{"beach", "family"}}, start)
+	if n := SyncSidecars(); n != 1 {
+		t.Fatalf("first sync imported %d sidecars, want 1", n)
+	}
+
+	postJSON(t, TagsApplyHandler, `{"paths":["/a.jpg"],"add":["passport"]}`)
+	postJSON(t, RatingHandler, `{"paths":["/a.jpg"],"rating":5}`)
+	postJSON(t, DescribeHandler, `{"paths":["/a.jpg"],"title":"Renewal"}`)
+
+	// edited in Lightroom: a keyword swapped, the rating lowered
+	writeTestSidecar(t, side, xmpMeta{Rating: 1, Title: "Beach day", Keywords: []string{"family", "sunset"}}, start.Add(time.Minute))
+	if n := SyncSidecars(); n != 1 {
+		t.Fatalf("second sync imported %d sidecars, want 1", n)
+	}
+
+	tags := fileTags(id)
+	sort.Strings(tags)
+	if want := []string{"family", "passport", "sunset"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %v, want %v", tags, want)
+	}
+	var rating int
+	var title string
+	if err := db.DB.QueryRow("SELECT rating, title FROM files WHERE id = ?", id).Scan(&rating, &title); err != nil {
+		t.Fatal(err)
+	}
+	if rating != 5 || title != "Renewal" {
+		t.Errorf("rating, title = %d, %q; want the API values 5, \"Renewal\"", rating, title)
+	}
+}
+
+func TestSyncSidecarsFillsEmptyValues(t *testing.T) {
+	abs, id := sidecarTestPhoto(t)
+	XMPWrite = false
+	writeTestSidecar(t, abs+".xmp", xmpMeta{Rating: 3, Description: "From Lightroom"}, time.Now().Add(-time.Hour))
+	if n := SyncSidecars(); n != 1 {
+		t.Fatalf("imported %d sidecars, want 1", n)
+	}
+	var rating int
+	var desc string
+	if err := db.DB.QueryRow("SELECT rating, description FROM files WHERE id = ?", id).Scan(&rating, &desc); err != nil {
+		t.Fatal(err)
+	}
+	if rating != 3 || desc != "From Lightroom" {
+		t.Errorf("rating, description = %d, %q; want 3, \"From Lightroom\"", rating, desc)
+	}
+}
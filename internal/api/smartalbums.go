@@ -0,0 +1,610 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"localcloud/internal/db"
+)
+
+// InitSmartAlbumsDB ensures the smart_albums table exists.
+// Call once after db.InitDB()
+func InitSmartAlbumsDB() error {
+	_, err := db.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS smart_albums (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		query TEXT NOT NULL,
+		new_items INTEGER NOT NULL DEFAULT 0,
+		last_match_at DATETIME,
+		created_at DATETIME DEFAULT (datetime('now')),
+		updated_at DATETIME DEFAULT (datetime('now'))
+	);
+	`)
+	return err
+}
+
+// smartAlbum is the JSON shape of a saved query. Count is only filled in when
+// live counts are requested; NewItems counts sync uploads that matched since
+// the album was last opened.
+type smartAlbum struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Query       string `json:"query"`
+	Count       *int   `json:"count,omitempty"`
+	NewItems    int    `json:"new_items"`
+	LastMatchAt string `json:"last_match_at,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+// smartAlbumRequest is the body of create/update calls; nil fields are left alone
+type smartAlbumRequest struct {
+	Name  *string `json:"name"`
+	Query *string `json:"query"`
+}
+
+// smartTypes maps type: values to mime conditions
+var smartTypes = map[string]string{
+	"photo": "mime LIKE 'image/%'",
+	"image": "mime LIKE 'image/%'",
+	"video": "mime LIKE 'video/%'",
+	"audio": "mime LIKE 'audio/%'",
+	"raw":   "mime IN ('image/x-adobe-dng', 'image/x-canon-cr2', 'image/x-nikon-nef', 'image/x-sony-arw')",
+}
+
+// smartQuery is a compiled saved query: a WHERE clause over files and its args
+type smartQuery struct {
+	where string
+	args  []interface{}
+}
+
+// splitSmartQuery splits a query on spaces, keeping "double quoted" runs
+// together (camera:"Canon EOS R6").
+func splitSmartQuery(q string) []string {
+	var out []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if cur.Len() > 0 {
+				out = append(out, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		out = append(out, cur.String())
+	}
+	return out
+}
+
+// smartTakenCond matches capture dates by RFC3339 prefix: 2023, 2023-06,
+// 2023-06-12, or an inclusive range 2023-01..2023-03 (either end may be empty).
+func smartTakenCond(v string) (string, []interface{}, error) {
+	valid := func(s string) bool {
+		if len(s) != 4 && len(s) != 7 && len(s) != 10 {
+			return false
+		}
+		_, err := time.Parse("2006-01-02"[:len(s)], s)
+		return err == nil
+	}
+	if from, to, ok := strings.Cut(v, ".."); ok {
+		var conds []string
+		var args []interface{}
+		if from != "" {
+			if !valid(from) {
+				return "", nil, fmt.Errorf("taken: bad date %q", from)
+			}
+			conds = append(conds, fmt.Sprintf("substr(%s, 1, %d) >= ?", takenExpr, len(from)))
+			args = append(args, from)
+		}
+		if to != "" {
+			if !valid(to) {
+				return "", nil, fmt.Errorf("taken: bad date %q", to)
+			}
+			conds = append(conds, fmt.Sprintf("substr(%s, 1, %d) <= ?", takenExpr, len(to)))
+			args = append(args, to)
+		}
+		if len(conds) == 0 {
+			return "", nil, fmt.Errorf("taken: empty range")
+		}
+		return strings.Join(conds, " AND "), args, nil
+	}
+	if !valid(v) {
+		return "", nil, fmt.Errorf("taken: bad date %q", v)
+	}
+	return fmt.Sprintf("substr(%s, 1, %d) = ?", takenExpr, len(v)), []interface{}{v}, nil
+}
+
+// smartRatingCond matches rating:4 (at least 4), rating:=3, rating:<2 etc.
+func smartRatingCond(v string) (string, []interface{}, error) {
+	op := ">="
+	for _, o := range []string{">=", "<=", "=", ">", "<"} {
+		if strings.HasPrefix(v, o) {
+			op, v = o, v[len(o):]
+			break
+		}
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > 5 {
+		return "", nil, fmt.Errorf("rating: want 0-5, got %q", v)
+	}
+	return "COALESCE(rating, 0) " + op + " ?", []interface{}{n}, nil
+}
+
+// smartNumCond matches a numeric column: duration:>60, fps:>=50, fps:=30.
+// Without an operator it means "at least". parse converts the value.
+func smartNumCond(key, col, v string, parse func(string) (float64, error)) (string, []interface{}, error) {
+	op := ">="
+	for _, o := range []string{">=", "<=", "=", ">", "<"} {
+		if strings.HasPrefix(v, o) {
+			op, v = o, v[len(o):]
+			break
+		}
+	}
+	n, err := parse(v)
+	if err != nil || n < 0 {
+		return "", nil, fmt.Errorf("%s: bad value %q", key, v)
+	}
+	return "COALESCE(" + col + ", 0) " + op + " ?", []interface{}{n}, nil
+}
+
+// parseSeconds parses durations given as seconds ("90") or Go-style ("1m30s")
+func parseSeconds(v string) (float64, error) {
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		return n, nil
+	}
+	d, err := time.ParseDuration(v)
+	return d.Seconds(), err
+}
+
+// parseSmartQuery compiles a saved query such as
+// `camera:iPhone taken:2023 type:video -place:Paris beach`.
+// Terms are ANDed; a leading "-" negates one. Bare words match name, path,
+// camera or place like /api/search does; tag: matches a tag exactly.
+// Videos also filter by codec:, duration: (seconds or 1m30s) and fps:;
+// music by artist:, album: and genre:.
+func parseSmartQuery(q string) (smartQuery, error) {
+	terms := splitSmartQuery(strings.TrimSpace(q))
+	if len(terms) == 0 {
+		return smartQuery{}, fmt.Errorf("query must not be empty")
+	}
+	// duplicates collapsed by dedup stay out, like the timeline
+	conds := []string{"canonical_id IS NULL"}
+	var args []interface{}
+	for _, t := range terms {
+		neg := false
+		if strings.HasPrefix(t, "-") && len(t) > 1 {
+			neg, t = true, t[1:]
+		}
+		key, val, hasKey := strings.Cut(t, ":")
+		if !hasKey {
+			key, val = "", t
+		}
+		key = strings.ToLower(key)
+		if val == "" {
+			return smartQuery{}, fmt.Errorf("%s: missing value", key)
+		}
+		// the value is matched literally; LIKE wildcards in it are escaped
+		like := "%" + likeEscape(strings.ToLower(val)) + "%"
+		var cond string
+		var cargs []interface{}
+		switch key {
+		case "":
+			cond = "(LOWER(filename) LIKE ? ESCAPE '\\' OR LOWER(filepath) LIKE ? ESCAPE '\\' OR LOWER(COALESCE(camera_model, '')) LIKE ? ESCAPE '\\' OR LOWER(COALESCE(place, '')) LIKE ? ESCAPE '\\')"
+			cargs = []interface{}{like, like, like, like}
+		case "camera":
+			cond = "(LOWER(COALESCE(camera_model, '')) LIKE ? ESCAPE '\\' OR LOWER(COALESCE(camera_make, '')) LIKE ? ESCAPE '\\')"
+			cargs = []interface{}{like, like}
+		case "lens":
+			cond = "LOWER(COALESCE(lens_model, '')) LIKE ? ESCAPE '\\'"
+			cargs = []interface{}{like}
+		case "place":
+			cond = "LOWER(COALESCE(place, '')) LIKE ? ESCAPE '\\'"
+			cargs = []interface{}{like}
+		case "name":
+			cond = "LOWER(filename) LIKE ? ESCAPE '\\'"
+			cargs = []interface{}{like}
+		case "ext":
+			cond = "LOWER(filename) LIKE ? ESCAPE '\\'"
+			cargs = []interface{}{"%." + likeEscape(strings.ToLower(strings.TrimPrefix(val, ".")))}
+		case "folder":
+			dir := "/" + strings.Trim(val, "/") + "/"
+			cond = "filepath LIKE ? ESCAPE '\\'"
+			cargs = []interface{}{likeEscape(dir) + "%"}
+		case "type":
+			c, ok := smartTypes[strings.ToLower(val)]
+			if !ok {
+				return smartQuery{}, fmt.Errorf("type: want photo, video, audio or raw, got %q", val)
+			}
+			cond = "(" + c + ")"
+		case "taken":
+			c, a, err := smartTakenCond(val)
+			if err != nil {
+				return smartQuery{}, err
+			}
+			cond, cargs = "("+c+")", a
+		case "tag":
+			cond = "id IN (SELECT ft.file_id FROM file_tags ft JOIN tags t ON t.id = ft.tag_id WHERE t.name = ?)"
+			cargs = []interface{}{normalizeTag(val)}
+		case "favorite":
+			switch strings.ToLower(val) {
+			case "yes", "true", "1":
+				cond = "COALESCE(favorite, 0) = 1"
+			case "no", "false", "0":
+				cond = "COALESCE(favorite, 0) = 0"
+			default:
+				return smartQuery{}, fmt.Errorf("favorite: want yes or no, got %q", val)
+			}
+		case "rating":
+			c, a, err := smartRatingCond(val)
+			if err != nil {
+				return smartQuery{}, err
+			}
+			cond, cargs = c, a
+		case "codec":
+			cond = "(LOWER(COALESCE(video_codec, '')) LIKE ? ESCAPE '\\' OR LOWER(COALESCE(audio_codec, '')) LIKE ? ESCAPE '\\')"
+			cargs = []interface{}{like, like}
+		case "duration":
+			c, a, err := smartNumCond(key, "duration", val, parseSeconds)
+			if err != nil {
+				return smartQuery{}, err
+			}
+			cond, cargs = c, a
+		case "fps":
+			c, a, err := smartNumCond(key, "frame_rate", val, func(v string) (float64, error) { return strconv.ParseFloat(v, 64) })
+			if err != nil {
+				return smartQuery{}, err
+			}
+			cond, cargs = c, a
+		case "artist":
+			cond = "(LOWER(COALESCE(artist, '')) LIKE ? ESCAPE '\\' OR LOWER(COALESCE(album_artist, '')) LIKE ? ESCAPE '\\')"
+			cargs = []interface{}{like, like}
+		case "album", "genre":
+			cond = "LOWER(COALESCE(" + key + ", '')) LIKE ? ESCAPE '\\'"
+			cargs = []interface{}{like}
+		default:
+			return smartQuery{}, fmt.Errorf("unknown filter %q", key)
+		}
+		if neg {
+			cond = "NOT " + cond
+		}
+		conds = append(conds, cond)
+		args = append(args, cargs...)
+	}
+	// a RAW+JPEG pair is one asset (see raw.go)
+	conds = append(conds, "NOT "+rawPairedSQL)
+	return smartQuery{where: strings.Join(conds, " AND "), args: args}, nil
+}
+
+// count returns how many catalog rows currently match
+func (sq smartQuery) count() (int, error) {
+	var n int
+	err := db.DB.QueryRow("SELECT COUNT(*) FROM files WHERE "+sq.where, sq.args...).Scan(&n)
+	return n, err
+}
+
+const smartAlbumSelect = `SELECT id, name, query, new_items, COALESCE(last_match_at, ''), created_at, updated_at FROM smart_albums`
+
+func scanSmartAlbum(row interface{ Scan(...interface{}) error }) (smartAlbum, error) {
+	var a smartAlbum
+	err := row.Scan(&a.ID, &a.Name, &a.Query, &a.NewItems, &a.LastMatchAt, &a.CreatedAt, &a.UpdatedAt)
+	return a, err
+}
+
+func loadSmartAlbum(id int64) (smartAlbum, error) {
+	return scanSmartAlbum(db.DB.QueryRow(smartAlbumSelect+" WHERE id = ?", id))
+}
+
+// withCount fills in the live count; a query that no longer compiles
+// (e.g. after a filter was renamed) is logged and left without one.
+func (a *smartAlbum) withCount() {
+	sq, err := parseSmartQuery(a.Query)
+	if err == nil {
+		var n int
+		if n, err = sq.count(); err == nil {
+			a.Count = &n
+			return
+		}
+	}
+	log.Printf("smart album %d: count: %v", a.ID, err)
+}
+
+// SmartAlbumsHandler lists smart albums (GET, ?counts=1 for live counts) or
+// saves one (POST {"name","query"}). The query is validated on save.
+// GET|POST /api/smart-albums
+func SmartAlbumsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req smartAlbumRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if req.Name == nil || strings.TrimSpace(*req.Name) == "" || req.Query == nil {
+			http.Error(w, "name and query required", http.StatusBadRequest)
+			return
+		}
+		if _, err := parseSmartQuery(*req.Query); err != nil {
+			http.Error(w, "query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := db.DB.Exec("INSERT INTO smart_albums(name, query) VALUES(?, ?)",
+			strings.TrimSpace(*req.Name), strings.TrimSpace(*req.Query))
+		if err != nil {
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id, _ := res.LastInsertId()
+		a, err := loadSmartAlbum(id)
+		if err != nil {
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.withCount()
+		writeAlbumJSON(w, http.StatusCreated, a)
+		return
+	}
+
+	rows, err := db.DB.Query(smartAlbumSelect + " ORDER BY name COLLATE NOCASE, id")
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	albums := []smartAlbum{}
+	for rows.Next() {
+		a, err := scanSmartAlbum(rows)
+		if err != nil {
+			log.Printf("smart albums: row scan: %v", err)
+			continue
+		}
+		albums = append(albums, a)
+	}
+	rows.Close()
+	if r.URL.Query().Get("counts") == "1" {
+		for i := range albums {
+			albums[i].withCount()
+		}
+	}
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{"albums": albums})
+}
+
+// SmartAlbumHandler evaluates a smart album and returns a page of matches,
+// newest capture first, in /api/search's item shape (GET; this also clears
+// new_items), updates name/query (PUT) or deletes it (DELETE).
+// GET    /api/smart-albums/{id}?offset=0&limit=100
+// PUT    /api/smart-albums/{id}  {"name","query"}
+// DELETE /api/smart-albums/{id}
+func SmartAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := albumIDFromRequest(r)
+	if !ok {
+		http.Error(w, "invalid album id", http.StatusBadRequest)
+		return
+	}
+	a, err := loadSmartAlbum(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "smart album not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		if _, err := db.DB.Exec("DELETE FROM smart_albums WHERE id = ?", id); err != nil {
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAlbumJSON(w, http.StatusOK, map[string]interface{}{"deleted": id})
+		return
+
+	case http.MethodPut:
+		var req smartAlbumRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if req.Name != nil {
+			if strings.TrimSpace(*req.Name) == "" {
+				http.Error(w, "name must not be empty", http.StatusBadRequest)
+				return
+			}
+			_, err = db.DB.Exec("UPDATE smart_albums SET name = ? WHERE id = ?", strings.TrimSpace(*req.Name), id)
+		}
+		if err == nil && req.Query != nil {
+			if _, qerr := parseSmartQuery(*req.Query); qerr != nil {
+				http.Error(w, "query: "+qerr.Error(), http.StatusBadRequest)
+				return
+			}
+			// a new query starts with a clean slate of notifications
+			_, err = db.DB.Exec("UPDATE smart_albums SET query = ?, new_items = 0 WHERE id = ?", strings.TrimSpace(*req.Query), id)
+		}
+		if err == nil {
+			_, err = db.DB.Exec("UPDATE smart_albums SET updated_at = datetime('now') WHERE id = ?", id)
+		}
+		if err != nil {
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if a, err = loadSmartAlbum(id); err != nil {
+			http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.withCount()
+		writeAlbumJSON(w, http.StatusOK, a)
+		return
+	}
+
+	sq, err := parseSmartQuery(a.Query)
+	if err != nil {
+		http.Error(w, "query: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit := 100
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+	rows, err := db.DB.Query(`SELECT id, filename, filepath, mime, uploaded_at, exif_datetime, camera_model
+		FROM files WHERE `+sq.where+` ORDER BY `+takenExpr+` DESC, id DESC LIMIT ? OFFSET ?`,
+		append(sq.args, limit, offset)...)
+	if err != nil {
+		log.Printf("smart album %d: %v", id, err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	items := pairRawJPEG(scanMediaRows(rows))
+	rows.Close()
+	a.withCount()
+	if a.NewItems > 0 {
+		_, _ = db.DB.Exec("UPDATE smart_albums SET new_items = 0 WHERE id = ?", id)
+	}
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{
+		"album":  a,
+		"items":  items,
+		"offset": offset,
+		"limit":  limit,
+	})
+}
+
+// smartAlbumEvent records that a new upload matched a smart album
+type smartAlbumEvent struct {
+	Seq     int64  `json:"seq"`
+	AlbumID int64  `json:"album_id"`
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	At      string `json:"at"`
+}
+
+// smartEventsMax bounds the in-memory event log; clients that fall further
+// behind than this should reload the album list.
+const smartEventsMax = 256
+
+// smartEvents is the change feed served by SmartAlbumEventsHandler. wake is
+// closed and replaced whenever events are appended so long-polls return.
+var smartEvents = struct {
+	sync.Mutex
+	seq  int64
+	log  []smartAlbumEvent
+	wake chan struct{}
+}{wake: make(chan struct{})}
+
+// notifySmartAlbums checks a newly cataloged file against every smart album,
+// bumps new_items on the ones it matches and publishes a change event. Called
+// by the metadata worker, so filters on EXIF, place and tags see the file.
+func notifySmartAlbums(apiPath string) {
+	fid := catalogFileID(catalogAbs(apiPath))
+	if fid == 0 {
+		return
+	}
+	rows, err := db.DB.Query("SELECT id, name, query FROM smart_albums")
+	if err != nil {
+		log.Printf("smart albums: notify: %v", err)
+		return
+	}
+	type saved struct {
+		id          int64
+		name, query string
+	}
+	var all []saved
+	for rows.Next() {
+		var s saved
+		if err := rows.Scan(&s.id, &s.name, &s.query); err == nil {
+			all = append(all, s)
+		}
+	}
+	rows.Close()
+
+	var events []smartAlbumEvent
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, s := range all {
+		sq, err := parseSmartQuery(s.query)
+		if err != nil {
+			continue
+		}
+		var hit int
+		err = db.DB.QueryRow("SELECT COUNT(*) FROM files WHERE id = ? AND "+sq.where, append([]interface{}{fid}, sq.args...)...).Scan(&hit)
+		if err != nil || hit == 0 {
+			continue
+		}
+		if _, err := db.DB.Exec("UPDATE smart_albums SET new_items = new_items + 1, last_match_at = ? WHERE id = ?", now, s.id); err != nil {
+			log.Printf("smart album %d: notify: %v", s.id, err)
+		}
+		events = append(events, smartAlbumEvent{AlbumID: s.id, Name: s.name, Path: apiPath, At: now})
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	smartEvents.Lock()
+	for _, ev := range events {
+		smartEvents.seq++
+		ev.Seq = smartEvents.seq
+		smartEvents.log = append(smartEvents.log, ev)
+	}
+	if n := len(smartEvents.log); n > smartEventsMax {
+		smartEvents.log = append([]smartAlbumEvent(nil), smartEvents.log[n-smartEventsMax:]...)
+	}
+	close(smartEvents.wake)
+	smartEvents.wake = make(chan struct{})
+	smartEvents.Unlock()
+}
+
+// smartEventsSince returns events after seq, the latest seq, and a channel
+// closed on the next append.
+func smartEventsSince(seq int64) ([]smartAlbumEvent, int64, <-chan struct{}) {
+	smartEvents.Lock()
+	defer smartEvents.Unlock()
+	out := []smartAlbumEvent{}
+	for _, ev := range smartEvents.log {
+		if ev.Seq > seq {
+			out = append(out, ev)
+		}
+	}
+	return out, smartEvents.seq, smartEvents.wake
+}
+
+// SmartAlbumEventsHandler is a long-poll change feed of uploads matching smart
+// albums. It returns as soon as there are events after `since`, or after
+// `wait` seconds (max 60) with none. Pass the returned seq back as since.
+// GET /api/smart-albums/events?since=0&wait=30
+func SmartAlbumEventsHandler(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	wait := 30
+	if v, err := strconv.Atoi(r.URL.Query().Get("wait")); err == nil && v >= 0 && v <= 60 {
+		wait = v
+	}
+	events, seq, wake := smartEventsSince(since)
+	if len(events) == 0 && wait > 0 {
+		t := time.NewTimer(time.Duration(wait) * time.Second)
+		select {
+		case <-wake:
+		case <-t.C:
+		case <-r.Context().Done():
+		}
+		t.Stop()
+		events, seq, _ = smartEventsSince(since)
+	}
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{"events": events, "seq": seq})
+}
+
+// likeEscape escapes the LIKE wildcards in s for use with ESCAPE '\'
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,353 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Storyboards are what the UI scrubs through when hovering a video or its
+// seek bar: one JPEG sprite sheet of evenly spaced frames plus a WebVTT
+// thumbnail track mapping time ranges to tiles (#xywh media fragments).
+// Both live in the thumbnail cache next to the video's thumbnails; preview
+// clips (a few muted seconds from across the video) are made on request.
+
+// cache variants, see thumbcache.go
+const (
+	storyboardSprite  = "sprite"
+	storyboardPreview = "preview"
+)
+
+const (
+	storyboardCols      = 10
+	storyboardTileW     = 160
+	storyboardMaxFrames = 100
+	// storyboardMinStep keeps short clips from getting a tile per frame
+	storyboardMinStep = 2.0
+
+	previewClipW    = 320
+	previewSnippets = 3
+	previewSnipLen  = 1.0 // seconds per snippet
+)
+
+// PreviewClips makes the thumbnail worker generate preview clips up front
+// instead of on first request (set from config).
+var PreviewClips bool
+
+// storyboardURL is the WebVTT thumbnail track of a video
+func storyboardURL(apiPath string) string {
+	return "/api/video/storyboard.vtt?path=" + url.QueryEscape(apiPath)
+}
+
+// spriteURL is the sprite sheet a storyboard's cues point into
+func spriteURL(apiPath string) string {
+	return "/api/video/sprite?path=" + url.QueryEscape(apiPath)
+}
+
+// previewURL is the animated preview clip of a video
+func previewURL(apiPath string) string {
+	return "/api/video/preview?path=" + url.QueryEscape(apiPath)
+}
+
+// previewClipPath is the cache path of the preview clip of abs
+func previewClipPath(abs string) string {
+	return thumbVariantPath(thumbCachePath(abs, storyboardPreview), "mp4")
+}
+
+// videoDuration probes abs (through the stream probe cache) for its length
+func videoDuration(abs string) (float64, error) {
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return 0, err
+	}
+	info, err := probeVideo(abs, fi.ModTime())
+	if err != nil {
+		return 0, err
+	}
+	if info.Duration <= 0 {
+		return 0, fmt.Errorf("unknown duration")
+	}
+	return info.Duration, nil
+}
+
+// storyboardStep returns the seconds between storyboard frames and how many
+// frames a video of d seconds gets.
+func storyboardStep(d float64) (step float64, frames int) {
+	step = math.Max(storyboardMinStep, d/storyboardMaxFrames)
+	frames = int(math.Ceil(d / step))
+	if frames < 1 {
+		frames = 1
+	}
+	return step, frames
+}
+
+// videoGen deduplicates storyboard/preview generation, so the worker and a
+// viewer asking for the same file share one ffmpeg run.
+var videoGen = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: map[string]chan struct{}{}}
+
+// generateOnce runs gen unless dst exists, waiting for a run already in
+// progress for dst instead of starting a second one.
+func generateOnce(dst string, gen func() error) error {
+	if fileExists(dst) {
+		return nil
+	}
+	videoGen.Lock()
+	if ch, ok := videoGen.m[dst]; ok {
+		videoGen.Unlock()
+		<-ch
+		if fileExists(dst) {
+			return nil
+		}
+		return fmt.Errorf("generating %s failed", filepath.Base(dst))
+	}
+	ch := make(chan struct{})
+	videoGen.m[dst] = ch
+	videoGen.Unlock()
+	defer func() {
+		videoGen.Lock()
+		delete(videoGen.m, dst)
+		videoGen.Unlock()
+		close(ch)
+	}()
+	if fileExists(dst) {
+		return nil
+	}
+	return gen()
+}
+
+// runFFmpeg runs ffmpeg with args, including its stderr in the error
+func runFFmpeg(args ...string) error {
+	cmd := exec.Command("ffmpeg", append([]string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// generateStoryboard writes the sprite sheet and WebVTT track of video abs.
+// The track is written last, so its presence means the storyboard is complete.
+func generateStoryboard(abs string) error {
+	sprite := thumbCachePath(abs, storyboardSprite)
+	vtt := thumbVariantPath(sprite, "vtt")
+	if fileExists(vtt) && !fileExists(sprite) {
+		// the LRU evicted the sprite but not its track
+		_ = thumbs.remove(vtt)
+	}
+	return generateOnce(vtt, func() error {
+		d, err := videoDuration(abs)
+		if err != nil {
+			return err
+		}
+		step, frames := storyboardStep(d)
+		rows := (frames + storyboardCols - 1) / storyboardCols
+		tmp := sprite + ".tmp"
+		// keyframes only: decoding every frame of a long video takes minutes,
+		// and phones put a keyframe every second or two anyway
+		err = runFFmpeg("-skip_frame", "nokey", "-i", abs, "-an",
+			"-vf", fmt.Sprintf("fps=1/%g,scale=%d:-2,tile=%dx%d", step, storyboardTileW, storyboardCols, rows),
+			"-frames:v", "1", "-q:v", "5", "-f", "image2", "-c:v", "mjpeg", tmp)
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+		f, err := os.Open(tmp)
+		if err != nil {
+			return err
+		}
+		cfg, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			_ = os.Remove(tmp)
+			return fmt.Errorf("storyboard sprite: %w", err)
+		}
+		if err := os.Rename(tmp, sprite); err != nil {
+			return err
+		}
+		thumbs.add(sprite)
+
+		track := storyboardVTT(spriteURL(relAPIPath(abs)), d, step, frames, cfg.Width/storyboardCols, cfg.Height/rows)
+		if err := os.WriteFile(vtt+".tmp", []byte(track), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(vtt+".tmp", vtt); err != nil {
+			return err
+		}
+		thumbs.add(vtt)
+		return nil
+	})
+}
+
+// storyboardVTT builds the WebVTT thumbnail track for a sprite of frames
+// tiles of tileW x tileH, one per step seconds of a d-second video.
+func storyboardVTT(sprite string, d, step float64, frames, tileW, tileH int) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < frames; i++ {
+		start := float64(i) * step
+		end := math.Min(start+step, d)
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", vttTime(start), vttTime(end), sprite,
+			(i%storyboardCols)*tileW, (i/storyboardCols)*tileH, tileW, tileH)
+	}
+	return b.String()
+}
+
+// vttTime formats seconds as a WebVTT timestamp (HH:MM:SS.mmm)
+func vttTime(s float64) string {
+	ms := int64(math.Round(s * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// generatePreviewClip writes a short muted MP4 of video abs: a second from
+// each of a few points across it, or just the start of very short videos.
+func generatePreviewClip(abs string) error {
+	dst := previewClipPath(abs)
+	return generateOnce(dst, func() error {
+		d, err := videoDuration(abs)
+		if err != nil {
+			return err
+		}
+		vf := fmt.Sprintf("scale=%d:-2", previewClipW)
+		if d > previewSnippets*previewSnipLen*2 {
+			parts := make([]string, previewSnippets)
+			for i := range parts {
+				at := d * float64(i+1) / (previewSnippets + 1)
+				parts[i] = fmt.Sprintf("between(t,%.3f,%.3f)", at, at+previewSnipLen)
+			}
+			vf = "select='" + strings.Join(parts, "+") + "',setpts=N/FRAME_RATE/TB," + vf
+		}
+		tmp := dst + ".tmp"
+		err = runFFmpeg("-i", abs, "-an", "-vf", vf, "-t", fmt.Sprint(previewSnippets*previewSnipLen),
+			"-c:v", "libx264", "-preset", "veryfast", "-crf", "28", "-pix_fmt", "yuv420p",
+			"-movflags", "+faststart", "-f", "mp4", tmp)
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			return err
+		}
+		thumbs.add(dst)
+		return nil
+	})
+}
+
+// generateVideoExtras makes the storyboard (and preview clip if enabled) of
+// a freshly thumbnailed video. Called by the thumbnail worker.
+func generateVideoExtras(abs string) {
+	if err := generateStoryboard(abs); err != nil {
+		log.Printf("storyboard %s: %v", abs, err)
+	}
+	if PreviewClips {
+		if err := generatePreviewClip(abs); err != nil {
+			log.Printf("preview clip %s: %v", abs, err)
+		}
+	}
+}
+
+// videoTarget resolves the path of a storyboard/preview request to a video.
+// On failure the error response has been written.
+func videoTarget(w http.ResponseWriter, r *http.Request) (string, bool) {
+	q := r.URL.Query().Get("path")
+	if q == "" || shouldIgnoreFile(filepath.Base(q)) {
+		http.Error(w, "path required", http.StatusBadRequest)
+		return "", false
+	}
+	abs, err := absClean(DataDir, q)
+	if err != nil {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return "", false
+	}
+	abs = resolveFile(abs)
+	if !strings.HasPrefix(mimeTypeFor(abs), "video/") {
+		http.Error(w, "not a video", http.StatusBadRequest)
+		return "", false
+	}
+	if !fileExists(abs) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return "", false
+	}
+	return abs, true
+}
+
+// serveVideoExtra generates dst with gen if needed and serves it
+func serveVideoExtra(w http.ResponseWriter, r *http.Request, dst, contentType string, gen func() error) {
+	defer thumbs.pin(dst)()
+	if err := gen(); err != nil {
+		log.Printf("video extra %s: %v", dst, err)
+		http.Error(w, "not available", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(dst)
+	if err != nil {
+		http.Error(w, "not available", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "stat error", http.StatusInternalServerError)
+		return
+	}
+	thumbs.touch(dst)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, filepath.Base(dst), fi.ModTime(), f)
+}
+
+// VideoStoryboardHandler serves the WebVTT thumbnail track of a video, for
+// seek-bar previews (<track kind="metadata">) and hover scrubbing.
+// GET /api/video/storyboard.vtt?path=/clip.mov
+func VideoStoryboardHandler(w http.ResponseWriter, r *http.Request) {
+	abs, ok := videoTarget(w, r)
+	if !ok {
+		return
+	}
+	vtt := thumbVariantPath(thumbCachePath(abs, storyboardSprite), "vtt")
+	serveVideoExtra(w, r, vtt, "text/vtt; charset=utf-8", func() error { return generateStoryboard(abs) })
+}
+
+// VideoSpriteHandler serves the storyboard sprite sheet of a video.
+// GET /api/video/sprite?path=/clip.mov
+func VideoSpriteHandler(w http.ResponseWriter, r *http.Request) {
+	abs, ok := videoTarget(w, r)
+	if !ok {
+		return
+	}
+	serveVideoExtra(w, r, thumbCachePath(abs, storyboardSprite), "image/jpeg", func() error { return generateStoryboard(abs) })
+}
+
+// VideoPreviewHandler serves a short muted preview clip of a video, made on
+// first request unless the thumbnail worker already made it.
+// GET /api/video/preview?path=/clip.mov
+func VideoPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	abs, ok := videoTarget(w, r)
+	if !ok {
+		return
+	}
+	serveVideoExtra(w, r, previewClipPath(abs), "video/mp4", func() error { return generatePreviewClip(abs) })
+}
+
+// videoThumbSeek picks the frame time for a video thumbnail: 2s in, or a
+// third of the way through clips shorter than 6s.
+func videoThumbSeek(abs string) float64 {
+	d, err := videoDuration(abs)
+	if err != nil {
+		return 0
+	}
+	return math.Min(2, d/3)
+}
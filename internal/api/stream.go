@@ -0,0 +1,615 @@
+package api
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"localcloud/internal/db"
+)
+
+// HLS renditions are transcoded on demand, one ladder rung at a time, into
+// DataDir/.streams/<file id>.<source mtime key>/<rung>/ as index.m3u8 plus
+// seg_NNNNN.ts. Editing the source changes the key, so stale renditions are
+// never served and age out of the LRU.
+
+// hlsRendition is one rung of the bitrate ladder
+type hlsRendition struct {
+	Name    string // "720p"; also the URL path component
+	Short   int    // size of the shorter side, so portrait phone video works too
+	Bitrate int    // video bits/s
+}
+
+var hlsLadder = []hlsRendition{
+	{"360p", 360, 800_000},
+	{"720p", 720, 2_800_000},
+	{"1080p", 1080, 5_000_000},
+}
+
+const (
+	hlsAudioBitrate   = 128_000
+	hlsSegmentSeconds = 4
+)
+
+// streamIdleTimeout stops a transcode nobody has requested anything from
+// for this long; the partial rendition is discarded.
+var streamIdleTimeout = 2 * time.Minute
+
+// streamWaitTimeout bounds how long a request waits for a playlist or
+// segment that is still being transcoded.
+var streamWaitTimeout = 60 * time.Second
+
+// videoInfo is what the ladder needs to know about a source video.
+// Width/Height are display dimensions (rotation applied).
+type videoInfo struct {
+	Width    int
+	Height   int
+	Duration float64 // seconds
+}
+
+// Transcoder turns a video into HLS. The ffmpeg implementation is used unless
+// streamTranscoder is replaced (tests swap in a fake).
+type Transcoder interface {
+	Probe(src string) (videoInfo, error)
+	// Transcode writes dir/index.m3u8 and its segments for rendition r,
+	// returning when done or when ctx is cancelled.
+	Transcode(ctx context.Context, src, dir string, r hlsRendition, info videoInfo) error
+}
+
+var streamTranscoder Transcoder = ffmpegTranscoder{}
+
+// transcodeSlots bounds concurrent transcodes; a Pi can't do many
+var transcodeSlots = make(chan struct{}, 2)
+
+// outputSize scales info so its shorter side is r.Short, keeping the aspect
+// ratio and even dimensions (required by yuv420p).
+func (r hlsRendition) outputSize(info videoInfo) (int, int) {
+	even := func(v float64) int { return int(math.Round(v/2)) * 2 }
+	if info.Width <= 0 || info.Height <= 0 {
+		return even(float64(r.Short) * 16 / 9), r.Short
+	}
+	if info.Width >= info.Height {
+		return even(float64(info.Width) * float64(r.Short) / float64(info.Height)), r.Short
+	}
+	return r.Short, even(float64(info.Height) * float64(r.Short) / float64(info.Width))
+}
+
+// renditionsFor returns the rungs not larger than the source; a source
+// smaller than the lowest rung still gets that one.
+func renditionsFor(info videoInfo) []hlsRendition {
+	short := info.Width
+	if info.Height < short {
+		short = info.Height
+	}
+	var out []hlsRendition
+	for _, r := range hlsLadder {
+		if r.Short <= short {
+			out = append(out, r)
+		}
+	}
+	if len(out) == 0 {
+		out = hlsLadder[:1]
+	}
+	return out
+}
+
+func renditionByName(name string) (hlsRendition, bool) {
+	for _, r := range hlsLadder {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return hlsRendition{}, false
+}
+
+// ---------------------- ffmpeg ----------------------
+
+type ffmpegTranscoder struct{}
+
+func (ffmpegTranscoder) Probe(src string) (videoInfo, error) {
+	var info videoInfo
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height:stream_tags=rotate:stream_side_data=rotation:format=duration",
+		"-of", "json", src).Output()
+	if err != nil {
+		return info, fmt.Errorf("ffprobe: %w", err)
+	}
+	var probe struct {
+		Streams []struct {
+			Width    int               `json:"width"`
+			Height   int               `json:"height"`
+			Tags     map[string]string `json:"tags"`
+			SideData []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return info, fmt.Errorf("ffprobe: %w", err)
+	}
+	if len(probe.Streams) == 0 {
+		return info, fmt.Errorf("ffprobe: no video stream")
+	}
+	s := probe.Streams[0]
+	info.Width, info.Height = s.Width, s.Height
+	rot, _ := strconv.ParseFloat(s.Tags["rotate"], 64)
+	for _, sd := range s.SideData {
+		if sd.Rotation != 0 {
+			rot = sd.Rotation
+		}
+	}
+	// ffmpeg autorotates, so size the ladder by what the viewer sees
+	if r := int(math.Abs(rot)) % 180; r == 90 {
+		info.Width, info.Height = info.Height, info.Width
+	}
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	return info, nil
+}
+
+func (ffmpegTranscoder) Transcode(ctx context.Context, src, dir string, r hlsRendition, info videoInfo) error {
+	w, h := r.outputSize(info)
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y", "-i", src,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", fmt.Sprintf("scale=%d:%d,format=yuv420p", w, h),
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "high",
+		"-b:v", strconv.Itoa(r.Bitrate), "-maxrate", strconv.Itoa(r.Bitrate * 107 / 100), "-bufsize", strconv.Itoa(r.Bitrate * 3 / 2),
+		// keyframe every segment boundary so segments start cleanly
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds), "-sc_threshold", "0",
+		"-c:a", "aac", "-b:a", strconv.Itoa(hlsAudioBitrate), "-ac", "2",
+		"-f", "hls", "-hls_time", strconv.Itoa(hlsSegmentSeconds), "-hls_playlist_type", "event",
+		// temp_file: segments appear under their final name only when complete
+		"-hls_flags", "independent_segments+temp_file",
+		"-hls_segment_filename", filepath.Join(dir, "seg_%05d.ts"),
+		filepath.Join(dir, "index.m3u8"),
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("ffmpeg %s: %v: %s", r.Name, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// ---------------------- segment cache ----------------------
+
+// hlsJob is a running transcode of one rendition
+type hlsJob struct {
+	done   chan struct{}
+	err    error
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	last   time.Time // last request for this rendition
+}
+
+func (j *hlsJob) touch() {
+	j.mu.Lock()
+	j.last = time.Now()
+	j.mu.Unlock()
+}
+
+func (j *hlsJob) idle() time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return time.Since(j.last)
+}
+
+// streamCache tracks complete renditions in LRU order and keeps their total
+// size under maxBytes (0 = unlimited). Running transcodes are not evictable.
+type streamCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	ll       *list.List               // front = most recently used
+	entries  map[string]*list.Element // rendition dir -> element
+	jobs     map[string]*hlsJob       // rendition dir -> running transcode
+}
+
+type streamEntry struct {
+	dir  string
+	size int64
+}
+
+var streams = &streamCache{ll: list.New(), entries: map[string]*list.Element{}, jobs: map[string]*hlsJob{}}
+
+// dirSize sums the files in dir
+func dirSize(dir string) int64 {
+	var n int64
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if fi, err := e.Info(); err == nil && !fi.IsDir() {
+			n += fi.Size()
+		}
+	}
+	return n
+}
+
+// playlistComplete reports whether dir holds a finished rendition
+func playlistComplete(dir string) bool {
+	data, err := os.ReadFile(filepath.Join(dir, "index.m3u8"))
+	return err == nil && bytes.Contains(data, []byte("#EXT-X-ENDLIST"))
+}
+
+// add records a finished rendition and evicts older ones if needed
+func (c *streamCache) add(dir string) {
+	size := dirSize(dir)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[dir]; ok {
+		e := el.Value.(*streamEntry)
+		c.size += size - e.size
+		e.size = size
+		c.ll.MoveToFront(el)
+	} else {
+		c.entries[dir] = c.ll.PushFront(&streamEntry{dir: dir, size: size})
+		c.size += size
+	}
+	c.evictLocked()
+}
+
+func (c *streamCache) evictLocked() {
+	for c.maxBytes > 0 && c.size > c.maxBytes && c.ll.Len() > 1 {
+		el := c.ll.Back()
+		e := el.Value.(*streamEntry)
+		c.ll.Remove(el)
+		delete(c.entries, e.dir)
+		c.size -= e.size
+		if err := os.RemoveAll(e.dir); err != nil {
+			log.Printf("stream cache: evict %s: %v", e.dir, err)
+		}
+		// drop the per-video dir once its last rendition is gone
+		_ = os.Remove(filepath.Dir(e.dir))
+	}
+}
+
+// ensure makes sure rendition r of src exists in dir: a complete rendition
+// is marked used and nil is returned; otherwise the running (or a newly
+// started) transcode is returned.
+func (c *streamCache) ensure(src, dir string, r hlsRendition, info videoInfo) *hlsJob {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[dir]; ok {
+		c.ll.MoveToFront(el)
+		return nil
+	}
+	if j, ok := c.jobs[dir]; ok {
+		j.touch()
+		return j
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &hlsJob{done: make(chan struct{}), cancel: cancel, last: time.Now()}
+	c.jobs[dir] = j
+	go c.run(ctx, j, src, dir, r, info)
+	return j
+}
+
+// run transcodes one rendition, cancelling it if it goes unwatched
+func (c *streamCache) run(ctx context.Context, j *hlsJob, src, dir string, r hlsRendition, info videoInfo) {
+	defer j.cancel()
+	idle := streamIdleTimeout
+	go func() {
+		t := time.NewTicker(idle / 4)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if j.idle() > idle {
+					log.Printf("stream: %s idle, stopping transcode", dir)
+					j.cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	select {
+	case transcodeSlots <- struct{}{}:
+		defer func() { <-transcodeSlots }()
+	case <-ctx.Done():
+	}
+	err := ctx.Err()
+	if err == nil {
+		_ = os.RemoveAll(dir)
+		if err = os.MkdirAll(dir, 0755); err == nil {
+			err = streamTranscoder.Transcode(ctx, src, dir, r, info)
+		}
+	}
+	if err == nil && !playlistComplete(dir) {
+		err = fmt.Errorf("transcoder finished without a complete playlist")
+	}
+	if err != nil {
+		if err != context.Canceled {
+			log.Printf("stream: transcode %s: %v", dir, err)
+		}
+		_ = os.RemoveAll(dir)
+	} else {
+		c.add(dir)
+	}
+
+	c.mu.Lock()
+	delete(c.jobs, dir)
+	c.mu.Unlock()
+	j.err = err
+	close(j.done)
+}
+
+func (c *streamCache) stats() (count, running int, size, maxBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len(), len(c.jobs), c.size, c.maxBytes
+}
+
+// streamDirRE matches per-video cache dirs: "<file id>.<mtime key>"
+var streamDirRE = regexp.MustCompile(`^(\d+)\.(m[0-9a-f]+)$`)
+
+// InitStreamCache loads finished renditions into the LRU (oldest first) and
+// applies the size cap; partial renditions from an interrupted run and ones
+// whose source changed or left the catalog are deleted. maxBytes <= 0 means
+// unlimited.
+func InitStreamCache(maxBytes int64) {
+	type found struct {
+		dir  string
+		size int64
+		mod  time.Time
+	}
+	var all []found
+	root := filepath.Join(DataDir, ".streams")
+	videos, _ := os.ReadDir(root)
+	for _, v := range videos {
+		vdir := filepath.Join(root, v.Name())
+		m := streamDirRE.FindStringSubmatch(v.Name())
+		live := false
+		if m != nil {
+			id, _ := strconv.ParseInt(m[1], 10, 64)
+			if src, err := streamSource(id); err == nil {
+				if fi, err := os.Stat(src); err == nil && thumbKey(fi.ModTime()) == m[2] {
+					live = true
+				}
+			}
+		}
+		if !live {
+			_ = os.RemoveAll(vdir)
+			continue
+		}
+		rungs, _ := os.ReadDir(vdir)
+		for _, rg := range rungs {
+			dir := filepath.Join(vdir, rg.Name())
+			if !playlistComplete(dir) {
+				_ = os.RemoveAll(dir)
+				continue
+			}
+			if fi, err := os.Stat(filepath.Join(dir, "index.m3u8")); err == nil {
+				all = append(all, found{dir, dirSize(dir), fi.ModTime()})
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].mod.Before(all[j].mod) })
+
+	streams.mu.Lock()
+	streams.maxBytes = maxBytes
+	for _, f := range all {
+		if _, ok := streams.entries[f.dir]; ok {
+			continue
+		}
+		streams.entries[f.dir] = streams.ll.PushFront(&streamEntry{dir: f.dir, size: f.size})
+		streams.size += f.size
+	}
+	streams.evictLocked()
+	count, size := streams.ll.Len(), streams.size
+	streams.mu.Unlock()
+	log.Printf("stream cache: %d renditions, %d bytes (max %d)", count, size, maxBytes)
+}
+
+// ---------------------- handlers ----------------------
+
+// probeCache remembers videoInfo per source version; probing on every
+// playlist request would spawn ffprobe each time.
+var probeCache = struct {
+	sync.Mutex
+	m map[string]videoInfo
+}{m: map[string]videoInfo{}}
+
+func probeVideo(src string, mtime time.Time) (videoInfo, error) {
+	key := src + "\x00" + thumbKey(mtime)
+	probeCache.Lock()
+	info, ok := probeCache.m[key]
+	probeCache.Unlock()
+	if ok {
+		return info, nil
+	}
+	info, err := streamTranscoder.Probe(src)
+	if err != nil {
+		return info, err
+	}
+	probeCache.Lock()
+	probeCache.m[key] = info
+	probeCache.Unlock()
+	return info, nil
+}
+
+// streamURL is the HLS master playlist of catalog id
+func streamURL(id int64) string {
+	return fmt.Sprintf("/api/stream/%d/master.m3u8", id)
+}
+
+// streamSource returns the file on disk for catalog id if it is a video
+func streamSource(id int64) (string, error) {
+	var name, p string
+	err := db.DB.QueryRow("SELECT filename, filepath FROM files WHERE id = ?", id).Scan(&name, &p)
+	if err == sql.ErrNoRows {
+		return "", os.ErrNotExist
+	} else if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(mimeTypeFor(name), "video/") {
+		return "", fmt.Errorf("not a video")
+	}
+	return resolveFile(catalogAbs(p)), nil
+}
+
+// streamTarget resolves the {id} of a stream request to its source, probe
+// and cache dir. On failure the error response has been written.
+func streamTarget(w http.ResponseWriter, r *http.Request) (src, vdir string, info videoInfo, ok bool) {
+	id, err := strconv.ParseInt(muxVars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	src, err = streamSource(id)
+	if os.IsNotExist(err) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if info, err = probeVideo(src, fi.ModTime()); err != nil {
+		http.Error(w, "probe: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	vdir = filepath.Join(DataDir, ".streams", fmt.Sprintf("%d.%s", id, thumbKey(fi.ModTime())))
+	return src, vdir, info, true
+}
+
+// StreamMasterHandler returns the HLS master playlist listing the ladder
+// rungs that fit the video. Nothing is transcoded until a rung is requested.
+// GET /api/stream/{id}/master.m3u8
+func StreamMasterHandler(w http.ResponseWriter, r *http.Request) {
+	_, _, info, ok := streamTarget(w, r)
+	if !ok {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	for _, rd := range renditionsFor(info) {
+		wd, ht := rd.outputSize(info)
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%dx%d,NAME=\"%s\"\n%s/index.m3u8\n",
+			(rd.Bitrate*107/100)+hlsAudioBitrate, rd.Bitrate+hlsAudioBitrate, wd, ht, rd.Name, rd.Name)
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// segmentNameRE matches the segment names the transcoder writes
+var segmentNameRE = regexp.MustCompile(`^seg_\d{5}\.ts$`)
+
+// waitForFile waits until ready() holds, the job ends or the wait times out.
+func waitForFile(r *http.Request, j *hlsJob, ready func() bool) bool {
+	deadline := time.NewTimer(streamWaitTimeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	for !ready() {
+		select {
+		case <-j.done:
+			return ready()
+		case <-deadline.C:
+			return false
+		case <-r.Context().Done():
+			return false
+		case <-tick.C:
+		}
+	}
+	return true
+}
+
+// StreamFileHandler serves a rendition playlist or segment, starting the
+// transcode of that rendition on first request. While it runs the playlist
+// is an EVENT playlist that grows; players keep reloading it until
+// #EXT-X-ENDLIST appears.
+// GET /api/stream/{id}/{rendition}/index.m3u8
+// GET /api/stream/{id}/{rendition}/seg_00000.ts
+func StreamFileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := muxVars(r)
+	rd, ok := renditionByName(vars["rendition"])
+	name := vars["file"]
+	if !ok || (name != "index.m3u8" && !segmentNameRE.MatchString(name)) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	src, vdir, info, ok := streamTarget(w, r)
+	if !ok {
+		return
+	}
+	dir := filepath.Join(vdir, rd.Name)
+	target := filepath.Join(dir, name)
+
+	if j := streams.ensure(src, dir, rd, info); j != nil {
+		ready := func() bool {
+			if name != "index.m3u8" {
+				_, err := os.Stat(target)
+				return err == nil
+			}
+			// wait for the first segment so players don't see an empty list
+			data, err := os.ReadFile(target)
+			return err == nil && bytes.Contains(data, []byte("#EXTINF"))
+		}
+		if !waitForFile(r, j, ready) {
+			select {
+			case <-j.done:
+				if j.err != nil {
+					http.Error(w, "transcode failed", http.StatusBadGateway)
+					return
+				}
+			default:
+				if r.Context().Err() == nil {
+					http.Error(w, "still transcoding", http.StatusServiceUnavailable)
+					return
+				}
+			}
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if name == "index.m3u8" {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "video/mp2t")
+		// a segment name is tied to a source version via the cache dir
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	}
+	http.ServeFile(w, r, target)
+}
+
+// StreamCacheHandler reports HLS cache usage.
+// GET /api/stream/cache
+func StreamCacheHandler(w http.ResponseWriter, r *http.Request) {
+	count, running, size, maxBytes := streams.stats()
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{
+		"renditions": count,
+		"running":    running,
+		"bytes":      size,
+		"max_bytes":  maxBytes,
+	})
+}
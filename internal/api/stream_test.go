@@ -0,0 +1,283 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"localcloud/internal/db"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeTranscoder writes a two-segment rendition without ffmpeg. With hold
+// set it stops after the first segment (an EVENT playlist without
+// #EXT-X-ENDLIST) until hold is closed or ctx is cancelled.
+type fakeTranscoder struct {
+	info  videoInfo
+	err   error // returned before anything is written
+	hold  chan struct{}
+	calls int32
+}
+
+func (f *fakeTranscoder) Probe(src string) (videoInfo, error) {
+	return f.info, nil
+}
+
+func (f *fakeTranscoder) Transcode(ctx context.Context, src, dir string, r hlsRendition, info videoInfo) error {
+	atomic.AddInt32(&f.calls, 1)
+	if f.err != nil {
+		return f.err
+	}
+	playlist := "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-PLAYLIST-TYPE:EVENT\n"
+	segment := func(n int) error {
+		name := fmt.Sprintf("seg_%05d.ts", n)
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, 1000), 0644); err != nil {
+			return err
+		}
+		playlist += fmt.Sprintf("#EXTINF:%d.0,\n%s\n", hlsSegmentSeconds, name)
+		return os.WriteFile(filepath.Join(dir, "index.m3u8"), []byte(playlist), 0644)
+	}
+	if err := segment(0); err != nil {
+		return err
+	}
+	if f.hold != nil {
+		select {
+		case <-f.hold:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := segment(1); err != nil {
+		return err
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+	return os.WriteFile(filepath.Join(dir, "index.m3u8"), []byte(playlist), 0644)
+}
+
+// useFakeTranscoder points the stream globals at tr, a fresh cache and a
+// temporary DataDir, restoring them when the test ends. Transcodes still
+// running then are cancelled so they don't hold transcodeSlots.
+func useFakeTranscoder(t *testing.T, tr Transcoder) {
+	t.Helper()
+	oldTr, oldStreams, oldDataDir := streamTranscoder, streams, DataDir
+	oldIdle, oldWait := streamIdleTimeout, streamWaitTimeout
+	streamTranscoder = tr
+	streams = &streamCache{ll: list.New(), entries: map[string]*list.Element{}, jobs: map[string]*hlsJob{}}
+	DataDir = t.TempDir()
+	t.Cleanup(func() {
+		streams.mu.Lock()
+		var running []*hlsJob
+		for _, j := range streams.jobs {
+			running = append(running, j)
+		}
+		streams.mu.Unlock()
+		for _, j := range running {
+			j.cancel()
+			<-j.done
+		}
+		streamTranscoder, streams, DataDir = oldTr, oldStreams, oldDataDir
+		streamIdleTimeout, streamWaitTimeout = oldIdle, oldWait
+	})
+}
+
+func waitJob(t *testing.T, j *hlsJob) {
+	t.Helper()
+	select {
+	case <-j.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("transcode did not finish")
+	}
+}
+
+func TestStreamEnsureRun(t *testing.T) {
+	tr := &fakeTranscoder{hold: make(chan struct{})}
+	useFakeTranscoder(t, tr)
+	dir := filepath.Join(DataDir, ".streams", "1.m1", "360p")
+	rd := hlsLadder[0]
+
+	j := streams.ensure("src.mp4", dir, rd, videoInfo{})
+	if j == nil {
+		t.Fatal("ensure of a missing rendition returned no job")
+	}
+	if again := streams.ensure("src.mp4", dir, rd, videoInfo{}); again != j {
+		t.Fatal("ensure while transcoding started a second job")
+	}
+	if _, running, _, _ := streams.stats(); running != 1 {
+		t.Fatalf("running = %d, want 1", running)
+	}
+
+	close(tr.hold)
+	waitJob(t, j)
+	if j.err != nil {
+		t.Fatalf("job err = %v", j.err)
+	}
+	if !playlistComplete(dir) {
+		t.Fatal("rendition is not complete")
+	}
+	if again := streams.ensure("src.mp4", dir, rd, videoInfo{}); again != nil {
+		t.Fatal("ensure of a cached rendition returned a job")
+	}
+	count, running, size, _ := streams.stats()
+	if count != 1 || running != 0 || size != dirSize(dir) {
+		t.Fatalf("stats = %d renditions, %d running, %d bytes", count, running, size)
+	}
+	if n := atomic.LoadInt32(&tr.calls); n != 1 {
+		t.Fatalf("Transcode called %d times, want 1", n)
+	}
+}
+
+func TestStreamEnsureFailure(t *testing.T) {
+	tr := &fakeTranscoder{err: errors.New("boom")}
+	useFakeTranscoder(t, tr)
+	dir := filepath.Join(DataDir, ".streams", "1.m1", "360p")
+
+	j := streams.ensure("src.mp4", dir, hlsLadder[0], videoInfo{})
+	waitJob(t, j)
+	if j.err == nil {
+		t.Fatal("job err = nil, want the transcoder's error")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatal("failed rendition was not removed")
+	}
+	// a failure is not cached; the next request tries again
+	if j2 := streams.ensure("src.mp4", dir, hlsLadder[0], videoInfo{}); j2 == nil {
+		t.Fatal("ensure after a failure returned no job")
+	} else {
+		waitJob(t, j2)
+	}
+	if n := atomic.LoadInt32(&tr.calls); n != 2 {
+		t.Fatalf("Transcode called %d times, want 2", n)
+	}
+}
+
+func TestStreamCacheEvictLRU(t *testing.T) {
+	useFakeTranscoder(t, &fakeTranscoder{})
+	rendition := func(name string) string {
+		dir := filepath.Join(DataDir, ".streams", name, "360p")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "seg_00000.ts"), make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	exists := func(dir string) bool {
+		_, err := os.Stat(dir)
+		return err == nil
+	}
+	streams.maxBytes = 250
+
+	a, b, c := rendition("1.m1"), rendition("2.m1"), rendition("3.m1")
+	streams.add(a)
+	streams.add(b)
+	// a is used again, so b is now the least recently used
+	if j := streams.ensure("src.mp4", a, hlsLadder[0], videoInfo{}); j != nil {
+		t.Fatal("ensure of a cached rendition returned a job")
+	}
+	streams.add(c)
+
+	if exists(b) || exists(filepath.Dir(b)) {
+		t.Error("least recently used rendition was not evicted")
+	}
+	if !exists(a) || !exists(c) {
+		t.Error("recently used renditions were evicted")
+	}
+	if count, _, size, _ := streams.stats(); count != 2 || size != 200 {
+		t.Errorf("stats = %d renditions, %d bytes, want 2, 200", count, size)
+	}
+
+	// the newest rendition is kept even when it alone is over the cap
+	streams.maxBytes = 50
+	streams.mu.Lock()
+	streams.evictLocked()
+	streams.mu.Unlock()
+	if count, _, _, _ := streams.stats(); count != 1 || !exists(c) {
+		t.Errorf("%d renditions left, want only the newest", count)
+	}
+}
+
+func TestStreamIdleCancel(t *testing.T) {
+	tr := &fakeTranscoder{hold: make(chan struct{})}
+	useFakeTranscoder(t, tr)
+	streamIdleTimeout = 40 * time.Millisecond
+	dir := filepath.Join(DataDir, ".streams", "1.m1", "360p")
+
+	j := streams.ensure("src.mp4", dir, hlsLadder[0], videoInfo{})
+	waitJob(t, j)
+	if j.err != context.Canceled {
+		t.Fatalf("job err = %v, want context.Canceled", j.err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatal("partial rendition was not removed")
+	}
+	if count, running, _, _ := streams.stats(); count != 0 || running != 0 {
+		t.Fatalf("stats = %d renditions, %d running, want none", count, running)
+	}
+}
+
+func TestStreamFileHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		tr         *fakeTranscoder
+		rendition  string
+		file       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"playlist", &fakeTranscoder{}, "360p", "index.m3u8", http.StatusOK, "#EXT-X-ENDLIST"},
+		{"segment", &fakeTranscoder{}, "360p", "seg_00001.ts", http.StatusOK, ""},
+		{"growing playlist", &fakeTranscoder{hold: make(chan struct{})}, "360p", "index.m3u8", http.StatusOK, "seg_00000.ts"},
+		{"segment not written yet", &fakeTranscoder{hold: make(chan struct{})}, "360p", "seg_00001.ts", http.StatusServiceUnavailable, ""},
+		{"transcode failed", &fakeTranscoder{err: errors.New("boom")}, "360p", "index.m3u8", http.StatusBadGateway, ""},
+		{"unknown rendition", &fakeTranscoder{}, "4k", "index.m3u8", http.StatusNotFound, ""},
+		{"bad file name", &fakeTranscoder{}, "360p", "../index.m3u8", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.tr.info = videoInfo{Width: 1280, Height: 720, Duration: 8}
+			useFakeTranscoder(t, tt.tr)
+			streamWaitTimeout = 300 * time.Millisecond
+			id := streamTestVideo(t)
+
+			req := httptest.NewRequest("GET", "/api/stream/", nil)
+			req = mux.SetURLVars(req, map[string]string{
+				"id": fmt.Sprint(id), "rendition": tt.rendition, "file": tt.file,
+			})
+			rec := httptest.NewRecorder()
+			StreamFileHandler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, strings.TrimSpace(rec.Body.String()))
+			}
+			if tt.wantBody != "" && !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Fatalf("body %q does not contain %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+// streamTestVideo catalogs an (empty) video in DataDir and returns its id
+func streamTestVideo(t *testing.T) int64 {
+	t.Helper()
+	db.InitDB(filepath.Join(DataDir, "test.db"))
+	t.Cleanup(func() { db.DB.Close() })
+	if err := os.WriteFile(filepath.Join(DataDir, "clip.mp4"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.DB.Exec(`INSERT INTO files(filename, filepath, mime) VALUES('clip.mp4', '/clip.mp4', 'video/mp4')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
@@ -0,0 +1,544 @@
+package api
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"localcloud/internal/db"
+	"localcloud/internal/middleware"
+)
+
+// The Subsonic REST API (https://www.subsonic.org/pages/api.jsp) lets
+// Subsonic/OpenSubsonic apps browse and play the music library of music.go.
+// IDs are strings: artists and albums are identified by their names, tracks
+// by their catalog row.
+
+const subsonicVersion = "1.16.1"
+
+// Subsonic error codes
+const (
+	subsonicErrGeneric  = 0
+	subsonicErrMissing  = 10
+	subsonicErrAuth     = 40
+	subsonicErrNotFound = 70
+)
+
+// subsonicIgnoredArticles are skipped when indexing artists by letter
+var subsonicIgnoredArticles = []string{"The", "El", "La", "Los", "Las", "Le", "Les"}
+
+// subsonicMethods are served at /rest/<method> and /rest/<method>.view
+var subsonicMethods = map[string]http.HandlerFunc{
+	"ping":            SubsonicPingHandler,
+	"getLicense":      SubsonicLicenseHandler,
+	"getMusicFolders": SubsonicMusicFoldersHandler,
+	"getArtists":      SubsonicArtistsHandler,
+	"getArtist":       SubsonicArtistHandler,
+	"getAlbum":        SubsonicAlbumHandler,
+	"search3":         SubsonicSearch3Handler,
+	"stream":          SubsonicStreamHandler,
+	"download":        SubsonicStreamHandler,
+	"getCoverArt":     SubsonicCoverArtHandler,
+}
+
+type subsonicResponse struct {
+	XMLName       xml.Name               `xml:"subsonic-response" json:"-"`
+	Xmlns         string                 `xml:"xmlns,attr" json:"-"`
+	Status        string                 `xml:"status,attr" json:"status"`
+	Version       string                 `xml:"version,attr" json:"version"`
+	Type          string                 `xml:"type,attr" json:"type"`
+	OpenSubsonic  bool                   `xml:"openSubsonic,attr" json:"openSubsonic"`
+	Error         *subsonicError         `xml:"error,omitempty" json:"error,omitempty"`
+	License       *subsonicLicense       `xml:"license,omitempty" json:"license,omitempty"`
+	MusicFolders  *subsonicMusicFolders  `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Artists       *subsonicArtists       `xml:"artists,omitempty" json:"artists,omitempty"`
+	Artist        *subsonicArtist        `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album         *subsonicAlbum         `xml:"album,omitempty" json:"album,omitempty"`
+	SearchResult3 *subsonicSearchResult3 `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+}
+
+type subsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type subsonicLicense struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type subsonicMusicFolders struct {
+	Folders []subsonicMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type subsonicMusicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type subsonicArtists struct {
+	IgnoredArticles string          `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []subsonicIndex `xml:"index" json:"index"`
+}
+
+type subsonicIndex struct {
+	Name    string           `xml:"name,attr" json:"name"`
+	Artists []subsonicArtist `xml:"artist" json:"artist"`
+}
+
+type subsonicArtist struct {
+	ID         string          `xml:"id,attr" json:"id"`
+	Name       string          `xml:"name,attr" json:"name"`
+	CoverArt   string          `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	AlbumCount int             `xml:"albumCount,attr" json:"albumCount"`
+	Albums     []subsonicAlbum `xml:"album,omitempty" json:"album,omitempty"`
+}
+
+type subsonicAlbum struct {
+	ID        string         `xml:"id,attr" json:"id"`
+	Name      string         `xml:"name,attr" json:"name"`
+	Artist    string         `xml:"artist,attr" json:"artist"`
+	ArtistID  string         `xml:"artistId,attr" json:"artistId"`
+	CoverArt  string         `xml:"coverArt,attr" json:"coverArt"`
+	SongCount int            `xml:"songCount,attr" json:"songCount"`
+	Duration  int            `xml:"duration,attr" json:"duration"`
+	Year      int            `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre     string         `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	Created   string         `xml:"created,attr,omitempty" json:"created,omitempty"`
+	Songs     []subsonicSong `xml:"song,omitempty" json:"song,omitempty"`
+}
+
+type subsonicSong struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr" json:"parent"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr" json:"album"`
+	Artist      string `xml:"artist,attr" json:"artist"`
+	Track       int    `xml:"track,attr,omitempty" json:"track,omitempty"`
+	DiscNumber  int    `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	Year        int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre       string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt    string `xml:"coverArt,attr" json:"coverArt"`
+	Size        int64  `xml:"size,attr" json:"size"`
+	ContentType string `xml:"contentType,attr" json:"contentType"`
+	Suffix      string `xml:"suffix,attr" json:"suffix"`
+	Duration    int    `xml:"duration,attr" json:"duration"`
+	BitRate     int    `xml:"bitRate,attr,omitempty" json:"bitRate,omitempty"` // kbit/s
+	Path        string `xml:"path,attr" json:"path"`
+	AlbumID     string `xml:"albumId,attr" json:"albumId"`
+	ArtistID    string `xml:"artistId,attr" json:"artistId"`
+	Type        string `xml:"type,attr" json:"type"`
+	IsVideo     bool   `xml:"isVideo,attr" json:"isVideo"`
+}
+
+type subsonicSearchResult3 struct {
+	Artists []subsonicArtist `xml:"artist" json:"artist,omitempty"`
+	Albums  []subsonicAlbum  `xml:"album" json:"album,omitempty"`
+	Songs   []subsonicSong   `xml:"song" json:"song,omitempty"`
+}
+
+// ---------------------- ids ----------------------
+
+func subsonicArtistID(name string) string {
+	return "ar-" + base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func subsonicAlbumID(artist, album string) string {
+	return "al-" + base64.RawURLEncoding.EncodeToString([]byte(artist+"\x00"+album))
+}
+
+func subsonicSongID(id int64) string {
+	return "tr-" + strconv.FormatInt(id, 10)
+}
+
+func parseSubsonicArtistID(id string) (string, bool) {
+	if !strings.HasPrefix(id, "ar-") {
+		return "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(id[3:])
+	return string(b), err == nil && len(b) > 0
+}
+
+func parseSubsonicAlbumID(id string) (artist, album string, ok bool) {
+	if !strings.HasPrefix(id, "al-") {
+		return "", "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(id[3:])
+	if err != nil {
+		return "", "", false
+	}
+	artist, album, ok = strings.Cut(string(b), "\x00")
+	return artist, album, ok
+}
+
+// subsonicFilePath maps a song, album or artist id to the API path of the
+// track to stream or take the cover art of
+func subsonicFilePath(id string) (string, bool) {
+	var p sql.NullString
+	var err error
+	switch {
+	case strings.HasPrefix(id, "tr-"):
+		n, perr := strconv.ParseInt(id[3:], 10, 64)
+		if perr != nil {
+			return "", false
+		}
+		err = db.DB.QueryRow(`SELECT filepath FROM files WHERE id = ? AND `+musicWhere, n).Scan(&p)
+	case strings.HasPrefix(id, "al-"):
+		artist, album, ok := parseSubsonicAlbumID(id)
+		if !ok {
+			return "", false
+		}
+		err = db.DB.QueryRow(`SELECT MIN(filepath) FROM files WHERE `+musicWhere+`
+			AND `+musicArtistExpr+` = ? AND `+musicAlbumExpr+` = ?`, artist, album).Scan(&p)
+	case strings.HasPrefix(id, "ar-"):
+		artist, ok := parseSubsonicArtistID(id)
+		if !ok {
+			return "", false
+		}
+		err = db.DB.QueryRow(`SELECT MIN(filepath) FROM files WHERE `+musicWhere+`
+			AND `+musicArtistExpr+` = ?`, artist).Scan(&p)
+	default:
+		return "", false
+	}
+	if err != nil || !p.Valid {
+		return "", false
+	}
+	// legacy rows store absolute paths
+	return relAPIPath(catalogAbs(p.String)), true
+}
+
+func toSubsonicAlbum(a musicAlbum) subsonicAlbum {
+	id := subsonicAlbumID(a.Artist, a.Name)
+	return subsonicAlbum{
+		ID: id, Name: a.Name, Artist: a.Artist, ArtistID: subsonicArtistID(a.Artist), CoverArt: id,
+		SongCount: a.Tracks, Duration: int(math.Round(a.Duration)), Year: a.Year, Genre: a.Genre, Created: a.Created,
+	}
+}
+
+func toSubsonicSong(t musicTrack) subsonicSong {
+	id, albumID := subsonicSongID(t.ID), subsonicAlbumID(t.AlbumArt, t.Album)
+	artist := t.Artist
+	if artist == "" {
+		artist = t.AlbumArt
+	}
+	return subsonicSong{
+		ID: id, Parent: albumID, Title: t.Title, Album: t.Album, Artist: artist,
+		Track: t.Track, DiscNumber: t.Disc, Year: t.Year, Genre: t.Genre, CoverArt: id,
+		Size: t.Size, ContentType: t.Mime, Suffix: strings.TrimPrefix(strings.ToLower(path.Ext(t.Path)), "."),
+		Duration: int(math.Round(t.Duration)), BitRate: int(t.Bitrate / 1000),
+		Path: strings.TrimPrefix(t.Path, "/"), AlbumID: albumID, ArtistID: subsonicArtistID(t.AlbumArt),
+		Type: "music",
+	}
+}
+
+// ---------------------- responses & auth ----------------------
+
+var jsonpCallback = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$.]*$`)
+
+// writeSubsonic writes resp as XML (the default), JSON or JSONP (f=). Errors
+// go out with status 200 too; clients look at the status attribute.
+func writeSubsonic(w http.ResponseWriter, r *http.Request, resp subsonicResponse) {
+	resp.Xmlns, resp.Version, resp.Type, resp.OpenSubsonic = "http://subsonic.org/restapi", subsonicVersion, "localcloud", true
+	if resp.Status == "" {
+		resp.Status = "ok"
+	}
+	switch f := r.FormValue("f"); f {
+	case "json", "jsonp":
+		b, err := json.Marshal(map[string]interface{}{"subsonic-response": resp})
+		if err != nil {
+			log.Printf("subsonic: encode: %v", err)
+			http.Error(w, "encode error", http.StatusInternalServerError)
+			return
+		}
+		if cb := r.FormValue("callback"); f == "jsonp" && jsonpCallback.MatchString(cb) {
+			w.Header().Set("Content-Type", "application/javascript")
+			io.WriteString(w, cb+"(")
+			w.Write(b)
+			io.WriteString(w, ");")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	default:
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		io.WriteString(w, xml.Header)
+		if err := xml.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("subsonic: encode: %v", err)
+		}
+	}
+}
+
+func subsonicFail(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	writeSubsonic(w, r, subsonicResponse{Status: "failed", Error: &subsonicError{Code: code, Message: msg}})
+}
+
+// subsonicAuth checks the u= user and either t= (md5 of password + s= salt)
+// or p= (plain or "enc:" hex-encoded password) against the localcloud
+// account; /rest/ is exempt from HTTP Basic auth.
+func subsonicAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, pass := middleware.Credentials()
+		u := r.FormValue("u")
+		if u == "" {
+			subsonicFail(w, r, subsonicErrMissing, "required parameter u is missing")
+			return
+		}
+		var ok bool
+		if t, s := r.FormValue("t"), r.FormValue("s"); t != "" && s != "" {
+			sum := md5.Sum([]byte(pass + s))
+			ok = subtle.ConstantTimeCompare([]byte(strings.ToLower(t)), []byte(hex.EncodeToString(sum[:]))) == 1
+		} else if p := r.FormValue("p"); p != "" {
+			if strings.HasPrefix(p, "enc:") {
+				b, err := hex.DecodeString(p[4:])
+				if err != nil {
+					subsonicFail(w, r, subsonicErrAuth, "wrong username or password")
+					return
+				}
+				p = string(b)
+			}
+			ok = subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+		} else {
+			subsonicFail(w, r, subsonicErrMissing, "required parameter t and s, or p, is missing")
+			return
+		}
+		if !ok || u != user {
+			subsonicFail(w, r, subsonicErrAuth, "wrong username or password")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// subsonicCount reads a count/offset parameter, clamped to [0, max]
+func subsonicCount(r *http.Request, key string, def, max int) int {
+	v, err := strconv.Atoi(r.FormValue(key))
+	if err != nil || v < 0 {
+		return def
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// subsonicIndexName is the letter an artist is listed under, ignoring
+// leading articles ("The Beatles" under B)
+func subsonicIndexName(name string) (index, sortName string) {
+	sortName = name
+	for _, a := range subsonicIgnoredArticles {
+		if len(name) > len(a)+1 && strings.EqualFold(name[:len(a)+1], a+" ") {
+			sortName = name[len(a)+1:]
+			break
+		}
+	}
+	if c, _ := utf8.DecodeRuneInString(sortName); unicode.IsLetter(c) {
+		return string(unicode.ToUpper(c)), sortName
+	}
+	return "#", sortName
+}
+
+// ---------------------- handlers ----------------------
+
+// SubsonicPingHandler checks connectivity and credentials.
+// GET /rest/ping
+func SubsonicPingHandler(w http.ResponseWriter, r *http.Request) {
+	writeSubsonic(w, r, subsonicResponse{})
+}
+
+// SubsonicLicenseHandler tells clients there is nothing to unlock.
+// GET /rest/getLicense
+func SubsonicLicenseHandler(w http.ResponseWriter, r *http.Request) {
+	writeSubsonic(w, r, subsonicResponse{License: &subsonicLicense{Valid: true}})
+}
+
+// SubsonicMusicFoldersHandler lists the one music folder: the library.
+// GET /rest/getMusicFolders
+func SubsonicMusicFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	writeSubsonic(w, r, subsonicResponse{MusicFolders: &subsonicMusicFolders{
+		Folders: []subsonicMusicFolder{{ID: 1, Name: "Music"}},
+	}})
+}
+
+// SubsonicArtistsHandler lists all album artists, indexed by letter.
+// GET /rest/getArtists
+func SubsonicArtistsHandler(w http.ResponseWriter, r *http.Request) {
+	artists, err := musicArtists("", -1, 0)
+	if err != nil {
+		log.Printf("subsonic: artists: %v", err)
+		subsonicFail(w, r, subsonicErrGeneric, "db error")
+		return
+	}
+	type entry struct {
+		sortName string
+		artist   subsonicArtist
+	}
+	byIndex := map[string][]entry{}
+	for _, a := range artists {
+		index, sortName := subsonicIndexName(a.Name)
+		id := subsonicArtistID(a.Name)
+		byIndex[index] = append(byIndex[index], entry{sortName, subsonicArtist{ID: id, Name: a.Name, CoverArt: id, AlbumCount: a.Albums}})
+	}
+	res := &subsonicArtists{IgnoredArticles: strings.Join(subsonicIgnoredArticles, " "), Index: []subsonicIndex{}}
+	for index, entries := range byIndex {
+		sort.Slice(entries, func(i, j int) bool {
+			return strings.ToLower(entries[i].sortName) < strings.ToLower(entries[j].sortName)
+		})
+		idx := subsonicIndex{Name: index}
+		for _, e := range entries {
+			idx.Artists = append(idx.Artists, e.artist)
+		}
+		res.Index = append(res.Index, idx)
+	}
+	sort.Slice(res.Index, func(i, j int) bool { return res.Index[i].Name < res.Index[j].Name })
+	writeSubsonic(w, r, subsonicResponse{Artists: res})
+}
+
+// SubsonicArtistHandler lists the albums of an artist.
+// GET /rest/getArtist?id=ar-...
+func SubsonicArtistHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := parseSubsonicArtistID(r.FormValue("id"))
+	if !ok {
+		subsonicFail(w, r, subsonicErrNotFound, "artist not found")
+		return
+	}
+	albums, err := musicAlbums(name, "", -1, 0)
+	if err != nil {
+		log.Printf("subsonic: artist: %v", err)
+		subsonicFail(w, r, subsonicErrGeneric, "db error")
+		return
+	}
+	if len(albums) == 0 {
+		subsonicFail(w, r, subsonicErrNotFound, "artist not found")
+		return
+	}
+	id := subsonicArtistID(name)
+	res := &subsonicArtist{ID: id, Name: name, CoverArt: id, AlbumCount: len(albums)}
+	for _, a := range albums {
+		res.Albums = append(res.Albums, toSubsonicAlbum(a))
+	}
+	writeSubsonic(w, r, subsonicResponse{Artist: res})
+}
+
+// SubsonicAlbumHandler lists the songs of an album.
+// GET /rest/getAlbum?id=al-...
+func SubsonicAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	artist, album, ok := parseSubsonicAlbumID(r.FormValue("id"))
+	if !ok {
+		subsonicFail(w, r, subsonicErrNotFound, "album not found")
+		return
+	}
+	albums, err := musicAlbums(artist, album, -1, 0)
+	if err != nil {
+		log.Printf("subsonic: album: %v", err)
+		subsonicFail(w, r, subsonicErrGeneric, "db error")
+		return
+	}
+	var res *subsonicAlbum
+	for _, a := range albums {
+		if a.Name == album {
+			sa := toSubsonicAlbum(a)
+			res = &sa
+		}
+	}
+	if res == nil {
+		subsonicFail(w, r, subsonicErrNotFound, "album not found")
+		return
+	}
+	tracks, err := musicTracks(artist, album)
+	if err != nil {
+		log.Printf("subsonic: album: %v", err)
+		subsonicFail(w, r, subsonicErrGeneric, "db error")
+		return
+	}
+	for _, t := range tracks {
+		res.Songs = append(res.Songs, toSubsonicSong(t))
+	}
+	writeSubsonic(w, r, subsonicResponse{Album: res})
+}
+
+// SubsonicSearch3Handler searches artists, albums and songs by name. An
+// empty query ("" or `""`) lists everything, which clients use to sync.
+// GET /rest/search3?query=abba&artistCount=20&albumCount=20&songCount=20
+func SubsonicSearch3Handler(w http.ResponseWriter, r *http.Request) {
+	q := strings.Trim(strings.TrimSpace(r.FormValue("query")), `"`)
+	res := &subsonicSearchResult3{}
+	artists, err := musicArtists(q, subsonicCount(r, "artistCount", 20, 500), subsonicCount(r, "artistOffset", 0, math.MaxInt32))
+	if err == nil {
+		for _, a := range artists {
+			id := subsonicArtistID(a.Name)
+			res.Artists = append(res.Artists, subsonicArtist{ID: id, Name: a.Name, CoverArt: id, AlbumCount: a.Albums})
+		}
+		var albums []musicAlbum
+		albums, err = musicAlbums("", q, subsonicCount(r, "albumCount", 20, 500), subsonicCount(r, "albumOffset", 0, math.MaxInt32))
+		for _, a := range albums {
+			res.Albums = append(res.Albums, toSubsonicAlbum(a))
+		}
+	}
+	if err == nil {
+		like := "%" + q + "%"
+		var tracks []musicTrack
+		tracks, err = queryMusicTracks(` AND (COALESCE(song_title, filename) LIKE ? OR COALESCE(artist, '') LIKE ? OR COALESCE(album, '') LIKE ?)
+			ORDER BY `+musicArtistExpr+` COLLATE NOCASE, `+musicAlbumExpr+` COLLATE NOCASE,
+				COALESCE(disc, 1), COALESCE(track, 9999), filename COLLATE NOCASE
+			LIMIT ? OFFSET ?`, like, like, like,
+			subsonicCount(r, "songCount", 20, 500), subsonicCount(r, "songOffset", 0, math.MaxInt32))
+		for _, t := range tracks {
+			res.Songs = append(res.Songs, toSubsonicSong(t))
+		}
+	}
+	if err != nil {
+		log.Printf("subsonic: search3: %v", err)
+		subsonicFail(w, r, subsonicErrGeneric, "db error")
+		return
+	}
+	writeSubsonic(w, r, subsonicResponse{SearchResult3: res})
+}
+
+// SubsonicStreamHandler plays or downloads a song through FileHandler, with
+// range requests; the original file is served, so format and maxBitRate
+// are ignored.
+// GET /rest/stream?id=tr-42
+func SubsonicStreamHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := subsonicFilePath(r.FormValue("id"))
+	if !ok {
+		subsonicFail(w, r, subsonicErrNotFound, "song not found")
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.RawQuery = url.Values{"path": {p}}.Encode()
+	FileHandler(w, r2)
+}
+
+// SubsonicCoverArtHandler serves the cover of a song, album or artist from
+// the thumbnail cache.
+// GET /rest/getCoverArt?id=al-...&size=300
+func SubsonicCoverArtHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := subsonicFilePath(r.FormValue("id"))
+	if !ok {
+		subsonicFail(w, r, subsonicErrNotFound, "cover art not found")
+		return
+	}
+	size := thumbRenditions[len(thumbRenditions)-2]
+	if v, err := strconv.Atoi(r.FormValue("size")); err == nil && v > 0 {
+		size = v
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.RawQuery = url.Values{"path": {p}, "w": {strconv.Itoa(nearestRendition(size))}, "format": {thumbJPEG}}.Encode()
+	ThumbnailHandler(w, r2)
+}
@@ -0,0 +1,363 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Subtitles come from two places: files next to the video sharing its base
+// name ("Movie.srt", "Movie.en.srt", "Movie.de.forced.vtt") and text subtitle
+// streams inside the container (MKV, MP4 mov_text). Every track is served as
+// WebVTT, the only caption format browsers take. Tracks are identified by
+// "f:<file name>" or "s:<stream index>".
+
+// subtitleExts are the sidecar formats we serve; .srt and .vtt are converted
+// in-process, the others through ffmpeg
+var subtitleExts = map[string]bool{".srt": true, ".vtt": true, ".ass": true, ".ssa": true}
+
+// textSubtitleCodecs are the embedded codecs ffmpeg converts to WebVTT;
+// bitmap subtitles (PGS, VobSub, DVB) can't be and are left out
+var textSubtitleCodecs = map[string]bool{"subrip": true, "mov_text": true, "ass": true, "ssa": true, "webvtt": true, "text": true}
+
+// subtitleTrack is one entry of /api/subtitles
+type subtitleTrack struct {
+	ID       string `json:"id"`
+	Label    string `json:"label"`
+	Language string `json:"language,omitempty"`
+	Source   string `json:"source"` // "file" or "embedded"
+	Format   string `json:"format"` // "srt", "subrip", "mov_text", ...
+	Default  bool   `json:"default,omitempty"`
+	Forced   bool   `json:"forced,omitempty"`
+	URL      string `json:"url"`
+}
+
+// subtitleFlags are name parts that describe a sidecar rather than its language
+var subtitleFlags = map[string]bool{"forced": true, "sdh": true, "cc": true, "hi": true, "default": true}
+
+// sidecarSubtitles lists subtitle files next to video abs named after it
+func sidecarSubtitles(abs string) []subtitleTrack {
+	dir, name := filepath.Split(abs)
+	stem := strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+	videoExt := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var out []subtitleTrack
+	for _, e := range entries {
+		n := e.Name()
+		ext := strings.ToLower(filepath.Ext(n))
+		lower := strings.ToLower(n)
+		if e.IsDir() || !subtitleExts[ext] || shouldIgnoreFile(n) || !strings.HasPrefix(lower, stem+".") {
+			continue
+		}
+		t := subtitleTrack{ID: "f:" + n, Source: "file", Format: strings.TrimPrefix(ext, ".")}
+		// "Movie.mkv.en.forced.srt" -> ["mkv", "en", "forced"], "Movie.srt" -> []
+		var parts []string
+		if base := strings.TrimSuffix(lower, ext); len(base) > len(stem) {
+			parts = strings.Split(base[len(stem)+1:], ".")
+		}
+		for _, part := range parts {
+			switch {
+			case part == "" || part == videoExt:
+			case part == "forced":
+				t.Forced = true
+			case subtitleFlags[part]:
+			case t.Language == "" && len(part) >= 2 && len(part) <= 3:
+				t.Language = part
+			}
+		}
+		t.Label = subtitleLabel(t.Language, n)
+		if t.Forced {
+			t.Label += " (forced)"
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// subtitleLabel names a track for the player menu
+func subtitleLabel(lang, fallback string) string {
+	if lang != "" {
+		return strings.ToUpper(lang)
+	}
+	return fallback
+}
+
+// subtitleStream is a subtitle stream reported by ffprobe
+type subtitleStream struct {
+	Index   int
+	Codec   string
+	Lang    string
+	Title   string
+	Default bool
+	Forced  bool
+}
+
+// probeSubtitleStreams lists the subtitle streams of abs.
+func probeSubtitleStreams(abs string) ([]subtitleStream, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "s",
+		"-show_entries", "stream=index,codec_name:stream_tags=language,title:stream_disposition=default,forced",
+		"-of", "json", abs).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	var probe struct {
+		Streams []struct {
+			Index       int               `json:"index"`
+			CodecName   string            `json:"codec_name"`
+			Tags        map[string]string `json:"tags"`
+			Disposition map[string]int    `json:"disposition"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	var streams []subtitleStream
+	for _, s := range probe.Streams {
+		lang := s.Tags["language"]
+		if lang == "und" {
+			lang = ""
+		}
+		streams = append(streams, subtitleStream{Index: s.Index, Codec: s.CodecName, Lang: lang, Title: s.Tags["title"],
+			Default: s.Disposition["default"] == 1, Forced: s.Disposition["forced"] == 1})
+	}
+	return streams, nil
+}
+
+// subtitleProbes caches probeSubtitleStreams per file version
+var subtitleProbes = struct {
+	sync.Mutex
+	m map[string][]subtitleStream
+}{m: map[string][]subtitleStream{}}
+
+// embeddedSubtitles lists the text subtitle streams of video abs
+func embeddedSubtitles(abs string) []subtitleTrack {
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil
+	}
+	key := abs + "\x00" + thumbKey(fi.ModTime())
+	subtitleProbes.Lock()
+	streams, ok := subtitleProbes.m[key]
+	subtitleProbes.Unlock()
+	if !ok {
+		if streams, err = probeSubtitleStreams(abs); err != nil {
+			return nil
+		}
+		subtitleProbes.Lock()
+		subtitleProbes.m[key] = streams
+		subtitleProbes.Unlock()
+	}
+	var out []subtitleTrack
+	for _, s := range streams {
+		if !textSubtitleCodecs[s.Codec] {
+			continue
+		}
+		t := subtitleTrack{ID: "s:" + strconv.Itoa(s.Index), Language: s.Lang, Source: "embedded",
+			Format: s.Codec, Default: s.Default, Forced: s.Forced}
+		t.Label = s.Title
+		if t.Label == "" {
+			t.Label = subtitleLabel(s.Lang, fmt.Sprintf("Track %d", s.Index))
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// videoSubtitles lists every subtitle track of abs, sidecar files first,
+// with their WebVTT URLs for the video at apiPath
+func videoSubtitles(abs, apiPath string) []subtitleTrack {
+	tracks := sidecarSubtitles(abs)
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].ID < tracks[j].ID })
+	tracks = append(tracks, embeddedSubtitles(abs)...)
+	for i := range tracks {
+		tracks[i].URL = subtitleURL(apiPath, tracks[i].ID)
+	}
+	return tracks
+}
+
+// subtitleURL serves one track as WebVTT
+func subtitleURL(apiPath, id string) string {
+	return "/api/subtitles/vtt?path=" + url.QueryEscape(apiPath) + "&track=" + url.QueryEscape(id)
+}
+
+// ---------------------- conversion ----------------------
+
+// srtTiming matches SRT cue timings ("00:01:02,500 --> 00:01:04,000")
+var srtTiming = regexp.MustCompile(`^(\d+:\d{2}:\d{2})[,.](\d{3})\s*-->\s*(\d+:\d{2}:\d{2})[,.](\d{3})(.*)$`)
+
+// subtitleText decodes a subtitle file: strips a UTF-8 BOM, normalizes line
+// endings and treats non-UTF-8 files as Latin-1, which most legacy .srt
+// downloads are close enough to.
+func subtitleText(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	s := string(data)
+	if !utf8.Valid(data) {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		s = string(runes)
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\r", "\n")
+}
+
+// srtToVTT converts SubRip to WebVTT: a header, and "." instead of "," in
+// timings. Cue numbers are valid WebVTT cue identifiers and stay.
+func srtToVTT(data []byte) []byte {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, line := range strings.Split(subtitleText(data), "\n") {
+		if m := srtTiming.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			line = fmt.Sprintf("%s.%s --> %s.%s%s", m[1], m[2], m[3], m[4], m[5])
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// ffmpegToVTT converts stream index of src (0 for a subtitle file) to WebVTT.
+func ffmpegToVTT(src string, index int) ([]byte, error) {
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error", "-nostdin", "-i", src,
+		"-map", "0:"+strconv.Itoa(index), "-f", "webvtt", "pipe:1")
+	var out, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out.Bytes(), nil
+}
+
+// subtitleVTT returns track id of video abs as WebVTT. Embedded tracks are
+// extracted once and kept in the thumbnail cache.
+func subtitleVTT(abs, id string) ([]byte, error) {
+	kind, ref, _ := strings.Cut(id, ":")
+	switch kind {
+	case "f":
+		// only sidecars discovery returns, never an arbitrary file
+		var found bool
+		for _, t := range sidecarSubtitles(abs) {
+			if t.ID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, os.ErrNotExist
+		}
+		p := filepath.Join(filepath.Dir(abs), ref)
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(filepath.Ext(ref)) {
+		case ".srt":
+			return srtToVTT(data), nil
+		case ".vtt":
+			return []byte(subtitleText(data)), nil
+		}
+		return ffmpegToVTT(p, 0)
+	case "s":
+		index, err := strconv.Atoi(ref)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+		var found bool
+		for _, t := range embeddedSubtitles(abs) {
+			if t.ID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, os.ErrNotExist
+		}
+		dst := thumbVariantPath(thumbCachePath(abs, fmt.Sprintf("sub%d", index)), "vtt")
+		defer thumbs.pin(dst)()
+		err = generateOnce(dst, func() error {
+			data, err := ffmpegToVTT(abs, index)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(dst+".tmp", data, 0644); err != nil {
+				return err
+			}
+			if err := os.Rename(dst+".tmp", dst); err != nil {
+				return err
+			}
+			thumbs.add(dst)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		thumbs.touch(dst)
+		return os.ReadFile(dst)
+	}
+	return nil, os.ErrNotExist
+}
+
+// ---------------------- handlers ----------------------
+
+// SubtitlesHandler lists the subtitle tracks of a video: files next to it
+// named after it, then text streams inside it.
+// GET /api/subtitles?path=/movies/Movie.mkv
+func SubtitlesHandler(w http.ResponseWriter, r *http.Request) {
+	abs, ok := videoTarget(w, r)
+	if !ok {
+		return
+	}
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{"tracks": videoSubtitles(abs, relAPIPath(abs))})
+}
+
+// SubtitleVTTHandler serves one subtitle track as WebVTT, for <track> elements.
+// GET /api/subtitles/vtt?path=/movies/Movie.mkv&track=f:Movie.en.srt
+func SubtitleVTTHandler(w http.ResponseWriter, r *http.Request) {
+	abs, ok := videoTarget(w, r)
+	if !ok {
+		return
+	}
+	data, err := subtitleVTT(abs, r.URL.Query().Get("track"))
+	if os.IsNotExist(err) {
+		http.Error(w, "no such track", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "subtitle conversion failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(data)
+}
+
+// setCaptionInfo points DLNA renderers that ask for captions (Samsung's
+// getcaptionInfo.sec request header) at the first subtitle track of abs.
+func setCaptionInfo(w http.ResponseWriter, r *http.Request, abs string) {
+	if r.Header.Get("getcaptionInfo.sec") != "1" || !strings.HasPrefix(mimeTypeFor(abs), "video/") {
+		return
+	}
+	tracks := videoSubtitles(abs, relAPIPath(abs))
+	if len(tracks) == 0 {
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	w.Header().Set("CaptionInfo.sec", scheme+"://"+r.Host+tracks[0].URL)
+}
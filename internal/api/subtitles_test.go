@@ -0,0 +1,85 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSidecarSubtitles(t *testing.T) {
+	tests := []struct {
+		file     string
+		language string
+		forced   bool
+		label    string
+		format   string
+	}{
+		{"Movie.srt", "", false, "Movie.srt", "srt"},
+		{"Movie.vtt", "", false, "Movie.vtt", "vtt"},
+		{"movie.ASS", "", false, "movie.ASS", "ass"},
+		{"Movie.en.srt", "en", false, "EN", "srt"},
+		{"Movie.de.forced.vtt", "de", true, "DE (forced)", "vtt"},
+		{"Movie.forced.srt", "", true, "Movie.forced.srt (forced)", "srt"},
+		{"Movie.mkv.en.srt", "en", false, "EN", "srt"},
+		{"Movie.eng.sdh.srt", "eng", false, "ENG", "srt"},
+		{"Movie.English.srt", "", false, "Movie.English.srt", "srt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, n := range []string{"Movie.mkv", tt.file} {
+				if err := os.WriteFile(filepath.Join(dir, n), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tracks := sidecarSubtitles(filepath.Join(dir, "Movie.mkv"))
+			if len(tracks) != 1 {
+				t.Fatalf("got %d tracks, want 1", len(tracks))
+			}
+			tr := tracks[0]
+			if tr.ID != "f:"+tt.file || tr.Language != tt.language || tr.Forced != tt.forced || tr.Label != tt.label || tr.Format != tt.format {
+				t.Errorf("got %+v", tr)
+			}
+		})
+	}
+}
+
+func TestSidecarSubtitlesOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, n := range []string{"Movie.mkv", "Movie 2.srt", "Movies.en.srt", "Movie.txt", "Other.srt"} {
+		if err := os.WriteFile(filepath.Join(dir, n), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tracks := sidecarSubtitles(filepath.Join(dir, "Movie.mkv")); len(tracks) != 0 {
+		t.Errorf("got %+v, want no tracks", tracks)
+	}
+}
+
+func TestSrtToVTT(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"basic",
+			"1\n00:00:01,000 --> 00:00:02,500\nHello\n\n2\n00:01:02,250 --> 00:01:04,000\nWorld\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.500\nHello\n\n2\n00:01:02.250 --> 00:01:04.000\nWorld\n\n"},
+		{"CRLF and BOM",
+			"\xef\xbb\xbf1\r\n00:00:01,000 --> 00:00:02,000\r\nHi\r\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nHi\n\n"},
+		{"Latin-1",
+			"1\n00:00:01,000 --> 00:00:02,000\nCaf\xe9\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nCafé\n\n"},
+		{"positions and long hours kept",
+			"1\n100:00:01,000-->100:00:02,000 X1:10 X2:20\nText\n",
+			"WEBVTT\n\n1\n100:00:01.000 --> 100:00:02.000 X1:10 X2:20\nText\n\n"},
+		{"text that looks like a timing is left alone",
+			"1\n00:00:01,000 --> 00:00:02,000\nAt 10:00:00,000 sharp\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nAt 10:00:00,000 sharp\n\n"},
+		{"empty", "", "WEBVTT\n\n\n"},
+	}
+	for _, tt := range tests {
+		if got := string(srtToVTT([]byte(tt.in))); got != tt.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -66,6 +67,10 @@ func InitSyncDB() error {
 		"retry_count":   "INTEGER DEFAULT 0",
 		"exif_datetime": "TEXT",
 		"camera_model":  "TEXT",
+		// size and mtime the sha256 was taken at, so the scrubber can tell
+		// edits from corruption
+		"size":  "INTEGER",
+		"mtime": "TEXT",
 	}
 
 	for col, def := range toAdd {
@@ -147,6 +152,13 @@ func SyncUploadHandler(w http.ResponseWriter, r *http.Request) {
 	// check duplicate by SHA256
 	var existingPath string
 	err = db.DB.QueryRow("SELECT filepath FROM media WHERE sha256 = ? LIMIT 1", sum).Scan(&existingPath)
+	if err != nil || existingPath == "" {
+		// not synced before; it may still be in the library via upload or indexing
+		var catalogPath string
+		if err = db.DB.QueryRow("SELECT filepath FROM files WHERE sha256 = ? LIMIT 1", sum).Scan(&catalogPath); err == nil {
+			existingPath = relAPIPath(resolveFile(catalogAbs(catalogPath)))
+		}
+	}
 	if err == nil && existingPath != "" {
 		// duplicate found -> remove tmp and return skipped
 		_ = os.Remove(tmpPath)
@@ -179,41 +191,59 @@ func SyncUploadHandler(w http.ResponseWriter, r *http.Request) {
 		_ = os.Remove(tmpPath)
 	}
 
-	// extract EXIF for JPEGs
+	// extract EXIF for JPEGs and HEIC/HEIF
 	var exifDate, cameraModel string
 	ext := strings.ToLower(filepath.Ext(finalPath))
-	if ext == ".jpg" || ext == ".jpeg" {
-		if f2, err := os.Open(finalPath); err == nil {
-			if x, err := exif.Decode(f2); err == nil {
-				if dt, err := x.DateTime(); err == nil {
-					exifDate = dt.Format(time.RFC3339)
-				}
-				if m, err := x.Get(exif.Model); err == nil {
-					if s, err := m.StringVal(); err == nil {
-						cameraModel = s
-					}
+	if hasExif(ext) {
+		if x, err := readExif(finalPath); err == nil {
+			if dt, err := x.DateTime(); err == nil {
+				exifDate = dt.Format(takenLayout)
+			}
+			if m, err := x.Get(exif.Model); err == nil {
+				if s, err := m.StringVal(); err == nil {
+					cameraModel = s
 				}
 			}
-			_ = f2.Close()
 		}
 	}
 
 	// insert into media table including exif fields
+	var size, mtime interface{}
+	if fi, err := os.Stat(finalPath); err == nil {
+		size, mtime = fi.Size(), fi.ModTime().UTC().Format(time.RFC3339)
+	}
 	res, err := db.DB.Exec(`
-		INSERT INTO media(filename, filepath, sha256, device_id, exif_datetime, camera_model) 
-		VALUES(?, ?, ?, ?, ?, ?)`,
-		filepath.Base(finalPath), finalPath, sum, deviceID, exifDate, cameraModel)
+		INSERT INTO media(filename, filepath, sha256, device_id, exif_datetime, camera_model, size, mtime) 
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		filepath.Base(finalPath), finalPath, sum, deviceID, exifDate, cameraModel, size, mtime)
 	if err != nil {
 		// log but continue
 		fmt.Println("db insert error:", err)
 	}
 	lastID, _ := res.LastInsertId()
 
+	// register in the library catalog with its hash so dedup covers sync uploads
+	if fi, err := os.Stat(finalPath); err == nil {
+		now := time.Now().UTC().Format(time.RFC3339)
+		_, err = db.DB.Exec(`
+			INSERT OR IGNORE INTO files(filename, filepath, mime, uploaded_at, size, mtime, sha256, hashed_at, exif_datetime, camera_model)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			filepath.Base(finalPath), relAPIPath(finalPath), mime.TypeByExtension(ext), now,
+			fi.Size(), fi.ModTime().UTC().Format(time.RFC3339), sum, now, exifDate, cameraModel)
+		if err != nil {
+			fmt.Println("catalog insert error:", err)
+		}
+	}
+
 	// enqueue backup job (background worker will copy to backup dir)
 	EnqueueBackup(finalPath, lastID)
 
 	// enqueue thumbnail generation if thumbnail worker is running
 	EnqueueThumbnail(finalPath)
+	// smart albums watching for this kind of item hear about it once its
+	// metadata is in the catalog
+	EnqueueMetadata(finalPath, true)
+	EnqueueProxy(finalPath, false)
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(map[string]interface{}{
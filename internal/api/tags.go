@@ -0,0 +1,345 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"localcloud/internal/db"
+)
+
+// InitTagsDB ensures the tags and file_tags tables exist.
+// Call once after db.InitDB()
+func InitTagsDB() error {
+	_, err := db.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		created_at DATETIME DEFAULT (datetime('now'))
+	);
+	CREATE TABLE IF NOT EXISTS file_tags (
+		file_id INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+		tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+		source TEXT NOT NULL DEFAULT 'user',
+		added_at DATETIME DEFAULT (datetime('now')),
+		PRIMARY KEY (file_id, tag_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_file_tags_tag ON file_tags(tag_id);
+	CREATE INDEX IF NOT EXISTS idx_files_favorite ON files(favorite);
+	`)
+	return err
+}
+
+// tag sources: set through the API, or imported from XMP dc:subject
+const (
+	tagSourceUser = "user"
+	tagSourceXMP  = "xmp"
+)
+
+// maxTagLen bounds tag names; longer ones are almost certainly pasted junk
+const maxTagLen = 64
+
+// normalizeTag trims a tag name and collapses inner whitespace.
+// Returns "" for names that can't be stored.
+func normalizeTag(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	if len(name) > maxTagLen {
+		return ""
+	}
+	return name
+}
+
+// tagID returns the id of tag name, creating it if needed
+func tagID(q interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+	QueryRow(string, ...interface{}) *sql.Row
+}, name string) (int64, error) {
+	if _, err := q.Exec("INSERT OR IGNORE INTO tags(name) VALUES(?)", name); err != nil {
+		return 0, err
+	}
+	var id int64
+	err := q.QueryRow("SELECT id FROM tags WHERE name = ?", name).Scan(&id)
+	return id, err
+}
+
+// fileTags returns the tag names of a catalog row, sorted
+func fileTags(fid int64) []string {
+	rows, err := db.DB.Query(`SELECT t.name FROM file_tags ft JOIN tags t ON t.id = ft.tag_id
+		WHERE ft.file_id = ? ORDER BY t.name COLLATE NOCASE`, fid)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var n string
+		if err := rows.Scan(&n); err == nil {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// importXMPTags makes the XMP-sourced tags of abs match keywords. Tags added
+// by hand are never removed; a keyword the user already added stays theirs.
+func importXMPTags(abs string, keywords []string) error {
+	fid := catalogFileID(abs)
+	if fid == 0 {
+		return nil
+	}
+	return syncFileTags(fid, keywords, false)
+}
+
+// syncFileTags adds keywords to a catalog row as XMP-sourced tags and drops
+// XMP-sourced tags not among them. With all, hand-added tags not among them
+// are dropped as well, making keywords the complete tag set.
+func syncFileTags(fid int64, keywords []string, all bool) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	keep := []interface{}{fid}
+	for _, k := range keywords {
+		if k = normalizeTag(k); k == "" {
+			continue
+		}
+		tid, err := tagID(tx, k)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO file_tags(file_id, tag_id, source) VALUES(?, ?, ?)", fid, tid, tagSourceXMP); err != nil {
+			return err
+		}
+		keep = append(keep, tid)
+	}
+	stale := "DELETE FROM file_tags WHERE file_id = ?"
+	if !all {
+		stale += " AND source = '" + tagSourceXMP + "'"
+	}
+	if len(keep) > 1 {
+		stale += " AND tag_id NOT IN (?" + strings.Repeat(", ?", len(keep)-2) + ")"
+	}
+	if _, err := tx.Exec(stale, keep...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// pruneTags drops tags no asset uses anymore
+func pruneTags() {
+	if _, err := db.DB.Exec("DELETE FROM tags WHERE id NOT IN (SELECT DISTINCT tag_id FROM file_tags)"); err != nil {
+		log.Printf("tags: prune: %v", err)
+	}
+}
+
+// TagsHandler lists tags with usage counts, most used first. With prefix it
+// serves autocomplete: names starting with prefix, then ones containing it.
+// GET /api/tags?prefix=pass&limit=10
+func TagsHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("prefix")))
+	limit := 200
+	if prefix != "" {
+		limit = 10
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+	qry := `SELECT t.name, COUNT(ft.file_id) AS n FROM tags t
+		LEFT JOIN file_tags ft ON ft.tag_id = t.id`
+	args := []interface{}{}
+	order := " ORDER BY n DESC, t.name COLLATE NOCASE"
+	if prefix != "" {
+		qry += " WHERE LOWER(t.name) LIKE ?"
+		args = append(args, "%"+prefix+"%")
+		order = " ORDER BY LOWER(t.name) LIKE ? DESC, n DESC, t.name COLLATE NOCASE"
+		args = append(args, prefix+"%")
+	}
+	qry += " GROUP BY t.id" + order + " LIMIT ?"
+	args = append(args, limit)
+	rows, err := db.DB.Query(qry, args...)
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	tags := []map[string]interface{}{}
+	for rows.Next() {
+		var name string
+		var n int
+		if err := rows.Scan(&name, &n); err == nil {
+			tags = append(tags, map[string]interface{}{"name": name, "count": n})
+		}
+	}
+	writeAlbumJSON(w, http.StatusOK, map[string]interface{}{"tags": tags})
+}
+
+// bulkRequest is the body of the bulk-apply endpoints
+type bulkRequest struct {
+	Paths    []string `json:"paths"`
+	Add      []string `json:"add"`
+	Remove   []string `json:"remove"`
+	Favorite *bool    `json:"favorite"`
+	Rating   *int     `json:"rating"`
+}
+
+// bulkApply resolves req.Paths to catalog ids and runs apply on each inside
+// one transaction. Paths that can't be resolved are reported, not fatal.
+// With sidecar, the XMP sidecars of changed assets are rewritten afterwards.
+func bulkApply(w http.ResponseWriter, req bulkRequest, sidecar bool, apply func(tx *sql.Tx, fid int64) (bool, error)) {
+	if len(req.Paths) == 0 {
+		http.Error(w, "paths required", http.StatusBadRequest)
+		return
+	}
+	errs := map[string]string{}
+	var ids []int64
+	var paths []string
+	for _, p := range req.Paths {
+		fid, err := catalogIDForPath(p)
+		if err != nil {
+			errs[p] = err.Error()
+			continue
+		}
+		ids = append(ids, fid)
+		paths = append(paths, p)
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var changed []int64
+	for i, fid := range ids {
+		ok, err := apply(tx, fid)
+		if err != nil {
+			errs[paths[i]] = err.Error()
+			continue
+		}
+		if ok {
+			changed = append(changed, fid)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if sidecar {
+		writeSidecars(changed)
+	}
+	resp := map[string]interface{}{"changed": len(changed)}
+	if len(errs) > 0 {
+		resp["errors"] = errs
+	}
+	writeAlbumJSON(w, http.StatusOK, resp)
+}
+
+// TagsApplyHandler adds and/or removes tags on many assets at once.
+// POST /api/tags/apply  {"paths":["/a.jpg"],"add":["passport"],"remove":["todo"]}
+func TagsApplyHandler(w http.ResponseWriter, r *http.Request) {
+	var req bulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	var add, remove []string
+	for _, t := range req.Add {
+		if t = normalizeTag(t); t != "" {
+			add = append(add, t)
+		}
+	}
+	for _, t := range req.Remove {
+		if t = normalizeTag(t); t != "" {
+			remove = append(remove, t)
+		}
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		http.Error(w, "add or remove required", http.StatusBadRequest)
+		return
+	}
+	bulkApply(w, req, true, func(tx *sql.Tx, fid int64) (bool, error) {
+		changed := false
+		for _, t := range add {
+			tid, err := tagID(tx, t)
+			if err != nil {
+				return changed, err
+			}
+			// tagging by hand claims an imported tag so re-imports keep it
+			res, err := tx.Exec(`INSERT INTO file_tags(file_id, tag_id, source) VALUES(?, ?, ?)
+				ON CONFLICT(file_id, tag_id) DO UPDATE SET source = excluded.source WHERE source != excluded.source`,
+				fid, tid, tagSourceUser)
+			if err != nil {
+				return changed, err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				changed = true
+			}
+		}
+		for _, t := range remove {
+			res, err := tx.Exec("DELETE FROM file_tags WHERE file_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?)", fid, t)
+			if err != nil {
+				return changed, err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+	if len(remove) > 0 {
+		pruneTags()
+	}
+}
+
+// FavoritesHandler marks or unmarks many assets as favorites.
+// POST /api/favorites  {"paths":["/a.jpg"],"favorite":true}
+func FavoritesHandler(w http.ResponseWriter, r *http.Request) {
+	var req bulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Favorite == nil {
+		http.Error(w, "favorite required", http.StatusBadRequest)
+		return
+	}
+	fav := 0
+	if *req.Favorite {
+		fav = 1
+	}
+	// favorites have no XMP property; they stay in the catalog
+	bulkApply(w, req, false, func(tx *sql.Tx, fid int64) (bool, error) {
+		res, err := tx.Exec("UPDATE files SET favorite = ? WHERE id = ? AND COALESCE(favorite, 0) != ?", fav, fid, fav)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n > 0, nil
+	})
+}
+
+// RatingHandler sets the 0–5 star rating of many assets; 0 clears it.
+// POST /api/rating  {"paths":["/a.jpg"],"rating":4}
+func RatingHandler(w http.ResponseWriter, r *http.Request) {
+	var req bulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Rating == nil || *req.Rating < 0 || *req.Rating > 5 {
+		http.Error(w, "rating must be 0-5", http.StatusBadRequest)
+		return
+	}
+	rating := nullNum(float64(*req.Rating))
+	bulkApply(w, req, true, func(tx *sql.Tx, fid int64) (bool, error) {
+		res, err := tx.Exec("UPDATE files SET rating = ? WHERE id = ? AND rating IS NOT ?", rating, fid, rating)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n > 0, nil
+	})
+}
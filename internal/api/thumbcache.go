@@ -0,0 +1,335 @@
+package api
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Thumbnails live under DataDir/.thumbs mirroring the source tree. Each file is
+// named "<source name>.m<source mtime, hex ns><thumbVersion>.<w<rendition>|full|sprite|preview>.<format>",
+// so an edited source gets a new cache key and its stale thumbnails become
+// garbage for the GC. "full" entries are full-size conversions (e.g. HEIC ->
+// JPEG); "sprite" and "preview" are video storyboards (see storyboard.go).
+
+// thumbRenditions are the widths thumbnails are generated at; requests are
+// served the nearest rendition so each width is cached exactly once.
+var thumbRenditions = []int{160, 360, 720, 1440}
+
+// defaultRendition is what the grid asks for and the worker pre-generates;
+// the other renditions are generated lazily on first request.
+const defaultRendition = 360
+
+// nearestRendition returns the smallest rendition at least w wide, or the
+// largest one if w exceeds them all.
+func nearestRendition(w int) int {
+	for _, r := range thumbRenditions {
+		if r >= w {
+			return r
+		}
+	}
+	return thumbRenditions[len(thumbRenditions)-1]
+}
+
+// thumbCache tracks cached thumbnails in LRU order and keeps their total size
+// under maxBytes (0 = unlimited).
+type thumbCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	ll       *list.List               // front = most recently used
+	entries  map[string]*list.Element // thumb abs path -> element
+	pinned   map[string]int           // thumb abs path -> requests serving it
+}
+
+type thumbEntry struct {
+	path string
+	size int64
+}
+
+var thumbs = &thumbCache{ll: list.New(), entries: map[string]*list.Element{}, pinned: map[string]int{}}
+
+// thumbTempMaxAge is how long a half-written ".tmp" file is left alone by the
+// GC; older ones are leftovers of a crashed encoder.
+const thumbTempMaxAge = time.Hour
+
+// isThumbTemp reports whether name is an in-flight temp file ("x.tmp",
+// "x.tmp.jpg" for encoders that need the extension)
+func isThumbTemp(name string) bool {
+	return strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, ".tmp"+filepath.Ext(name))
+}
+
+// thumbKey is the cache key component for a source modification time
+func thumbKey(mtime time.Time) string {
+	return "m" + strconv.FormatInt(mtime.UnixNano(), 16)
+}
+
+// thumbVersion is appended to thumbnail cache keys; bump it when renderings
+// change so the old ones are regenerated and collected by the GC.
+// v2: EXIF orientation is applied.
+const thumbVersion = "v2"
+
+// thumbCacheKey is the key of the thumbnails of a source with this mtime
+func thumbCacheKey(mtime time.Time) string {
+	return thumbKey(mtime) + thumbVersion
+}
+
+// parseThumbName splits a thumbnail file name into the source file name and
+// the mtime key it was generated for.
+func parseThumbName(name string) (src, key string, ok bool) {
+	rest := strings.TrimSuffix(name, filepath.Ext(name))
+	// rendition suffix: "w<width>", "full", "sprite", "preview" or "sub<stream>"
+	if i := strings.LastIndex(rest, "."); i > 0 {
+		if v := rest[i+1:]; v == "full" || v == storyboardSprite || v == storyboardPreview {
+			rest = rest[:i]
+		} else if strings.HasPrefix(v, "w") {
+			if _, err := strconv.Atoi(v[1:]); err == nil {
+				rest = rest[:i]
+			}
+		} else if n, ok := strings.CutPrefix(v, "sub"); ok {
+			// extracted subtitle streams (see subtitles.go)
+			if _, err := strconv.Atoi(n); err == nil {
+				rest = rest[:i]
+			}
+		}
+	}
+	i := strings.LastIndex(rest, ".")
+	if i <= 0 {
+		return "", "", false
+	}
+	key = rest[i+1:]
+	if len(key) < 2 || key[0] != 'm' {
+		return "", "", false
+	}
+	stamp := key[1:]
+	if i := strings.IndexByte(stamp, 'v'); i >= 0 {
+		// versioned key; unversioned ones predate thumbVersion
+		if _, err := strconv.Atoi(stamp[i+1:]); err != nil {
+			return "", "", false
+		}
+		stamp = stamp[:i]
+	}
+	if _, err := strconv.ParseInt(stamp, 16, 64); err != nil {
+		return "", "", false
+	}
+	return rest[:i], key, true
+}
+
+// thumbIsLive reports whether a cached thumbnail still belongs to an existing,
+// unmodified source file.
+func thumbIsLive(thumbPath string) bool {
+	root := filepath.Join(DataDir, ".thumbs")
+	rel, err := filepath.Rel(root, thumbPath)
+	if err != nil {
+		return false
+	}
+	src, key, ok := parseThumbName(filepath.Base(rel))
+	if !ok {
+		// pre-cache-manager "<stem>.jpg" thumbnails can't be validated
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(DataDir, filepath.Dir(rel), src))
+	if err != nil {
+		return false
+	}
+	return thumbCacheKey(fi.ModTime()) == key
+}
+
+// add records a freshly written thumbnail and evicts older ones if needed
+func (c *thumbCache) add(path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		e := el.Value.(*thumbEntry)
+		c.size += fi.Size() - e.size
+		e.size = fi.Size()
+		c.ll.MoveToFront(el)
+	} else {
+		c.entries[path] = c.ll.PushFront(&thumbEntry{path: path, size: fi.Size()})
+		c.size += fi.Size()
+	}
+	c.evictLocked()
+}
+
+// touch marks a thumbnail as recently used
+func (c *thumbCache) touch(path string) {
+	c.mu.Lock()
+	el, ok := c.entries[path]
+	if ok {
+		c.ll.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		// generated before the cache was loaded, or by another process
+		c.add(path)
+	}
+}
+
+// pin keeps path from being evicted until the returned func is called, so a
+// thumbnail can't vanish between generating it and serving it. path doesn't
+// have to exist yet.
+func (c *thumbCache) pin(path string) (unpin func()) {
+	c.mu.Lock()
+	c.pinned[path]++
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		if c.pinned[path]--; c.pinned[path] <= 0 {
+			delete(c.pinned, path)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// remove deletes a thumbnail from disk and from the index
+func (c *thumbCache) remove(path string) error {
+	c.mu.Lock()
+	if el, ok := c.entries[path]; ok {
+		c.size -= el.Value.(*thumbEntry).size
+		c.ll.Remove(el)
+		delete(c.entries, path)
+	}
+	c.mu.Unlock()
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *thumbCache) evictLocked() {
+	for el := c.ll.Back(); el != nil && c.maxBytes > 0 && c.size > c.maxBytes && c.ll.Len() > 1; {
+		e := el.Value.(*thumbEntry)
+		prev := el.Prev()
+		if c.pinned[e.path] > 0 {
+			el = prev
+			continue
+		}
+		c.ll.Remove(el)
+		delete(c.entries, e.path)
+		c.size -= e.size
+		if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("thumb cache: evict %s: %v", e.path, err)
+		}
+		el = prev
+	}
+}
+
+func (c *thumbCache) stats() (count int, size, maxBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len(), c.size, c.maxBytes
+}
+
+// InitThumbCache loads existing thumbnails into the LRU (oldest first, by file
+// mtime) and applies the size cap. maxBytes <= 0 means unlimited.
+func InitThumbCache(maxBytes int64) {
+	type found struct {
+		path string
+		size int64
+		mod  time.Time
+	}
+	var all []found
+	root := filepath.Join(DataDir, ".thumbs")
+	_ = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || isThumbTemp(d.Name()) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			all = append(all, found{path, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].mod.Before(all[j].mod) })
+
+	thumbs.mu.Lock()
+	thumbs.maxBytes = maxBytes
+	for _, f := range all {
+		if _, ok := thumbs.entries[f.path]; ok {
+			continue
+		}
+		thumbs.entries[f.path] = thumbs.ll.PushFront(&thumbEntry{path: f.path, size: f.size})
+		thumbs.size += f.size
+	}
+	thumbs.evictLocked()
+	count, size := thumbs.ll.Len(), thumbs.size
+	thumbs.mu.Unlock()
+	log.Printf("thumb cache: %d thumbnails, %d bytes (max %d)", count, size, maxBytes)
+}
+
+// GCThumbnails removes thumbnails whose source was deleted, renamed or edited.
+func GCThumbnails() int {
+	var stale []string
+	root := filepath.Join(DataDir, ".thumbs")
+	_ = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if isThumbTemp(d.Name()) {
+			// still being written, unless it was abandoned long ago
+			if info, err := d.Info(); err != nil || time.Since(info.ModTime()) < thumbTempMaxAge {
+				return nil
+			}
+		} else if thumbIsLive(path) {
+			return nil
+		}
+		stale = append(stale, path)
+		return nil
+	})
+	removed := 0
+	for _, p := range stale {
+		if err := thumbs.remove(p); err != nil {
+			log.Printf("thumb gc: %s: %v", p, err)
+			continue
+		}
+		removed++
+	}
+	removeEmptyDirs(root)
+	if removed > 0 {
+		log.Printf("thumb gc: removed %d stale thumbnails", removed)
+	}
+	return removed
+}
+
+// StartThumbCacheGC runs GCThumbnails every interval. interval <= 0 disables it.
+func StartThumbCacheGC(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			GCThumbnails()
+		}
+	}()
+}
+
+// ThumbCacheHandler reports cache usage (GET) or runs garbage collection (POST).
+// GET|POST /api/thumbnails/cache
+func ThumbCacheHandler(w http.ResponseWriter, r *http.Request) {
+	removed := 0
+	if r.Method == http.MethodPost {
+		removed = GCThumbnails()
+	}
+	count, size, maxBytes := thumbs.stats()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":     count,
+		"bytes":     size,
+		"max_bytes": maxBytes,
+		"removed":   removed,
+	})
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Thumbnail formats. JPEG is always generated first (in-process); WebP and
+// AVIF variants are encoded from the cached JPEG with ffmpeg when its build
+// has the encoder, and cached next to it with their own extension.
+const (
+	thumbJPEG = "jpg"
+	thumbWebP = "webp"
+	thumbAVIF = "avif"
+)
+
+var thumbContentTypes = map[string]string{
+	thumbJPEG: "image/jpeg",
+	thumbWebP: "image/webp",
+	thumbAVIF: "image/avif",
+}
+
+// ffmpeg encoder used per format, in order of preference
+var thumbEncoders = map[string][]string{
+	thumbWebP: {"libwebp"},
+	thumbAVIF: {"libsvtav1", "libaom-av1"},
+}
+
+var (
+	encoderOnce      sync.Once
+	availableEncoder map[string]string // format -> ffmpeg encoder name
+)
+
+// thumbEncoder returns the ffmpeg encoder for format, or "" if unavailable.
+// Detection runs once per process.
+func thumbEncoder(format string) string {
+	encoderOnce.Do(func() {
+		availableEncoder = map[string]string{}
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			return
+		}
+		out, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+		if err != nil {
+			return
+		}
+		for f, names := range thumbEncoders {
+			for _, n := range names {
+				if bytes.Contains(out, []byte(" "+n+" ")) {
+					availableEncoder[f] = n
+					break
+				}
+			}
+		}
+	})
+	return availableEncoder[format]
+}
+
+// acceptQuality returns the q value the Accept header gives mimeType
+// (exact match only; wildcards don't count as support for modern formats).
+func acceptQuality(accept, mimeType string) float64 {
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), mimeType) {
+			continue
+		}
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		return q
+	}
+	return 0
+}
+
+// negotiateThumbFormat picks the smallest format the client accepts and the
+// server can encode: AVIF, then WebP, then JPEG.
+func negotiateThumbFormat(accept string) string {
+	for _, f := range []string{thumbAVIF, thumbWebP} {
+		if acceptQuality(accept, thumbContentTypes[f]) > 0 && thumbEncoder(f) != "" {
+			return f
+		}
+	}
+	return thumbJPEG
+}
+
+// thumbVariantPath is the cache path of a JPEG thumbnail re-encoded as format
+func thumbVariantPath(jpegPath, format string) string {
+	return strings.TrimSuffix(jpegPath, "."+thumbJPEG) + "." + format
+}
+
+// encodeThumbVariant converts the cached JPEG thumbnail into format
+func encodeThumbVariant(jpegPath, dst, format string) error {
+	enc := thumbEncoder(format)
+	if enc == "" {
+		return fmt.Errorf("no %s encoder available", format)
+	}
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", jpegPath, "-c:v", enc}
+	switch format {
+	case thumbWebP:
+		args = append(args, "-quality", "75")
+	case thumbAVIF:
+		args = append(args, "-still-picture", "1", "-crf", "35", "-pix_fmt", "yuv420p")
+	}
+	// write to a temp name so a half-written file is never served
+	tmp := dst + ".tmp"
+	args = append(args, "-f", map[string]string{thumbWebP: "webp", thumbAVIF: "avif"}[format], tmp)
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("ffmpeg %s: %v: %s", format, err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Rename(tmp, dst)
+}
+
+// thumbPathsFor lists every cached rendition/format path for abs
+func thumbPathsFor(abs string) []string {
+	var out []string
+	for _, r := range thumbRenditions {
+		p := thumbPathFor(abs, r)
+		out = append(out, p, thumbVariantPath(p, thumbWebP), thumbVariantPath(p, thumbAVIF))
+	}
+	sprite := thumbCachePath(abs, storyboardSprite)
+	out = append(out, sprite, thumbVariantPath(sprite, "vtt"), previewClipPath(abs))
+	return out
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"localcloud/internal/db"
+)
+
+// takenExpr is when a photo/video was captured, as server-local wall-clock
+// time: the EXIF time (stored as the camera recorded it), else the file mtime
+// (stored in UTC) converted. Prefixes of it sort and group by local date.
+const takenExpr = "COALESCE(exif_datetime, strftime('%Y-%m-%dT%H:%M:%S', mtime, 'localtime'))"
+
+// takenLayout is how capture times are stored: the wall-clock time without
+// a zone, since EXIF doesn't say where the photo was taken
+const takenLayout = "2006-01-02T15:04:05"
+
+// timelineWhere selects library media that have a capture time, counting a
+// RAW+JPEG pair once
+var timelineWhere = `(mime LIKE 'image/%' OR mime LIKE 'video/%') AND canonical_id IS NULL AND ` + takenExpr + ` IS NOT NULL
+	AND NOT ` + rawPairedSQL
+
+// timelineGroups maps a grouping to the RFC3339 prefix length that keys it
+var timelineGroups = map[string]int{
+	"year":  4,  // 2024
+	"month": 7,  // 2024-06
+	"day":   10, // 2024-06-12
+}
+
+// timelineBucketExpr returns the SQL expression keying rows by group
+func timelineBucketExpr(group string) (string, error) {
+	n, ok := timelineGroups[group]
+	if !ok {
+		return "", fmt.Errorf("group must be year, month or day")
+	}
+	return fmt.Sprintf("substr(%s, 1, %d)", takenExpr, n), nil
+}
+
+// TimelineHandler pages through the whole library grouped by capture date,
+// newest first. next_cursor is passed back as cursor for the following page.
+// A bucket with more than per_bucket items carries a next_cursor for
+// TimelineBucketHandler.
+// GET /api/timeline?group=day&limit=20&per_bucket=100&cursor=2024-06-12
+func TimelineHandler(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		group = "day"
+	}
+	bucket, err := timelineBucketExpr(group)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 20
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 200 {
+		limit = v
+	}
+	perBucket := 100
+	if v, err := strconv.Atoi(r.URL.Query().Get("per_bucket")); err == nil && v > 0 && v <= 1000 {
+		perBucket = v
+	}
+	cursor := r.URL.Query().Get("cursor")
+
+	qry := "SELECT " + bucket + " AS k, COUNT(*) FROM files WHERE " + timelineWhere
+	args := []interface{}{}
+	if cursor != "" {
+		qry += " AND " + bucket + " < ?"
+		args = append(args, cursor)
+	}
+	// one extra bucket tells us whether there is a next page
+	qry += " GROUP BY k ORDER BY k DESC LIMIT ?"
+	args = append(args, limit+1)
+	rows, err := db.DB.Query(qry, args...)
+	if err != nil {
+		log.Printf("timeline: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	type bucketRow struct {
+		key   string
+		count int
+	}
+	var keys []bucketRow
+	for rows.Next() {
+		var b bucketRow
+		if err := rows.Scan(&b.key, &b.count); err == nil {
+			keys = append(keys, b)
+		}
+	}
+	rows.Close()
+
+	nextCursor := ""
+	if len(keys) > limit {
+		keys = keys[:limit]
+		nextCursor = keys[len(keys)-1].key
+	}
+	buckets := []map[string]interface{}{}
+	for _, b := range keys {
+		items, next, err := timelineItems(bucket, b.key, "", perBucket)
+		if err != nil {
+			log.Printf("timeline: bucket %s: %v", b.key, err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		buckets = append(buckets, map[string]interface{}{
+			"key":         b.key,
+			"count":       b.count,
+			"items":       items,
+			"next_cursor": next,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"group":       group,
+		"buckets":     buckets,
+		"next_cursor": nextCursor,
+	})
+}
+
+// timelineItems returns up to limit grid-shaped items of one bucket, newest
+// first, starting after cursor ("" for the start). next is the cursor of the
+// following items, or "" at the end of the bucket.
+func timelineItems(bucket, key, cursor string, limit int) (items []map[string]interface{}, next string, err error) {
+	qry := `SELECT id, filename, filepath, mime, uploaded_at, exif_datetime, camera_model
+		FROM files WHERE ` + timelineWhere + ` AND ` + bucket + ` = ?`
+	args := []interface{}{key}
+	if cursor != "" {
+		taken, id, ok := parseTimelineCursor(cursor)
+		if !ok {
+			return nil, "", fmt.Errorf("bad cursor %q", cursor)
+		}
+		qry += ` AND (` + takenExpr + ` < ? OR (` + takenExpr + ` = ? AND id < ?))`
+		args = append(args, taken, taken, id)
+	}
+	// one extra item tells us whether there is more
+	qry += ` ORDER BY ` + takenExpr + ` DESC, id DESC LIMIT ?`
+	args = append(args, limit+1)
+	rows, err := db.DB.Query(qry, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	items = scanMediaRows(rows)
+	rows.Close()
+	if len(items) > limit {
+		items = items[:limit]
+		id, _ := items[limit-1]["id"].(int64)
+		var taken string
+		if err := db.DB.QueryRow(`SELECT `+takenExpr+` FROM files WHERE id = ?`, id).Scan(&taken); err != nil {
+			return nil, "", err
+		}
+		next = taken + "," + strconv.FormatInt(id, 10)
+	}
+	return pairRawJPEG(items), next, nil
+}
+
+// parseTimelineCursor splits an item cursor ("<taken>,<id>")
+func parseTimelineCursor(c string) (taken string, id int64, ok bool) {
+	i := strings.LastIndex(c, ",")
+	if i < 0 {
+		return "", 0, false
+	}
+	id, err := strconv.ParseInt(c[i+1:], 10, 64)
+	return c[:i], id, err == nil
+}
+
+// TimelineBucketHandler pages through the items of one timeline bucket, for
+// buckets larger than per_bucket. cursor is the bucket's next_cursor.
+// GET /api/timeline/bucket?group=day&key=2024-06-12&limit=100&cursor=...
+func TimelineBucketHandler(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		group = "day"
+	}
+	bucket, err := timelineBucketExpr(group)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "key required", http.StatusBadRequest)
+		return
+	}
+	cursor := r.URL.Query().Get("cursor")
+	if _, _, ok := parseTimelineCursor(cursor); cursor != "" && !ok {
+		http.Error(w, "bad cursor", http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+	items, next, err := timelineItems(bucket, key, cursor, limit)
+	if err != nil {
+		log.Printf("timeline: bucket %s: %v", key, err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"group":       group,
+		"key":         key,
+		"items":       items,
+		"next_cursor": next,
+	})
+}
+
+// TimelineCountsHandler returns every bucket with its size, for drawing the
+// timeline scrubber without loading any items.
+// GET /api/timeline/counts?group=month
+func TimelineCountsHandler(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		group = "month"
+	}
+	bucket, err := timelineBucketExpr(group)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := db.DB.Query("SELECT " + bucket + " AS k, COUNT(*) FROM files WHERE " + timelineWhere + " GROUP BY k ORDER BY k DESC")
+	if err != nil {
+		log.Printf("timeline counts: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	counts := []map[string]interface{}{}
+	total := 0
+	for rows.Next() {
+		var k string
+		var n int
+		if err := rows.Scan(&k, &n); err == nil {
+			counts = append(counts, map[string]interface{}{"key": k, "count": n})
+			total += n
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"group":   group,
+		"buckets": counts,
+		"total":   total,
+	})
+}
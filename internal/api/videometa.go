@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// audioTrack describes one audio stream of a video
+type audioTrack struct {
+	Codec      string `json:"codec"`
+	Channels   int    `json:"channels,omitempty"`
+	Layout     string `json:"layout,omitempty"` // "stereo", "5.1(side)"
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Bitrate    int64  `json:"bitrate,omitempty"`
+	Language   string `json:"language,omitempty"`
+}
+
+// ffprobeOutput is the subset of `ffprobe -print_format json -show_format
+// -show_streams` we read
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType    string            `json:"codec_type"`
+		CodecName    string            `json:"codec_name"`
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		AvgFrameRate string            `json:"avg_frame_rate"`
+		RFrameRate   string            `json:"r_frame_rate"`
+		BitRate      string            `json:"bit_rate"`
+		Channels     int               `json:"channels"`
+		Layout       string            `json:"channel_layout"`
+		SampleRate   string            `json:"sample_rate"`
+		Tags         map[string]string `json:"tags"`
+		Disposition  map[string]int    `json:"disposition"`
+		SideData     []struct {
+			Rotation *float64 `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+	Format struct {
+		Duration string            `json:"duration"`
+		BitRate  string            `json:"bit_rate"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+// probeVideoMeta runs ffprobe on abs once and fills in the video fields of m.
+func probeVideoMeta(abs string, m *photoMeta) error {
+	out, err := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", abs).Output()
+	if err != nil {
+		return fmt.Errorf("ffprobe: %w", err)
+	}
+	return parseFFprobe(out, m)
+}
+
+// parseFFprobe fills in m from ffprobe JSON: codecs, display size, frame
+// rate, bitrate, rotation, audio tracks, and from the container tags the
+// creation time, camera and QuickTime/Android GPS location.
+func parseFFprobe(data []byte, m *photoMeta) error {
+	var p ffprobeOutput
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("ffprobe: %w", err)
+	}
+	m.Duration, _ = strconv.ParseFloat(p.Format.Duration, 64)
+	m.Bitrate, _ = strconv.ParseInt(p.Format.BitRate, 10, 64)
+	m.AudioTracks = nil
+	for _, s := range p.Streams {
+		switch s.CodecType {
+		case "video":
+			// cover art and thumbnails embedded as attached pictures aren't the video
+			if m.VideoCodec != "" || s.Disposition["attached_pic"] == 1 {
+				continue
+			}
+			m.VideoCodec = s.CodecName
+			m.FrameRate = parseFrameRate(s.AvgFrameRate)
+			if m.FrameRate == 0 {
+				m.FrameRate = parseFrameRate(s.RFrameRate)
+			}
+			// older ffprobe reports the "rotate" tag, newer a display
+			// matrix whose rotation is counter-clockwise
+			if r, err := strconv.Atoi(s.Tags["rotate"]); err == nil {
+				m.Rotation = r
+			} else {
+				for _, sd := range s.SideData {
+					if sd.Rotation != nil {
+						m.Rotation = -int(math.Round(*sd.Rotation))
+					}
+				}
+			}
+			m.Rotation = ((m.Rotation % 360) + 360) % 360
+			// the size the video is shown at, like EXIF dimensions of photos
+			m.Width, m.Height = s.Width, s.Height
+			if m.Rotation == 90 || m.Rotation == 270 {
+				m.Width, m.Height = s.Height, s.Width
+			}
+		case "audio":
+			t := audioTrack{Codec: s.CodecName, Channels: s.Channels, Layout: s.Layout, Language: s.Tags["language"]}
+			t.SampleRate, _ = strconv.Atoi(s.SampleRate)
+			t.Bitrate, _ = strconv.ParseInt(s.BitRate, 10, 64)
+			if t.Language == "und" {
+				t.Language = ""
+			}
+			m.AudioTracks = append(m.AudioTracks, t)
+		}
+	}
+
+	tags := map[string]string{}
+	for k, v := range p.Format.Tags {
+		tags[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+	m.DateTime = videoCreationTime(tags)
+	m.Make = firstTag(tags, "com.apple.quicktime.make", "com.android.manufacturer", "make")
+	m.Model = firstTag(tags, "com.apple.quicktime.model", "com.android.model", "model")
+	if lat, lon, alt, ok := parseISO6709(firstTag(tags, "com.apple.quicktime.location.iso6709", "location", "location-eng")); ok {
+		m.GPS = &gpsFix{Lat: lat, Lon: lon, Alt: alt}
+		m.Place = reverseGeocode(lat, lon)
+	}
+	return nil
+}
+
+func firstTag(tags map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v := tags[k]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseFrameRate parses ffprobe's "30000/1001" rates, rounded to 3 decimals
+func parseFrameRate(s string) float64 {
+	n, d, ok := strings.Cut(s, "/")
+	num, err := strconv.ParseFloat(n, 64)
+	if err != nil {
+		return 0
+	}
+	if ok {
+		den, err := strconv.ParseFloat(d, 64)
+		if err != nil || den == 0 {
+			return 0
+		}
+		num /= den
+	}
+	return math.Round(num*1000) / 1000
+}
+
+// videoCreationTime returns the capture time of a video in takenLayout.
+// Apple's creationdate keeps the wall-clock time where it was shot;
+// creation_time is UTC and is shown in server-local time. Unset QuickTime
+// dates (the 1904/1970 epochs) are ignored.
+func videoCreationTime(tags map[string]string) string {
+	if v := tags["com.apple.quicktime.creationdate"]; v != "" {
+		for _, layout := range []string{"2006-01-02T15:04:05-0700", time.RFC3339} {
+			if t, err := time.Parse(layout, v); err == nil && t.Year() > 1970 {
+				return t.Format(takenLayout)
+			}
+		}
+	}
+	if v := tags["creation_time"]; v != "" {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil && t.Year() > 1970 {
+			return t.Local().Format(takenLayout)
+		}
+	}
+	return ""
+}
+
+// iso6709 matches "+48.8584+002.2945+035.000/" style locations
+var iso6709 = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)?`)
+
+// parseISO6709 parses a QuickTime/Android location string
+func parseISO6709(s string) (lat, lon float64, alt *float64, ok bool) {
+	sm := iso6709.FindStringSubmatch(s)
+	if sm == nil {
+		return 0, 0, nil, false
+	}
+	lat, _ = strconv.ParseFloat(sm[1], 64)
+	lon, _ = strconv.ParseFloat(sm[2], 64)
+	if math.Abs(lat) > 90 || math.Abs(lon) > 180 || (lat == 0 && lon == 0) {
+		return 0, 0, nil, false
+	}
+	if sm[3] != "" {
+		if a, err := strconv.ParseFloat(sm[3], 64); err == nil {
+			alt = &a
+		}
+	}
+	return lat, lon, alt, true
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testdata/ffprobe/*.json are `ffprobe -print_format json -show_format
+// -show_streams` output for an iPhone HEVC clip (display matrix rotation), an
+// Android clip (rotate tag, older ffprobe) and a camera clip with cover art,
+// two audio tracks and an unset 1904 creation time.
+func TestParseFFprobe(t *testing.T) {
+	alt := 35.0
+	tests := []struct {
+		file string
+		want photoMeta
+	}{
+		{"iphone_hevc.json", photoMeta{
+			Duration: 12.345, Bitrate: 8304485, VideoCodec: "hevc", FrameRate: 29.97,
+			Rotation: 90, Width: 1080, Height: 1920,
+			AudioTracks: []audioTrack{{Codec: "aac", Channels: 2, Layout: "stereo", SampleRate: 44100, Bitrate: 164000}},
+			DateTime:    "2024-06-12T00:30:05",
+			Make:        "Apple", Model: "iPhone 15 Pro",
+			GPS: &gpsFix{Lat: 48.8584, Lon: 2.2945, Alt: &alt},
+		}},
+		{"android_rotate.json", photoMeta{
+			Duration: 4.01, Bitrate: 12104389, VideoCodec: "h264", FrameRate: 30,
+			Rotation: 270, Width: 720, Height: 1280,
+			AudioTracks: []audioTrack{{Codec: "aac", Channels: 1, Layout: "mono", SampleRate: 48000, Bitrate: 96000, Language: "eng"}},
+			DateTime:    time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC).Local().Format(takenLayout),
+			Make:        "Google", Model: "Pixel 7",
+			GPS: &gpsFix{Lat: 37.7749, Lon: -122.4194},
+		}},
+		{"camera_1904.json", photoMeta{
+			Duration: 60.06, Bitrate: 100178240, VideoCodec: "h264", FrameRate: 25,
+			Width: 3840, Height: 2160,
+			AudioTracks: []audioTrack{
+				{Codec: "aac", Channels: 6, Layout: "5.1", SampleRate: 48000, Bitrate: 384000, Language: "eng"},
+				{Codec: "ac3", Channels: 2, Layout: "stereo", SampleRate: 48000, Bitrate: 192000, Language: "fra"},
+			},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "ffprobe", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m photoMeta
+			if err := parseFFprobe(data, &m); err != nil {
+				t.Fatal(err)
+			}
+			// the place depends on the loaded city list
+			m.Place = ""
+			if !reflect.DeepEqual(m, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", m, tt.want)
+				if m.GPS != nil && tt.want.GPS != nil {
+					t.Errorf("gps = %+v, want %+v", *m.GPS, *tt.want.GPS)
+				}
+			}
+		})
+	}
+}
+
+// The display matrix rotation is counter-clockwise, the rotate tag and the
+// stored rotation clockwise.
+func TestParseFFprobeRotation(t *testing.T) {
+	tests := []struct {
+		stream string
+		want   int
+	}{
+		{`"side_data_list": [{"rotation": -90}]`, 90},
+		{`"side_data_list": [{"rotation": 90}]`, 270},
+		{`"side_data_list": [{"rotation": 180}]`, 180},
+		{`"side_data_list": [{"rotation": -180}]`, 180},
+		{`"side_data_list": [{"rotation": 0}]`, 0},
+		{`"tags": {"rotate": "90"}`, 90},
+		{`"tags": {"rotate": "-90"}`, 270},
+		{`"tags": {"rotate": "90"}, "side_data_list": [{"rotation": 90}]`, 90},
+	}
+	for _, tt := range tests {
+		data := []byte(`{"streams": [{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080, ` + tt.stream + `}], "format": {}}`)
+		var m photoMeta
+		if err := parseFFprobe(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Rotation != tt.want {
+			t.Errorf("%s: rotation = %d, want %d", tt.stream, m.Rotation, tt.want)
+		}
+		if portrait := m.Width < m.Height; portrait != (tt.want%180 == 90) {
+			t.Errorf("%s: size = %dx%d", tt.stream, m.Width, m.Height)
+		}
+	}
+}
+
+func TestParseISO6709(t *testing.T) {
+	tests := []struct {
+		in       string
+		lat, lon float64
+		alt      float64 // 0 = none
+		ok       bool
+	}{
+		{"+48.8584+002.2945+035.000/", 48.8584, 2.2945, 35, true},
+		{"+37.7749-122.4194/", 37.7749, -122.4194, 0, true},
+		{"-33.8688+151.2093-012.5/", -33.8688, 151.2093, -12.5, true},
+		{"+35-120/", 35, -120, 0, true},
+		{"+00.0000+000.0000/", 0, 0, 0, false}, // unset
+		{"+91.0000+000.0000/", 0, 0, 0, false},
+		{"+10.0000+181.0000/", 0, 0, 0, false},
+		{"48.8584,2.2945", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		lat, lon, alt, ok := parseISO6709(tt.in)
+		if ok != tt.ok || lat != tt.lat || lon != tt.lon {
+			t.Errorf("%q: got %v, %v, ok=%v; want %v, %v, ok=%v", tt.in, lat, lon, ok, tt.lat, tt.lon, tt.ok)
+			continue
+		}
+		switch {
+		case tt.alt == 0 && alt != nil:
+			t.Errorf("%q: alt = %v, want none", tt.in, *alt)
+		case tt.alt != 0 && (alt == nil || *alt != tt.alt):
+			t.Errorf("%q: alt = %v, want %v", tt.in, alt, tt.alt)
+		}
+	}
+}
+
+func TestVideoCreationTime(t *testing.T) {
+	local := func(s string) string {
+		ts, _ := time.Parse(time.RFC3339, s)
+		return ts.Local().Format(takenLayout)
+	}
+	tests := []struct {
+		name string
+		tags map[string]string
+		want string
+	}{
+		{"apple keeps the wall clock", map[string]string{"com.apple.quicktime.creationdate": "2024-06-12T00:30:05+0530"}, "2024-06-12T00:30:05"},
+		{"apple RFC3339", map[string]string{"com.apple.quicktime.creationdate": "2024-06-12T00:30:05-07:00"}, "2024-06-12T00:30:05"},
+		{"apple wins over creation_time", map[string]string{
+			"com.apple.quicktime.creationdate": "2024-06-12T00:30:05+0530",
+			"creation_time":                    "2024-06-11T19:00:05.000000Z",
+		}, "2024-06-12T00:30:05"},
+		{"creation_time is UTC", map[string]string{"creation_time": "2024-06-11T19:00:05.000000Z"}, local("2024-06-11T19:00:05Z")},
+		{"unset 1904 epoch", map[string]string{"creation_time": "1904-01-01T00:00:00.000000Z"}, ""},
+		{"unset 1970 epoch", map[string]string{"creation_time": "1970-01-01T00:00:00.000000Z"}, ""},
+		{"unset apple date falls back", map[string]string{
+			"com.apple.quicktime.creationdate": "1904-01-01T00:00:00+0000",
+			"creation_time":                    "2024-06-11T19:00:05.000000Z",
+		}, local("2024-06-11T19:00:05Z")},
+		{"garbage", map[string]string{"creation_time": "yesterday"}, ""},
+		{"none", map[string]string{}, ""},
+	}
+	for _, tt := range tests {
+		if got := videoCreationTime(tt.tags); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,15 +1,104 @@
 package config
 
-import "os"
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
 
 var (
-	DataDir  string
-	BindPort string
+	DataDir   string
+	BindPort  string
+	DedupMode string // "", "hardlink" or "canonical"
+
+	// ScrubInterval is how often stored files are re-hashed; 0 disables scrubbing
+	ScrubInterval time.Duration
+
+	// thumbnail cache size cap (0 = unlimited) and orphan GC interval
+	ThumbCacheMaxMB int64
+	ThumbGCInterval time.Duration
+
+	// optional GeoNames dump used instead of the bundled city list
+	GeoNamesFile string
+
+	// XMP sidecars: write catalog edits back to them (opt-in), and how often
+	// to re-import ones edited elsewhere (0 = only at startup)
+	XMPWrite            bool
+	SidecarSyncInterval time.Duration
+
+	// HLS segment cache size cap (0 = unlimited)
+	StreamCacheMaxMB int64
+
+	// background encoders for web video proxies (0 = no proxies), and how
+	// often to sweep the catalog for videos still needing one (0 = only at
+	// startup)
+	ProxyWorkers       int
+	ProxySweepInterval time.Duration
+
+	// generate video preview clips with thumbnails instead of on first view
+	PreviewClips bool
 )
 
 func LoadConfig() {
 	DataDir = getenv("DATA_DIR", "./data")
 	BindPort = getenv("PORT", getenv("BIND_PORT", "8080"))
+	DedupMode = getenv("DEDUP_MODE", "")
+	ScrubInterval = getduration("SCRUB_INTERVAL", 168*time.Hour)
+	ThumbCacheMaxMB = getint("THUMB_CACHE_MAX_MB", 2048)
+	ThumbGCInterval = getduration("THUMB_GC_INTERVAL", 24*time.Hour)
+	GeoNamesFile = getenv("GEONAMES_FILE", "")
+	XMPWrite = getbool("XMP_WRITE", false)
+	SidecarSyncInterval = getduration("SIDECAR_SYNC_INTERVAL", 10*time.Minute)
+	StreamCacheMaxMB = getint("STREAM_CACHE_MAX_MB", 10240)
+	ProxyWorkers = int(getint("PROXY_WORKERS", 1))
+	ProxySweepInterval = getduration("PROXY_SWEEP_INTERVAL", time.Hour)
+	PreviewClips = getbool("VIDEO_PREVIEW_CLIPS", false)
+}
+
+// getint parses an integer setting; a typo falls back to the default
+// instead of silently becoming 0
+func getint(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Printf("config: %s=%q: %v; using %d", key, v, err, def)
+		return def
+	}
+	return n
+}
+
+// getbool parses a boolean setting (1/0, true/false, ...); a typo falls
+// back to the default
+func getbool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("config: %s=%q: %v; using %t", key, v, err, def)
+		return def
+	}
+	return b
+}
+
+// getduration parses a duration setting; a typo falls back to the default
+// instead of silently disabling what the setting schedules
+func getduration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("config: %s=%q: %v; using %s", key, v, err, def)
+		return def
+	}
+	return d
 }
 
 func getenv(key, def string) string {
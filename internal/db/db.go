@@ -76,17 +76,21 @@ func IndexDataDirSync(dataDir string) ([]string, error) {
 
 	log.Printf("IndexDataDirSync: indexing recursively under %s", absData)
 
-	// Prepare statements once (concurrency-safe with separate Tx usage)
-	insertSQL := `INSERT OR IGNORE INTO files(filename, filepath, mime, uploaded_at) VALUES (?, ?, ?, ?);`
-	updateSQL := `UPDATE files SET mime = ?, uploaded_at = ? WHERE filepath = ?;`
+	// older versions cataloged the backup copies as if they were originals
+	if res, err := DB.Exec("DELETE FROM files WHERE NOT " + NotBackupSQL); err == nil {
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("IndexDataDirSync: dropped %d backup copies from the catalog", n)
+		}
+	}
 
-	insertStmt, err := DB.Prepare(insertSQL)
+	// Prepare statements once (concurrency-safe with separate Tx usage)
+	insertStmt, err := DB.Prepare(insertFileSQL)
 	if err != nil {
 		return nil, fmt.Errorf("prepare insert: %w", err)
 	}
 	defer insertStmt.Close()
 
-	updateStmt, err := DB.Prepare(updateSQL)
+	updateStmt, err := DB.Prepare(updateFileSQL)
 	if err != nil {
 		return nil, fmt.Errorf("prepare update: %w", err)
 	}
@@ -106,26 +110,14 @@ func IndexDataDirSync(dataDir string) ([]string, error) {
 		// Skip directories we don't want to descend
 		if d.IsDir() {
 			base := d.Name()
-			if strings.HasPrefix(base, ".") || base == ".thumbs" {
+			if strings.HasPrefix(base, ".") || base == ".thumbs" || path == filepath.Join(absData, BackupDir) {
 				return filepath.SkipDir
 			}
 			return nil
 		}
 
-		// Skip files with any hidden component
 		relRaw, err := filepath.Rel(absData, path)
-		if err != nil {
-			return nil
-		}
-		parts := strings.Split(relRaw, string(os.PathSeparator))
-		for _, p := range parts {
-			if strings.HasPrefix(p, ".") {
-				return nil
-			}
-		}
-
-		// Skip the DB file itself if located inside dataDir
-		if relRaw == "metadata.db" || strings.HasSuffix(path, "metadata.db") {
+		if err != nil || SkipIndexPath(relRaw) {
 			return nil
 		}
 
@@ -137,12 +129,9 @@ func IndexDataDirSync(dataDir string) ([]string, error) {
 
 		apiPath := "/" + filepath.ToSlash(relRaw)
 		name := info.Name()
-		ext := strings.ToLower(filepath.Ext(name))
-		mt := mime.TypeByExtension(ext)
-		if mt == "" {
-			mt = "application/octet-stream"
-		}
+		mt := mimeFor(name)
 		now := time.Now().UTC().Format(time.RFC3339)
+		mtime := info.ModTime().UTC().Format(time.RFC3339)
 
 		// Use a transaction for upsert per-file to reduce contention and ensure consistency
 		tx, err := DB.Begin()
@@ -156,8 +145,8 @@ func IndexDataDirSync(dataDir string) ([]string, error) {
 			_ = tx.Rollback()
 			return nil
 		}
-		// update mime/uploaded_at in case the row existed without them
-		if _, err := tx.Stmt(updateStmt).Exec(mt, now, apiPath); err != nil {
+		// update mime/uploaded_at/size/mtime in case the row existed without them
+		if _, err := tx.Stmt(updateStmt).Exec(mt, now, info.Size(), mtime, apiPath); err != nil {
 			log.Printf("index update error for %s: %v", apiPath, err)
 			_ = tx.Rollback()
 			return nil
@@ -182,6 +171,67 @@ func IndexDataDirSync(dataDir string) ([]string, error) {
 	return processed, nil
 }
 
+// BackupDir is where the backup worker keeps its copies, relative to the
+// data dir. They aren't originals, so the catalog leaves them out.
+const BackupDir = "backups"
+
+// NotBackupSQL excludes catalog rows of backup copies, for queries that must
+// never treat a copy as a primary
+const NotBackupSQL = `filepath NOT LIKE '/` + BackupDir + `/%'`
+
+const (
+	insertFileSQL = `INSERT OR IGNORE INTO files(filename, filepath, mime, uploaded_at) VALUES (?, ?, ?, ?);`
+	// sha256 and metadata_at are cleared when size/mtime changed so the
+	// background hasher and metadata extractor pick the file up again.
+	// Args: mime, uploaded_at, size, mtime, filepath.
+	updateFileSQL = `UPDATE files SET mime = ?1, uploaded_at = ?2,
+		sha256 = CASE WHEN size IS ?3 AND mtime IS ?4 THEN sha256 ELSE NULL END,
+		metadata_at = CASE WHEN size IS ?3 AND mtime IS ?4 THEN metadata_at ELSE NULL END,
+		size = ?3, mtime = ?4 WHERE filepath = ?5;`
+)
+
+// SkipIndexPath reports whether a path relative to the data dir is left out of
+// the catalog: anything with a hidden component, the backup copies, XMP
+// sidecars (they describe other files) and the DB file itself (plus its
+// WAL/shared-memory files).
+func SkipIndexPath(rel string) bool {
+	parts := strings.Split(rel, string(os.PathSeparator))
+	if len(parts) > 1 && parts[0] == BackupDir {
+		return true
+	}
+	for _, p := range parts {
+		if strings.HasPrefix(p, ".") {
+			return true
+		}
+	}
+	base := filepath.Base(rel)
+	if strings.EqualFold(filepath.Ext(base), ".xmp") {
+		return true
+	}
+	return base == "metadata.db" || strings.HasPrefix(base, "metadata.db-")
+}
+
+// UpsertFile inserts or refreshes the catalog row for a single file.
+// apiPath is the "/dir/file" path relative to the data dir.
+func UpsertFile(apiPath string, info os.FileInfo) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	mtime := info.ModTime().UTC().Format(time.RFC3339)
+	mt := mimeFor(info.Name())
+	if _, err := DB.Exec(insertFileSQL, info.Name(), apiPath, mt, now); err != nil {
+		return err
+	}
+	_, err := DB.Exec(updateFileSQL, mt, now, info.Size(), mtime, apiPath)
+	return err
+}
+
+func mimeFor(name string) string {
+	mt := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if mt == "" {
+		mt = "application/octet-stream"
+	}
+	return mt
+}
+
 // createFilesTable ensures minimal files table exists
 func createFilesTable() error {
 	stmt := `
@@ -225,6 +275,47 @@ func ensureColumns() error {
 		"uploaded_at":   "DATETIME DEFAULT CURRENT_TIMESTAMP",
 		"exif_datetime": "TEXT",
 		"camera_model":  "TEXT",
+		"size":          "INTEGER",
+		"mtime":         "TEXT",
+		"sha256":        "TEXT",
+		"hashed_at":     "TEXT",
+		"canonical_id":  "INTEGER",
+		"phash":         "TEXT",
+		"width":         "INTEGER",
+		"height":        "INTEGER",
+		"camera_make":   "TEXT",
+		"lens_model":    "TEXT",
+		"focal_length":  "REAL",
+		"aperture":      "REAL",
+		"iso":           "INTEGER",
+		"exposure_time": "TEXT",
+		"orientation":   "INTEGER",
+		"gps_lat":       "REAL",
+		"gps_lon":       "REAL",
+		"gps_alt":       "REAL",
+		"place":         "TEXT",
+		"rating":        "INTEGER",
+		"keywords":      "TEXT",
+		"favorite":      "INTEGER DEFAULT 0",
+		"title":         "TEXT",
+		"song_title":    "TEXT",
+		"description":   "TEXT",
+		"xmp_mtime":     "INTEGER",
+		"duration":      "REAL",
+		"video_codec":   "TEXT",
+		"frame_rate":    "REAL",
+		"bitrate":       "INTEGER",
+		"rotation":      "INTEGER",
+		"audio_codec":   "TEXT",
+		"audio_tracks":  "TEXT",
+		"artist":        "TEXT",
+		"album_artist":  "TEXT",
+		"album":         "TEXT",
+		"track":         "INTEGER",
+		"disc":          "INTEGER",
+		"year":          "INTEGER",
+		"genre":         "TEXT",
+		"metadata_at":   "TEXT",
 	}
 
 	for col, def := range cols {
@@ -243,7 +334,12 @@ func ensureColumns() error {
 func ensureIndexes() error {
 	stmts := []string{
 		"CREATE INDEX IF NOT EXISTS idx_files_filename ON files(filename);",
+		// RAW+JPEG pairing looks siblings up case-insensitively
+		"CREATE INDEX IF NOT EXISTS idx_files_filepath_lower ON files(lower(filepath));",
 		"CREATE INDEX IF NOT EXISTS idx_files_uploaded_at ON files(uploaded_at);",
+		"CREATE INDEX IF NOT EXISTS idx_files_sha256 ON files(sha256);",
+		"CREATE INDEX IF NOT EXISTS idx_files_phash ON files(phash);",
+		"CREATE INDEX IF NOT EXISTS idx_files_gps ON files(gps_lat, gps_lon);",
 	}
 	for _, s := range stmts {
 		if _, err := DB.Exec(s); err != nil {